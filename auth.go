@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net"
 	"strings"
 
 	"golang.org/x/crypto/ssh"
@@ -10,6 +11,7 @@ import (
 
 func (cfg *config) getAuthLogCallback() func(conn ssh.ConnMetadata, method string, err error) {
 	return func(conn ssh.ConnMetadata, method string, err error) {
+		cfg.authTimelines.record(conn.SessionID(), method, conn.User(), err)
 		if method == "none" {
 			connContext{ConnMetadata: conn, cfg: cfg}.logEvent(noAuthLog{authLog: authLog{
 				User:     conn.User(),
@@ -19,22 +21,38 @@ func (cfg *config) getAuthLogCallback() func(conn ssh.ConnMetadata, method strin
 	}
 }
 
+// remoteIP returns the client's IP address, or nil if the connection is not
+// over TCP.
+func remoteIP(conn ssh.ConnMetadata) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
 func (cfg *config) getPasswordCallback() func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
 	if !cfg.Auth.PasswordAuth.Enabled {
 		return nil
 	}
 	return func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		cfg.delayAuth(conn)
+		accepted := cfg.authenticate(authRequest{
+			Method:    "password",
+			User:      conn.User(),
+			ClientIP:  remoteIP(conn),
+			Passwords: []string{string(password)},
+		}, cfg.Auth.PasswordAuth.Accepted)
 		connContext{ConnMetadata: conn, cfg: cfg}.logEvent(passwordAuthLog{
 			authLog: authLog{
 				User:     conn.User(),
-				Accepted: authAccepted(cfg.Auth.PasswordAuth.Accepted),
+				Accepted: authAccepted(accepted),
 			},
 			Password: string(password),
 		})
-		if !cfg.Auth.PasswordAuth.Accepted {
+		if !accepted {
 			return nil, errors.New("")
 		}
-		return nil, nil
+		return cfg.permissions(conn.User()), nil
 	}
 }
 
@@ -43,17 +61,33 @@ func (cfg *config) getPublicKeyCallback() func(conn ssh.ConnMetadata, key ssh.Pu
 		return nil
 	}
 	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-		connContext{ConnMetadata: conn, cfg: cfg}.logEvent(publicKeyAuthLog{
+		cfg.delayAuth(conn)
+		fingerprint := ssh.FingerprintSHA256(key)
+		accepted := cfg.authenticate(authRequest{
+			Method:         "public_key",
+			User:           conn.User(),
+			ClientIP:       remoteIP(conn),
+			Key:            key,
+			KeyFingerprint: fingerprint,
+		}, cfg.Auth.PublicKeyAuth.Accepted)
+		entry := publicKeyAuthLog{
 			authLog: authLog{
 				User:     conn.User(),
-				Accepted: authAccepted(cfg.Auth.PublicKeyAuth.Accepted),
+				Accepted: authAccepted(accepted),
 			},
-			PublicKeyFingerprint: ssh.FingerprintSHA256(key),
-		})
-		if !cfg.Auth.PublicKeyAuth.Accepted {
+			PublicKeyFingerprint: fingerprint,
+			KeyType:              key.Type(),
+			KeyBits:              keyBits(key),
+			KeyBlob:              encodeKeyBlob(key),
+		}
+		if cert, ok := key.(*ssh.Certificate); ok {
+			entry.Certificate = newCertificateLog(cert)
+		}
+		connContext{ConnMetadata: conn, cfg: cfg}.logEvent(entry)
+		if !accepted {
 			return nil, errors.New("")
 		}
-		return nil, nil
+		return cfg.permissions(conn.User()), nil
 	}
 }
 
@@ -61,29 +95,61 @@ func (cfg *config) getKeyboardInteractiveCallback() func(conn ssh.ConnMetadata,
 	if !cfg.Auth.KeyboardInteractiveAuth.Enabled {
 		return nil
 	}
-	var keyboardInteractiveQuestions []string
-	var keyboardInteractiveEchos []bool
-	for _, question := range cfg.Auth.KeyboardInteractiveAuth.Questions {
-		keyboardInteractiveQuestions = append(keyboardInteractiveQuestions, question.Text)
-		keyboardInteractiveEchos = append(keyboardInteractiveEchos, question.Echo)
+	rounds := cfg.Auth.KeyboardInteractiveAuth.Rounds
+	if len(rounds) == 0 {
+		rounds = []keyboardInteractiveRound{{
+			Instruction: cfg.Auth.KeyboardInteractiveAuth.Instruction,
+			Questions:   cfg.Auth.KeyboardInteractiveAuth.Questions,
+		}}
 	}
 	return func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
-		answers, err := client(conn.User(), cfg.Auth.KeyboardInteractiveAuth.Instruction, keyboardInteractiveQuestions, keyboardInteractiveEchos)
-		if err != nil {
-			warningLogger.Printf("Failed to process keyboard interactive authentication: %v", err)
-			return nil, errors.New("")
+		for i, round := range rounds {
+			var questions []string
+			var echos []bool
+			for _, question := range round.Questions {
+				questions = append(questions, question.Text)
+				echos = append(echos, question.Echo)
+			}
+			answers, err := client(conn.User(), round.Instruction, questions, echos)
+			if err != nil {
+				warningLogger.Printf("Failed to process keyboard interactive authentication: %v", err)
+				return nil, errors.New("")
+			}
+			cfg.delayAuth(conn)
+			request := authRequest{
+				Method:    "keyboard_interactive",
+				User:      conn.User(),
+				ClientIP:  remoteIP(conn),
+				Passwords: answers,
+			}
+			accepted, decided := false, false
+			if i < len(cfg.roundRules) {
+				for _, rule := range cfg.roundRules[i] {
+					if rule.matches(request) {
+						accepted, decided = rule.accept, true
+						break
+					}
+				}
+			}
+			if !decided {
+				accepted = cfg.authenticate(request, cfg.Auth.KeyboardInteractiveAuth.Accepted)
+			}
+			entry := keyboardInteractiveAuthLog{
+				authLog: authLog{
+					User:     conn.User(),
+					Accepted: authAccepted(accepted),
+				},
+				Answers: answers,
+			}
+			if len(cfg.Auth.KeyboardInteractiveAuth.Rounds) > 0 {
+				entry.Round = i + 1
+			}
+			connContext{ConnMetadata: conn, cfg: cfg}.logEvent(entry)
+			if !accepted {
+				return nil, errors.New("")
+			}
 		}
-		connContext{ConnMetadata: conn, cfg: cfg}.logEvent(keyboardInteractiveAuthLog{
-			authLog: authLog{
-				User:     conn.User(),
-				Accepted: authAccepted(cfg.Auth.KeyboardInteractiveAuth.Accepted),
-			},
-			Answers: answers,
-		})
-		if !cfg.Auth.KeyboardInteractiveAuth.Accepted {
-			return nil, errors.New("")
-		}
-		return nil, nil
+		return cfg.permissions(conn.User()), nil
 	}
 }
 
@@ -91,9 +157,16 @@ func (cfg *config) getBannerCallback() func(conn ssh.ConnMetadata) string {
 	if cfg.SSHProto.Banner == "" {
 		return nil
 	}
-	banner := strings.ReplaceAll(strings.ReplaceAll(cfg.SSHProto.Banner, "\r\n", "\n"), "\n", "\r\n")
-	if !strings.HasSuffix(banner, "\r\n") {
+	banner := formatBanner(cfg.SSHProto.Banner)
+	return func(conn ssh.ConnMetadata) string { return banner }
+}
+
+// formatBanner normalizes line endings to CRLF and terminates the banner with
+// a line ending.
+func formatBanner(banner string) string {
+	banner = strings.ReplaceAll(strings.ReplaceAll(banner, "\r\n", "\n"), "\n", "\r\n")
+	if banner != "" && !strings.HasSuffix(banner, "\r\n") {
 		banner = fmt.Sprintf("%v\r\n", banner)
 	}
-	return func(conn ssh.ConnMetadata) string { return banner }
+	return banner
 }
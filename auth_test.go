@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"net"
 	"reflect"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 type mockConnContext struct{}
@@ -256,7 +260,7 @@ func TestPublicKeyFailJSON(t *testing.T) {
 	if permissions != nil {
 		t.Errorf("permissions=%v, want nil", permissions)
 	}
-	expectedLogs := `{"source":"127.0.0.1:1234","event_type":"public_key_auth","event":{"user":"root","accepted":false,"public_key":"SHA256:9faRaLujz6HiqA3/g5tI2zbfNvqHbBzZ19UI86swh0Q"}}
+	expectedLogs := `{"source":"127.0.0.1:1234","event_type":"public_key_auth","event":{"user":"root","accepted":false,"public_key":"SHA256:9faRaLujz6HiqA3/g5tI2zbfNvqHbBzZ19UI86swh0Q","key_type":"rsa","key_bits":0,"key_blob":"cnNh"}}
 `
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", string(logs), expectedLogs)
@@ -281,7 +285,7 @@ func TestPublicKeySuccessJSON(t *testing.T) {
 	if permissions != nil {
 		t.Errorf("permissions=%v, want nil", permissions)
 	}
-	expectedLogs := `{"source":"127.0.0.1:1234","event_type":"public_key_auth","event":{"user":"root","accepted":true,"public_key":"SHA256:9faRaLujz6HiqA3/g5tI2zbfNvqHbBzZ19UI86swh0Q"}}
+	expectedLogs := `{"source":"127.0.0.1:1234","event_type":"public_key_auth","event":{"user":"root","accepted":true,"public_key":"SHA256:9faRaLujz6HiqA3/g5tI2zbfNvqHbBzZ19UI86swh0Q","key_type":"rsa","key_bits":0,"key_blob":"cnNh"}}
 `
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", string(logs), expectedLogs)
@@ -492,3 +496,95 @@ func TestBanner(t *testing.T) {
 		t.Errorf("banner=%v, want %v", banner, expectedBanner)
 	}
 }
+
+func TestAuthTimeline(t *testing.T) {
+	cfg := &config{}
+	cfg.sshConfig = &ssh.ServerConfig{AuthLogCallback: cfg.getAuthLogCallback()}
+	logBuffer := setupLogBuffer(t, cfg)
+	cfg.sshConfig.AuthLogCallback(mockConnContext{}, "password", nil)
+	var sessionID []byte
+	callback := cfg.timedSSHConfig(time.Now(), &sessionID).AuthLogCallback
+	callback(mockConnContext{}, "none", errors.New(""))
+	if expected := (mockConnContext{}).SessionID(); !bytes.Equal(sessionID, expected) {
+		t.Errorf("sessionID=%q, want %q", sessionID, expected)
+	}
+	callback(mockConnContext{}, "publickey", errors.New(""))
+	callback(mockConnContext{}, "password", errors.New(""))
+	callback(mockConnContext{}, "password", nil)
+	if count := cfg.authTimelines.count([]byte("othersession")); count != 0 {
+		t.Errorf("count=%v, want 0 for another session", count)
+	}
+	summary := cfg.authTimelines.finish(sessionID)
+	for i := range summary.Attempts {
+		summary.Attempts[i].ElapsedMS = 0
+	}
+	expected := authSummaryLog{
+		Attempts: []authAttempt{
+			{Index: 0, Method: "none", User: "root"},
+			{Index: 1, Method: "publickey", User: "root"},
+			{Index: 2, Method: "password", User: "root"},
+			{Index: 3, Method: "password", User: "root", Accepted: true},
+		},
+		Methods:  []string{"none", "publickey", "password"},
+		Accepted: true,
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("summary=%+v, want %+v", summary, expected)
+	}
+	if summary := cfg.authTimelines.finish(sessionID); summary.Attempts != nil {
+		t.Errorf("summary=%+v, want the timeline forgotten", summary)
+	}
+	expectedLogs := `[127.0.0.1:1234] authentication for user "root" without credentials rejected
+`
+	if logs := logBuffer.String(); logs != expectedLogs {
+		t.Errorf("logs=%v, want %v", logs, expectedLogs)
+	}
+}
+
+func TestKeyboardInteractiveRounds(t *testing.T) {
+	cfg := &config{}
+	cfg.Auth.KeyboardInteractiveAuth.Enabled = true
+	cfg.Auth.KeyboardInteractiveAuth.Rounds = []keyboardInteractiveRound{
+		{Questions: []keyboardInteractiveAuthQuestion{{"Password: ", false}}},
+		{
+			Instruction: "Two-factor authentication",
+			Questions:   []keyboardInteractiveAuthQuestion{{"Verification code: ", true}},
+			Rules:       []authRuleConfig{{PasswordRegex: "^[0-9]{6}$", Accept: true}},
+		},
+	}
+	cfg.Auth.Rules = []authRuleConfig{{Password: "hunter2", Accept: true}}
+	if err := cfg.setupAuthRules(t.TempDir()); err != nil {
+		t.Fatalf("Failed to set up auth rules: %v", err)
+	}
+	callback := cfg.getKeyboardInteractiveCallback()
+	logBuffer := setupLogBuffer(t, cfg)
+	for _, answers := range [][]string{{"hunter2", "123456"}, {"hunter2", "12345"}, {"123456"}} {
+		var instructions []string
+		round := 0
+		_, err := callback(mockConnContext{}, func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			instructions = append(instructions, instruction)
+			round++
+			return answers[round-1 : round], nil
+		})
+		if accepted := err == nil; accepted != (answers[0] == "hunter2" && answers[1] == "123456") {
+			t.Errorf("answers %q: accepted=%v", answers, accepted)
+		}
+		if len(instructions) != len(answers) {
+			t.Errorf("answers %q: asked %v rounds, want %v", answers, len(instructions), len(answers))
+		}
+	}
+	expectedLogs := `[127.0.0.1:1234] authentication for user "root" with keyboard interactive answers ["hunter2"] in round 1 accepted
+[127.0.0.1:1234] authentication for user "root" with keyboard interactive answers ["123456"] in round 2 accepted
+[127.0.0.1:1234] authentication for user "root" with keyboard interactive answers ["hunter2"] in round 1 accepted
+[127.0.0.1:1234] authentication for user "root" with keyboard interactive answers ["12345"] in round 2 rejected
+[127.0.0.1:1234] authentication for user "root" with keyboard interactive answers ["123456"] in round 1 rejected
+`
+	if logs := logBuffer.String(); logs != expectedLogs {
+		t.Errorf("logs=%v, want %v", logs, expectedLogs)
+	}
+
+	cfg.Auth.KeyboardInteractiveAuth.Questions = []keyboardInteractiveAuthQuestion{{"q1", true}}
+	if err := cfg.setupAuthRules(t.TempDir()); err == nil {
+		t.Errorf("err=nil, want an error for questions combined with rounds")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// credential identifies what a client presented, so a remembered login can
+// be recognised when it is tried again.
+func (request authRequest) credential() string {
+	return strings.Join(append([]string{request.Method, request.User, request.KeyFingerprint}, request.Passwords...), "\x00")
+}
+
+type clientAttempts struct {
+	failures   int
+	lastSeen   time.Time
+	remembered string
+}
+
+// attemptClients holds what is known about each client. It is kept apart
+// from the settings so a reloaded configuration can take it over.
+type attemptClients struct {
+	mutex     sync.Mutex
+	clients   map[string]*clientAttempts
+	lastPrune time.Time
+}
+
+// attemptTracker implements the accept after N attempts mode. It counts the
+// attempts made from each client IP across connections and forgets a client
+// once it has been idle for longer than the window.
+type attemptTracker struct {
+	attempts int
+	window   time.Duration
+	remember bool
+	methods  map[string]bool
+	state    *attemptClients
+	now      func() time.Time
+}
+
+func newAttemptTracker(cfg acceptAfterConfig) (*attemptTracker, error) {
+	if cfg.Attempts < 1 {
+		return nil, errors.New("attempts must be at least 1")
+	}
+	if cfg.Window <= 0 {
+		return nil, errors.New("window must be positive")
+	}
+	tracker := &attemptTracker{
+		attempts: cfg.Attempts,
+		window:   cfg.Window,
+		remember: cfg.Remember,
+		state:    &attemptClients{clients: map[string]*clientAttempts{}},
+		now:      time.Now,
+	}
+	if len(cfg.Methods) > 0 {
+		tracker.methods = map[string]bool{}
+		for _, method := range cfg.Methods {
+			if !authMethods[method] {
+				return nil, fmt.Errorf("unknown method %q", method)
+			}
+			tracker.methods[method] = true
+		}
+	}
+	return tracker, nil
+}
+
+func (tracker *attemptTracker) handles(method string) bool {
+	return tracker.methods == nil || tracker.methods[method]
+}
+
+func (tracker *attemptTracker) prune(now time.Time) {
+	state := tracker.state
+	if now.Sub(state.lastPrune) < tracker.window {
+		return
+	}
+	for ip, client := range state.clients {
+		if now.Sub(client.lastSeen) > tracker.window {
+			delete(state.clients, ip)
+		}
+	}
+	state.lastPrune = now
+}
+
+// attempt records an attempt and reports whether it is accepted. Once a
+// credential has been accepted and remember is set, only that credential is
+// accepted from the client until it is forgotten.
+func (tracker *attemptTracker) attempt(request authRequest) bool {
+	tracker.state.mutex.Lock()
+	defer tracker.state.mutex.Unlock()
+	now := tracker.now()
+	tracker.prune(now)
+	ip := request.ClientIP.String()
+	client, ok := tracker.state.clients[ip]
+	if !ok || now.Sub(client.lastSeen) > tracker.window {
+		client = &clientAttempts{}
+		tracker.state.clients[ip] = client
+	}
+	client.lastSeen = now
+	credential := request.credential()
+	if client.remembered != "" {
+		return client.remembered == credential
+	}
+	if client.failures < tracker.attempts {
+		client.failures++
+		return false
+	}
+	client.failures = 0
+	if tracker.remember {
+		client.remembered = credential
+	}
+	return true
+}
+
+func (cfg *config) setupAuthAttempts() error {
+	cfg.authAttempts = nil
+	if !cfg.Auth.AcceptAfter.Enabled {
+		return nil
+	}
+	tracker, err := newAttemptTracker(cfg.Auth.AcceptAfter)
+	if err != nil {
+		return fmt.Errorf("accept_after: %w", err)
+	}
+	cfg.authAttempts = tracker
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAttemptTracker(t *testing.T) {
+	tracker, err := newAttemptTracker(acceptAfterConfig{Enabled: true, Attempts: 2, Window: time.Hour, Remember: true})
+	if err != nil {
+		t.Fatalf("Failed to create tracker: %v", err)
+	}
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	tracker.now = func() time.Time { return now }
+	attacker := net.ParseIP("192.0.2.1")
+	password := func(ip net.IP, user, password string) authRequest {
+		return authRequest{Method: "password", User: user, ClientIP: ip, Passwords: []string{password}}
+	}
+	for i, test := range []struct {
+		request  authRequest
+		expected bool
+	}{
+		{password(attacker, "root", "123456"), false},
+		{password(net.ParseIP("192.0.2.2"), "root", "123456"), false},
+		{password(attacker, "root", "password"), false},
+		{password(attacker, "root", "toor"), true},
+		{password(attacker, "root", "123456"), false},
+		{password(attacker, "root", "toor"), true},
+	} {
+		if accepted := tracker.attempt(test.request); accepted != test.expected {
+			t.Errorf("attempt %v accepted=%v, want %v", i, accepted, test.expected)
+		}
+	}
+
+	now = now.Add(2 * time.Hour)
+	if tracker.attempt(password(attacker, "root", "toor")) {
+		t.Errorf("accepted=true after the window, want the client forgotten")
+	}
+	if len(tracker.state.clients) != 1 {
+		t.Errorf("len(clients)=%v, want stale clients pruned", len(tracker.state.clients))
+	}
+}
+
+func TestAttemptTrackerForget(t *testing.T) {
+	tracker, err := newAttemptTracker(acceptAfterConfig{Enabled: true, Attempts: 1, Window: time.Minute, Methods: []string{"password"}})
+	if err != nil {
+		t.Fatalf("Failed to create tracker: %v", err)
+	}
+	if tracker.handles("public_key") {
+		t.Errorf("handles(public_key)=true, want false")
+	}
+	request := authRequest{Method: "password", User: "root", ClientIP: net.ParseIP("192.0.2.1"), Passwords: []string{"a"}}
+	for i, expected := range []bool{false, true, false, true} {
+		if accepted := tracker.attempt(request); accepted != expected {
+			t.Errorf("attempt %v accepted=%v, want %v", i, accepted, expected)
+		}
+	}
+	if _, err := newAttemptTracker(acceptAfterConfig{Enabled: true, Attempts: 1}); err == nil {
+		t.Errorf("err=nil, want an error for a zero window")
+	}
+	for _, attempts := range []int{0, -1} {
+		cfg := &config{}
+		cfg.Auth.AcceptAfter = acceptAfterConfig{Enabled: true, Attempts: attempts, Window: time.Hour}
+		if err := cfg.setupAuthAttempts(); err == nil {
+			t.Errorf("attempts=%v: err=nil, want an error", attempts)
+		}
+	}
+}
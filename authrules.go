@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authRequest describes a single authentication attempt as seen by the auth
+// rules. Passwords holds the password or keyboard interactive answers, and
+// Key and KeyFingerprint are set for public key attempts.
+type authRequest struct {
+	Method         string
+	User           string
+	ClientIP       net.IP
+	Passwords      []string
+	Key            ssh.PublicKey
+	KeyFingerprint string
+}
+
+// authRule is a compiled authRuleConfig. Nil matchers match anything.
+type authRule struct {
+	methods        map[string]bool
+	user           *regexp.Regexp
+	password       *regexp.Regexp
+	passwordList   map[string]bool
+	keyFingerprint string
+	clientIP       *net.IPNet
+	accept         bool
+}
+
+// globPattern compiles a shell style glob, where * matches any run of
+// characters and ? matches a single character, into an anchored regexp.
+func globPattern(glob string) *regexp.Regexp {
+	pattern := regexp.QuoteMeta(glob)
+	pattern = strings.ReplaceAll(pattern, `\*`, `.*`)
+	pattern = strings.ReplaceAll(pattern, `\?`, `.`)
+	return regexp.MustCompile("^(?s:" + pattern + ")$")
+}
+
+func loadWordlist(fileName string) (map[string]bool, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	words := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if word := strings.TrimSuffix(scanner.Text(), "\r"); word != "" {
+			words[word] = true
+		}
+	}
+	return words, scanner.Err()
+}
+
+func parseIPNet(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", value)
+		}
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(value)
+	return network, err
+}
+
+var authMethods = map[string]bool{"password": true, "public_key": true, "keyboard_interactive": true}
+
+func newAuthRule(ruleConfig authRuleConfig, dataDir string) (authRule, error) {
+	rule := authRule{keyFingerprint: ruleConfig.KeyFingerprint, accept: ruleConfig.Accept}
+	if len(ruleConfig.Methods) > 0 {
+		rule.methods = map[string]bool{}
+		for _, method := range ruleConfig.Methods {
+			if !authMethods[method] {
+				return authRule{}, fmt.Errorf("unknown method %q", method)
+			}
+			rule.methods[method] = true
+		}
+	}
+	if ruleConfig.User != "" {
+		rule.user = globPattern(ruleConfig.User)
+	}
+	passwordMatchers := 0
+	if ruleConfig.Password != "" {
+		rule.password = regexp.MustCompile("^" + regexp.QuoteMeta(ruleConfig.Password) + "$")
+		passwordMatchers++
+	}
+	if ruleConfig.PasswordGlob != "" {
+		rule.password = globPattern(ruleConfig.PasswordGlob)
+		passwordMatchers++
+	}
+	if ruleConfig.PasswordRegex != "" {
+		pattern, err := regexp.Compile(ruleConfig.PasswordRegex)
+		if err != nil {
+			return authRule{}, err
+		}
+		rule.password = pattern
+		passwordMatchers++
+	}
+	if ruleConfig.PasswordList != "" {
+		fileName := ruleConfig.PasswordList
+		if !path.IsAbs(fileName) {
+			fileName = path.Join(dataDir, fileName)
+		}
+		words, err := loadWordlist(fileName)
+		if err != nil {
+			return authRule{}, err
+		}
+		rule.passwordList = words
+		passwordMatchers++
+	}
+	if passwordMatchers > 1 {
+		return authRule{}, errors.New("password, password_glob, password_regex and password_list are mutually exclusive")
+	}
+	if ruleConfig.ClientIP != "" {
+		network, err := parseIPNet(ruleConfig.ClientIP)
+		if err != nil {
+			return authRule{}, err
+		}
+		rule.clientIP = network
+	}
+	return rule, nil
+}
+
+func (rule authRule) matchesPassword(passwords []string) bool {
+	if rule.password == nil && rule.passwordList == nil {
+		return true
+	}
+	for _, password := range passwords {
+		if rule.password != nil && rule.password.MatchString(password) {
+			return true
+		}
+		if rule.passwordList[password] {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule authRule) matches(request authRequest) bool {
+	if rule.methods != nil && !rule.methods[request.Method] {
+		return false
+	}
+	if rule.user != nil && !rule.user.MatchString(request.User) {
+		return false
+	}
+	if !rule.matchesPassword(request.Passwords) {
+		return false
+	}
+	if rule.keyFingerprint != "" && rule.keyFingerprint != request.KeyFingerprint {
+		return false
+	}
+	if rule.clientIP != nil && (request.ClientIP == nil || !rule.clientIP.Contains(request.ClientIP)) {
+		return false
+	}
+	return true
+}
+
+func newAuthRules(ruleConfigs []authRuleConfig, dataDir string) ([]authRule, error) {
+	var rules []authRule
+	for i, ruleConfig := range ruleConfigs {
+		rule, err := newAuthRule(ruleConfig, dataDir)
+		if err != nil {
+			return nil, fmt.Errorf("auth rule %v: %w", i, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (cfg *config) setupAuthRules(dataDir string) error {
+	rules, err := newAuthRules(cfg.Auth.Rules, dataDir)
+	if err != nil {
+		return err
+	}
+	cfg.authRules = rules
+	cfg.roundRules = nil
+	keyboardInteractive := cfg.Auth.KeyboardInteractiveAuth
+	if len(keyboardInteractive.Rounds) > 0 && (keyboardInteractive.Instruction != "" || len(keyboardInteractive.Questions) > 0) {
+		return errors.New("keyboard interactive instruction and questions can't be combined with rounds")
+	}
+	for i, round := range cfg.Auth.KeyboardInteractiveAuth.Rounds {
+		rules, err := newAuthRules(round.Rules, dataDir)
+		if err != nil {
+			return fmt.Errorf("keyboard interactive round %v: %w", i, err)
+		}
+		cfg.roundRules = append(cfg.roundRules, rules)
+	}
+	return nil
+}
+
+// authenticate decides an attempt using the first matching auth rule. When no
+// rule matches, the credentials of a configured account decide, then for
+// public keys the authorized keys file and trusted CAs, then the accept after
+// N attempts mode if it is enabled for the method, and otherwise the method's
+// accepted setting.
+func (cfg *config) authenticate(request authRequest, fallback bool) bool {
+	for _, rule := range cfg.authRules {
+		if rule.matches(request) {
+			return rule.accept
+		}
+	}
+	if account, ok := cfg.users[request.User]; ok {
+		if decided, accepted := account.authenticate(request); decided {
+			return accepted
+		}
+	}
+	if request.Method == "public_key" {
+		if decided, accepted := cfg.authenticatePublicKey(request); decided {
+			return accepted
+		}
+	}
+	if cfg.authAttempts != nil && cfg.authAttempts.handles(request.Method) {
+		return cfg.authAttempts.attempt(request)
+	}
+	return fallback
+}
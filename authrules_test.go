@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path"
+	"testing"
+)
+
+func TestAuthRules(t *testing.T) {
+	dataDir := t.TempDir()
+	if err := ioutil.WriteFile(path.Join(dataDir, "passwords.txt"), []byte("123456\r\nadmin\n\n"), 0600); err != nil {
+		t.Fatalf("Failed to write wordlist: %v", err)
+	}
+	cfg := &config{}
+	cfg.Auth.Rules = []authRuleConfig{
+		{ClientIP: "10.0.0.0/8", Accept: false},
+		{User: "root", Password: "hunter2", Accept: true},
+		{User: "oracle", PasswordGlob: "ora*?", Accept: true},
+		{Methods: []string{"keyboard_interactive"}, PasswordRegex: "^[0-9]{6}$", Accept: true},
+		{User: "adm*", PasswordList: "passwords.txt", Accept: true},
+		{KeyFingerprint: "SHA256:abc", ClientIP: "192.0.2.1", Accept: true},
+	}
+	if err := cfg.setupAuthRules(dataDir); err != nil {
+		t.Fatalf("Failed to set up auth rules: %v", err)
+	}
+	client := net.ParseIP("192.0.2.1")
+	for _, test := range []struct {
+		request  authRequest
+		expected bool
+	}{
+		{authRequest{Method: "password", User: "root", ClientIP: client, Passwords: []string{"hunter2"}}, true},
+		{authRequest{Method: "password", User: "root", ClientIP: net.ParseIP("10.1.2.3"), Passwords: []string{"hunter2"}}, false},
+		{authRequest{Method: "password", User: "root", ClientIP: client, Passwords: []string{"hunter3"}}, false},
+		{authRequest{Method: "password", User: "oracle", ClientIP: client, Passwords: []string{"oracle"}}, true},
+		{authRequest{Method: "password", User: "oracle", ClientIP: client, Passwords: []string{"ora"}}, false},
+		{authRequest{Method: "password", User: "nobody", ClientIP: client, Passwords: []string{"123456"}}, false},
+		{authRequest{Method: "keyboard_interactive", User: "nobody", ClientIP: client, Passwords: []string{"bob", "123456"}}, true},
+		{authRequest{Method: "password", User: "admin", ClientIP: client, Passwords: []string{"123456"}}, true},
+		{authRequest{Method: "password", User: "admin", ClientIP: client, Passwords: []string{"654321"}}, false},
+		{authRequest{Method: "public_key", User: "git", ClientIP: client, KeyFingerprint: "SHA256:abc"}, true},
+		{authRequest{Method: "public_key", User: "git", ClientIP: net.ParseIP("192.0.2.2"), KeyFingerprint: "SHA256:abc"}, false},
+	} {
+		if accepted := cfg.authenticate(test.request, false); accepted != test.expected {
+			t.Errorf("authenticate(%+v)=%v, want %v", test.request, accepted, test.expected)
+		}
+	}
+	if accepted := cfg.authenticate(authRequest{Method: "password", User: "guest"}, true); !accepted {
+		t.Errorf("authenticate()=false, want the fallback")
+	}
+}
+
+func TestAuthRulesInvalid(t *testing.T) {
+	for _, rule := range []authRuleConfig{
+		{Methods: []string{"hostbased"}},
+		{Password: "a", PasswordGlob: "b*"},
+		{PasswordRegex: "("},
+		{PasswordList: "missing.txt"},
+		{ClientIP: "not an address"},
+	} {
+		cfg := &config{}
+		cfg.Auth.Rules = []authRuleConfig{rule}
+		if err := cfg.setupAuthRules(t.TempDir()); err == nil {
+			t.Errorf("setupAuthRules(%+v)=nil, want an error", rule)
+		}
+	}
+}
+
+func TestPasswordRules(t *testing.T) {
+	cfg := &config{}
+	cfg.Auth.PasswordAuth.Enabled = true
+	cfg.Auth.PasswordAuth.Accepted = false
+	cfg.Auth.Rules = []authRuleConfig{{User: "root", Password: "hunter2", Accept: true}}
+	if err := cfg.setupAuthRules(t.TempDir()); err != nil {
+		t.Fatalf("Failed to set up auth rules: %v", err)
+	}
+	callback := cfg.getPasswordCallback()
+	logBuffer := setupLogBuffer(t, cfg)
+	if _, err := callback(mockConnContext{}, []byte("hunter2")); err != nil {
+		t.Errorf("err=%v, want nil", err)
+	}
+	if _, err := callback(mockConnContext{}, []byte("hunter3")); err == nil {
+		t.Errorf("err=nil, want an error")
+	}
+	expectedLogs := `[127.0.0.1:1234] authentication for user "root" with password "hunter2" accepted
+[127.0.0.1:1234] authentication for user "root" with password "hunter3" rejected
+`
+	if logs := logBuffer.String(); logs != expectedLogs {
+		t.Errorf("logs=%v, want %v", logs, expectedLogs)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authTimeline collects the authentication attempts of one connection.
+type authTimeline struct {
+	started  time.Time
+	attempts []authAttempt
+}
+
+// authTimelines tracks the timelines of connections that are still open,
+// keyed by session ID. A connection's timeline starts with its first
+// authentication attempt, as the session ID is unknown before that.
+type authTimelines struct {
+	mutex     sync.Mutex
+	timelines map[string]*authTimeline
+}
+
+func (timelines *authTimelines) start(sessionID []byte, started time.Time) {
+	timelines.mutex.Lock()
+	defer timelines.mutex.Unlock()
+	if timelines.timelines == nil {
+		timelines.timelines = map[string]*authTimeline{}
+	}
+	timelines.timelines[string(sessionID)] = &authTimeline{started: started}
+}
+
+func (timelines *authTimelines) record(sessionID []byte, method string, user string, err error) {
+	timelines.mutex.Lock()
+	defer timelines.mutex.Unlock()
+	timeline, ok := timelines.timelines[string(sessionID)]
+	if !ok {
+		return
+	}
+	timeline.attempts = append(timeline.attempts, authAttempt{
+		Index:     len(timeline.attempts),
+		Method:    method,
+		User:      user,
+		ElapsedMS: time.Since(timeline.started).Milliseconds(),
+		Accepted:  err == nil,
+	})
+}
+
+// count returns how many attempts a connection has made so far.
+func (timelines *authTimelines) count(sessionID []byte) int {
+	timelines.mutex.Lock()
+	defer timelines.mutex.Unlock()
+	if timeline, ok := timelines.timelines[string(sessionID)]; ok {
+		return len(timeline.attempts)
+	}
+	return 0
+}
+
+// finish stops tracking a connection and returns its summary.
+func (timelines *authTimelines) finish(sessionID []byte) authSummaryLog {
+	timelines.mutex.Lock()
+	defer timelines.mutex.Unlock()
+	timeline, ok := timelines.timelines[string(sessionID)]
+	if !ok {
+		return authSummaryLog{}
+	}
+	delete(timelines.timelines, string(sessionID))
+	summary := authSummaryLog{Attempts: timeline.attempts}
+	for _, attempt := range timeline.attempts {
+		summary.Methods = appendUnique(summary.Methods, attempt.Method)
+		if attempt.Accepted {
+			summary.Accepted = true
+		}
+	}
+	return summary
+}
+
+// timedSSHConfig returns a copy of the server config for one connection
+// that starts the connection's timeline at started once its session ID is
+// known, and stores that ID in sessionID.
+func (cfg *config) timedSSHConfig(started time.Time, sessionID *[]byte) *ssh.ServerConfig {
+	sshConfig := *cfg.sshConfig
+	sshConfig.AuthLogCallback = func(conn ssh.ConnMetadata, method string, err error) {
+		if *sessionID == nil {
+			*sessionID = conn.SessionID()
+			cfg.authTimelines.start(*sessionID, started)
+		}
+		cfg.sshConfig.AuthLogCallback(conn, method, err)
+	}
+	return &sshConfig
+}
+
+// netConnMetadata provides the addresses of a connection that has not
+// completed the SSH handshake, so events about it can still be logged.
+type netConnMetadata struct {
+	net.Conn
+}
+
+func (netConnMetadata) User() string          { return "" }
+func (netConnMetadata) SessionID() []byte     { return nil }
+func (netConnMetadata) ClientVersion() []byte { return nil }
+func (netConnMetadata) ServerVersion() []byte { return nil }
@@ -1,10 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type readLiner interface {
@@ -16,18 +26,65 @@ type commandContext struct {
 	stdin          readLiner
 	stdout, stderr io.Writer
 	pty            bool
+	filesystem     *virtualFilesystem
+	env            *shellEnvironment
+	channelID      int
+	events         chan<- logEntry
+	cfg            *config
+	source         captureSource
+}
+
+func (context commandContext) logEvent(entry logEntry) {
+	if context.events != nil {
+		context.events <- entry
+	}
+}
+
+// binaryInput returns stdin as a byte stream for commands speaking a binary
+// protocol. Interactive terminals have no such stream and read as empty.
+func (context commandContext) binaryInput() io.Reader {
+	if reader, ok := context.stdin.(io.Reader); ok {
+		return reader
+	}
+	return strings.NewReader("")
 }
 
 type command interface {
 	execute(context commandContext) (uint32, error)
 }
 
+// commands holds the built-in emulated commands. Canned commands from the
+// config live on the config instead, so this map is never modified.
 var commands = map[string]command{
-	"sh":    cmdShell{},
-	"true":  cmdTrue{},
-	"false": cmdFalse{},
-	"echo":  cmdEcho{},
-	"cat":   cmdCat{},
+	"sh":          cmdShell{},
+	"true":        cmdTrue{},
+	"false":       cmdFalse{},
+	"echo":        cmdEcho{},
+	"cat":         cmdCat{},
+	"uname":       cmdUname{},
+	"id":          cmdID{},
+	"whoami":      cmdWhoami{},
+	"hostname":    cmdHostname{},
+	"nproc":       cmdNproc{},
+	"free":        cmdFree{},
+	"ps":          cmdPs{},
+	"w":           cmdW{},
+	"uptime":      cmdUptime{},
+	"ls":          cmdLs{},
+	"cd":          cmdCd{},
+	"pwd":         cmdPwd{},
+	"history":     cmdHistory{},
+	"which":       cmdWhich{},
+	"export":      cmdExport{},
+	"crontab":     cmdCrontab{},
+	"wget":        cmdWget{},
+	"curl":        cmdCurl{},
+	"tftp":        cmdTftp{},
+	"ftpget":      cmdFtpget{},
+	"busybox":     cmdBusybox{},
+	"sftp-server": cmdSFTPServer{},
+	"scp":         cmdSCP{},
+	"base64":      cmdBase64{},
 }
 
 var shellProgram = []string{"sh"}
@@ -36,7 +93,10 @@ func executeProgram(context commandContext) (uint32, error) {
 	if len(context.args) == 0 {
 		return 0, nil
 	}
-	command := commands[context.args[0]]
+	command := context.lookupCommand(context.args[0])
+	if command == nil && strings.Contains(context.args[0], "/") {
+		command = context.lookupCommand(path.Base(context.args[0]))
+	}
 	if command == nil {
 		_, err := fmt.Fprintf(context.stderr, "%v: command not found\n", context.args[0])
 		return 127, err
@@ -46,37 +106,153 @@ func executeProgram(context commandContext) (uint32, error) {
 
 type cmdShell struct{}
 
-func (cmdShell) execute(context commandContext) (uint32, error) {
-	var prompt string
-	if context.pty {
-		prompt = "$ "
+// readCommand reads lines until they form a complete command, prompting for
+// continuation lines like an interactive shell does.
+func (cmdShell) readCommand(context commandContext) (string, error) {
+	line, err := context.stdin.ReadLine()
+	if err != nil {
+		return "", err
 	}
-	var line string
-	var err error
+	context.env.line++
 	for {
-		_, err = fmt.Fprint(context.stdout, prompt)
+		if _, err := parseShell(line); err != errIncompleteCommand {
+			return line, nil
+		}
+		if context.pty {
+			if _, err := fmt.Fprint(context.stdout, "> "); err != nil {
+				return "", err
+			}
+		}
+		nextLine, err := context.stdin.ReadLine()
 		if err != nil {
-			return 0, err
+			return line, err
+		}
+		context.env.line++
+		line = fmt.Sprintf("%v\n%v", line, nextLine)
+	}
+}
+
+func (cmdShell) run(context commandContext, command string) (uint32, error) {
+	list, err := parseShell(command)
+	if err == errIncompleteCommand {
+		err = shellSyntaxError{"end of file unexpected"}
+	}
+	var syntaxError shellSyntaxError
+	if errors.As(err, &syntaxError) {
+		context.env.status = 2
+		return 2, context.shellError("%v", syntaxError)
+	}
+	if err != nil {
+		return 0, err
+	}
+	context.env.history = append(context.env.history, command)
+	context.logEvent(sessionCommandLog{
+		channelLog: channelLog{
+			ChannelID: context.channelID,
+		},
+		Command: command,
+		Tree:    list,
+	})
+	if canned := context.matchCommandPattern(command); canned != nil {
+		status, err := canned.execute(context)
+		context.env.status = status
+		return status, err
+	}
+	return runShellList(context, list)
+}
+
+// prompt expands the PS1 variable, supporting the user, host and working
+// directory escapes bash users rely on.
+func (cmdShell) prompt(context commandContext) string {
+	ps1 := context.env.get("PS1")
+	if ps1 == "" {
+		return "$ "
+	}
+	dir := context.env.dir
+	if home := context.env.get("HOME"); home != "" && home != "/" && (dir == home || strings.HasPrefix(dir, home+"/")) {
+		dir = "~" + strings.TrimPrefix(dir, home)
+	}
+	name, uid, _ := context.user()
+	var prompt strings.Builder
+	for i := 0; i < len(ps1); i++ {
+		if ps1[i] != '\\' || i+1 == len(ps1) {
+			prompt.WriteByte(ps1[i])
+			continue
+		}
+		i++
+		switch ps1[i] {
+		case 'u':
+			prompt.WriteString(name)
+		case 'h':
+			prompt.WriteString(strings.SplitN(context.persona().Hostname, ".", 2)[0])
+		case 'H':
+			prompt.WriteString(context.persona().Hostname)
+		case 'w':
+			prompt.WriteString(dir)
+		case 'W':
+			if dir == "~" || dir == "/" {
+				prompt.WriteString(dir)
+			} else {
+				prompt.WriteString(path.Base(dir))
+			}
+		case '$':
+			if uid == 0 {
+				prompt.WriteByte('#')
+			} else {
+				prompt.WriteByte('$')
+			}
+		default:
+			prompt.WriteByte('\\')
+			prompt.WriteByte(ps1[i])
+		}
+	}
+	return prompt.String()
+}
+
+func (shell cmdShell) execute(context commandContext) (uint32, error) {
+	if context.env == nil {
+		context.env = newShellEnvironment("/", nil)
+	} else {
+		context.env = context.env.clone()
+	}
+	context.env.line = 0
+	if len(context.args) > 2 && context.args[1] == "-c" {
+		context.env.line = 1
+		status, err := shell.run(context, context.args[2])
+		var exit shellExit
+		if errors.As(err, &exit) {
+			return exit.status, nil
+		}
+		return status, err
+	}
+	for {
+		if context.pty {
+			if _, err := fmt.Fprint(context.stdout, shell.prompt(context)); err != nil {
+				return 0, err
+			}
+		}
+		command, err := shell.readCommand(context)
+		if err == io.EOF && command != "" {
+			_, err = shell.run(context, command)
+			if err == nil {
+				err = io.EOF
+			}
+		}
+		if err == io.EOF {
+			return context.env.status, nil
 		}
-		line, err = context.stdin.ReadLine()
 		if err != nil {
+			var exit shellExit
+			if errors.As(err, &exit) {
+				return exit.status, nil
+			}
 			return 0, err
 		}
-		args := strings.Fields(line)
-		if len(args) > 0 && args[0] == "exit" {
-			var err error
-			var status uint64
-			if len(args) > 1 {
-				status, err = strconv.ParseUint(args[1], 10, 32)
-				if err != nil {
-					status = 255
-				}
+		if _, err := shell.run(context, command); err != nil {
+			var exit shellExit
+			if errors.As(err, &exit) {
+				return exit.status, nil
 			}
-			return uint32(status), nil
-		}
-		newContext := context
-		newContext.args = strings.Fields(line)
-		if _, err = executeProgram(newContext); err != nil {
 			return 0, err
 		}
 	}
@@ -103,15 +279,7 @@ func (cmdEcho) execute(context commandContext) (uint32, error) {
 
 type cmdCat struct{}
 
-func (cmdCat) execute(context commandContext) (uint32, error) {
-	if len(context.args) > 1 {
-		for _, file := range context.args[1:] {
-			if _, err := fmt.Fprintf(context.stderr, "%v: %v: No such file or directory\n", context.args[0], file); err != nil {
-				return 0, err
-			}
-		}
-		return 1, nil
-	}
+func (cmdCat) readStdin(context commandContext) error {
 	var line string
 	var err error
 	for err == nil {
@@ -120,5 +288,611 @@ func (cmdCat) execute(context commandContext) (uint32, error) {
 			_, err = fmt.Fprintln(context.stdout, line)
 		}
 	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func (cat cmdCat) execute(context commandContext) (uint32, error) {
+	if len(context.args) < 2 {
+		return 0, cat.readStdin(context)
+	}
+	var status uint32
+	for _, file := range context.args[1:] {
+		if file == "-" {
+			if err := cat.readStdin(context); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		content, err := context.filesystem.readFile(resolvePath(context.env.dir, file))
+		if err != nil {
+			status = 1
+			if _, err := fmt.Fprintf(context.stderr, "%v: %v: %v\n", context.args[0], file, fsErrorMessage(err)); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if _, err := context.stdout.Write(content); err != nil {
+			return 0, err
+		}
+	}
+	return status, nil
+}
+
+func formatMode(mode os.FileMode) string {
+	result := []byte("-rwxrwxrwx")
+	switch {
+	case mode.IsDir():
+		result[0] = 'd'
+	case mode&os.ModeSymlink != 0:
+		result[0] = 'l'
+	}
+	for i := 0; i < 9; i++ {
+		if mode&(1<<uint(8-i)) == 0 {
+			result[i+1] = '-'
+		}
+	}
+	special := func(index int, set bool, char byte) {
+		if !set {
+			return
+		}
+		if result[index] == 'x' {
+			result[index] = char
+		} else {
+			result[index] = char - 'a' + 'A'
+		}
+	}
+	special(3, mode&os.ModeSetuid != 0, 's')
+	special(6, mode&os.ModeSetgid != 0, 's')
+	special(9, mode&os.ModeSticky != 0, 't')
+	return string(result)
+}
+
+func humanSize(size int64) string {
+	if size < 1024 {
+		return strconv.FormatInt(size, 10)
+	}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < 5 {
+		value /= 1024
+		unit++
+	}
+	suffix := "KMGTP"[unit-1 : unit]
+	if value < 10 {
+		return fmt.Sprintf("%.1f%v", math.Ceil(value*10)/10, suffix)
+	}
+	return fmt.Sprintf("%.0f%v", math.Ceil(value), suffix)
+}
+
+type lsOptions struct {
+	all, almostAll, long, human, directory, onePerLine bool
+}
+
+type cmdLs struct{}
+
+func (cmdLs) formatTime(modTime time.Time) string {
+	if time.Since(modTime) > 180*24*time.Hour || time.Until(modTime) > time.Hour {
+		return modTime.Format("Jan _2  2006")
+	}
+	return modTime.Format("Jan _2 15:04")
+}
+
+func (ls cmdLs) formatEntries(context commandContext, dir string, entries []os.FileInfo, options lsOptions) string {
+	var output strings.Builder
+	if !options.long {
+		names := make([]string, len(entries))
+		width := 0
+		for i, entry := range entries {
+			names[i] = entry.Name()
+			if len(names[i]) > width {
+				width = len(names[i])
+			}
+		}
+		if !context.pty || options.onePerLine {
+			for _, name := range names {
+				fmt.Fprintln(&output, name)
+			}
+			return output.String()
+		}
+		columns := 80 / (width + 2)
+		if columns < 1 {
+			columns = 1
+		}
+		rows := (len(names) + columns - 1) / columns
+		for row := 0; row < rows; row++ {
+			var line strings.Builder
+			for column := 0; column < columns; column++ {
+				index := column*rows + row
+				if index >= len(names) {
+					break
+				}
+				fmt.Fprintf(&line, "%-*v", width+2, names[index])
+			}
+			fmt.Fprintln(&output, strings.TrimRight(line.String(), " "))
+		}
+		return output.String()
+	}
+	type row struct {
+		mode, links, user, group, size, time, name string
+	}
+	var rows []row
+	widths := make([]int, 5)
+	for _, entry := range entries {
+		owner, _ := entry.Sys().(fileOwner)
+		nlink := 1
+		if info, ok := entry.(fileInfo); ok {
+			nlink = info.nlink
+		}
+		size := strconv.FormatInt(entry.Size(), 10)
+		if options.human {
+			size = humanSize(entry.Size())
+		}
+		name := entry.Name()
+		if entry.Mode()&os.ModeSymlink != 0 && dir != "" {
+			if target, err := context.filesystem.readlink(path.Join(dir, entry.Name())); err == nil {
+				name = fmt.Sprintf("%v -> %v", name, target)
+			}
+		}
+		r := row{
+			formatMode(entry.Mode()),
+			strconv.Itoa(nlink),
+			lookupID(context.filesystem, "/etc/passwd", owner.UID),
+			lookupID(context.filesystem, "/etc/group", owner.GID),
+			size,
+			ls.formatTime(entry.ModTime()),
+			name,
+		}
+		for i, value := range []string{r.links, r.user, r.group, r.size} {
+			if len(value) > widths[i] {
+				widths[i] = len(value)
+			}
+		}
+		rows = append(rows, r)
+	}
+	for _, r := range rows {
+		fmt.Fprintf(&output, "%v %*v %-*v %-*v %*v %v %v\n", r.mode, widths[0], r.links, widths[1], r.user, widths[2], r.group, widths[3], r.size, r.time, r.name)
+	}
+	return output.String()
+}
+
+func (ls cmdLs) listDirectory(context commandContext, name string, options lsOptions) (string, error) {
+	entries, err := context.filesystem.readDir(name)
+	if err != nil {
+		return "", err
+	}
+	if options.all {
+		self, err := context.filesystem.stat(name)
+		if err != nil {
+			return "", err
+		}
+		parent, err := context.filesystem.stat(path.Dir(name))
+		if err != nil {
+			return "", err
+		}
+		dots := []os.FileInfo{
+			fileInfo{".", self.Size(), self.Mode(), self.Sys().(fileOwner), self.ModTime(), self.(fileInfo).nlink},
+			fileInfo{"..", parent.Size(), parent.Mode(), parent.Sys().(fileOwner), parent.ModTime(), parent.(fileInfo).nlink},
+		}
+		entries = append(dots, entries...)
+	} else {
+		visible := entries[:0]
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Name(), ".") || options.almostAll {
+				visible = append(visible, entry)
+			}
+		}
+		entries = visible
+	}
+	result := ls.formatEntries(context, name, entries, options)
+	if options.long {
+		var blocks int64
+		for _, entry := range entries {
+			blocks += (entry.Size() + 4095) / 4096 * 4
+		}
+		result = fmt.Sprintf("total %v\n%v", blocks, result)
+	}
+	return result, nil
+}
+
+func (ls cmdLs) execute(context commandContext) (uint32, error) {
+	options := lsOptions{}
+	var operands []string
+	for i, arg := range context.args[1:] {
+		switch {
+		case arg == "--":
+			operands = append(operands, context.args[i+2:]...)
+		case arg == "--all":
+			options.all = true
+		case arg == "--almost-all":
+			options.almostAll = true
+		case arg == "--human-readable":
+			options.human = true
+		case arg == "--directory":
+			options.directory = true
+		case strings.HasPrefix(arg, "--"):
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			for _, flag := range arg[1:] {
+				switch flag {
+				case 'a':
+					options.all = true
+				case 'A':
+					options.almostAll = true
+				case 'l', 'n', 'g', 'o':
+					options.long = true
+				case 'h':
+					options.human = true
+				case 'd':
+					options.directory = true
+				case '1':
+					options.onePerLine = true
+				}
+			}
+		default:
+			operands = append(operands, arg)
+		}
+		if arg == "--" {
+			break
+		}
+	}
+	if len(operands) == 0 {
+		operands = []string{"."}
+	}
+	var status uint32
+	var files []os.FileInfo
+	var dirs []string
+	for _, operand := range operands {
+		name := resolvePath(context.env.dir, operand)
+		info, err := context.filesystem.lstat(name)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 && !options.long {
+			info, err = context.filesystem.stat(name)
+		}
+		if err != nil {
+			status = 2
+			if _, err := fmt.Fprintf(context.stderr, "ls: cannot access '%v': %v\n", operand, fsErrorMessage(err)); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if info.IsDir() && !options.directory {
+			dirs = append(dirs, operand)
+			continue
+		}
+		files = append(files, fileInfo{operand, info.Size(), info.Mode(), info.Sys().(fileOwner), info.ModTime(), info.(fileInfo).nlink})
+	}
+	var sections []string
+	if len(files) > 0 {
+		sections = append(sections, ls.formatEntries(context, context.env.dir, files, options))
+	}
+	for _, dir := range dirs {
+		listing, err := ls.listDirectory(context, resolvePath(context.env.dir, dir), options)
+		if err != nil {
+			status = 2
+			if _, err := fmt.Fprintf(context.stderr, "ls: cannot open directory '%v': %v\n", dir, fsErrorMessage(err)); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if len(operands) > 1 {
+			listing = fmt.Sprintf("%v:\n%v", dir, listing)
+		}
+		sections = append(sections, listing)
+	}
+	_, err := fmt.Fprint(context.stdout, strings.Join(sections, "\n"))
+	return status, err
+}
+
+type cmdCd struct{}
+
+func (cmdCd) execute(context commandContext) (uint32, error) {
+	target := context.env.get("HOME")
+	if len(context.args) > 1 {
+		target = context.args[1]
+	}
+	if target == "-" {
+		target = context.env.get("OLDPWD")
+		if target == "" {
+			target = context.env.dir
+		}
+		if _, err := fmt.Fprintln(context.stdout, target); err != nil {
+			return 0, err
+		}
+	}
+	dir := resolvePath(context.env.dir, target)
+	info, err := context.filesystem.stat(dir)
+	if err != nil || !info.IsDir() {
+		return 2, context.shellError("cd: can't cd to %v", target)
+	}
+	context.env.set("OLDPWD", context.env.dir)
+	context.env.dir = dir
+	context.env.set("PWD", dir)
+	return 0, nil
+}
+
+type cmdPwd struct{}
+
+func (cmdPwd) execute(context commandContext) (uint32, error) {
+	_, err := fmt.Fprintln(context.stdout, context.env.dir)
+	return 0, err
+}
+
+type cmdHistory struct{}
+
+func (cmdHistory) execute(context commandContext) (uint32, error) {
+	if len(context.args) > 1 && context.args[1] == "-c" {
+		context.env.history = nil
+		return 0, nil
+	}
+	for i, line := range context.env.history {
+		if _, err := fmt.Fprintf(context.stdout, "%5d  %v\n", i+1, line); err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+var shellBuiltins = map[string]bool{
+	"cd":      true,
+	"exit":    true,
+	"export":  true,
+	"history": true,
+}
+
+type cmdWhich struct{}
+
+func (cmdWhich) execute(context commandContext) (uint32, error) {
+	var status uint32
+	for _, arg := range context.args[1:] {
+		if strings.HasPrefix(arg, "-") {
+			continue
+		}
+		if context.lookupCommand(arg) == nil || shellBuiltins[arg] {
+			status = 1
+			continue
+		}
+		if _, err := fmt.Fprintf(context.stdout, "/usr/bin/%v\n", arg); err != nil {
+			return 0, err
+		}
+	}
+	return status, nil
+}
+
+type cmdExport struct{}
+
+func (cmdExport) execute(context commandContext) (uint32, error) {
+	var names []string
+	for _, arg := range context.args[1:] {
+		if arg == "-p" {
+			continue
+		}
+		nameValue := strings.SplitN(arg, "=", 2)
+		if len(nameValue) == 2 {
+			context.env.set(nameValue[0], nameValue[1])
+		} else if _, ok := context.env.variables[arg]; !ok {
+			context.env.set(arg, "")
+		}
+		names = append(names, nameValue[0])
+	}
+	if len(names) > 0 {
+		return 0, nil
+	}
+	for name := range context.env.variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := strings.ReplaceAll(context.env.variables[name], "'", `'\''`)
+		if _, err := fmt.Fprintf(context.stdout, "export %v='%v'\n", name, value); err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+type cmdCrontab struct{}
+
+func (cmdCrontab) execute(context commandContext) (uint32, error) {
+	user, _, _ := context.user()
+	file := ""
+	action := "install"
+	for _, arg := range context.args[1:] {
+		switch arg {
+		case "-l":
+			action = "list"
+		case "-r":
+			action = "remove"
+		case "-e":
+			action = "edit"
+		default:
+			if !strings.HasPrefix(arg, "-") || arg == "-" {
+				file = arg
+			}
+		}
+	}
+	crontab := path.Join("/var/spool/cron/crontabs", user)
+	switch action {
+	case "list":
+		content, err := context.filesystem.readFile(crontab)
+		if err != nil {
+			_, err := fmt.Fprintf(context.stderr, "no crontab for %v\n", user)
+			return 1, err
+		}
+		_, err = context.stdout.Write(content)
+		return 0, err
+	case "remove":
+		if err := context.filesystem.remove(crontab); err != nil {
+			_, err := fmt.Fprintf(context.stderr, "no crontab for %v\n", user)
+			return 1, err
+		}
+		return 0, nil
+	case "edit":
+		_, err := fmt.Fprintf(context.stderr, "no crontab for %v - using an empty one\ncrontab: no changes made to crontab\n", user)
+		return 0, err
+	}
+	var content []byte
+	if file == "" || file == "-" {
+		var lines strings.Builder
+		for {
+			line, err := context.stdin.ReadLine()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return 0, err
+			}
+			fmt.Fprintln(&lines, line)
+		}
+		content = []byte(lines.String())
+	} else {
+		var err error
+		content, err = context.filesystem.readFile(resolvePath(context.env.dir, file))
+		if err != nil {
+			_, err := fmt.Fprintf(context.stderr, "%v: %v\n", file, fsErrorMessage(err))
+			return 1, err
+		}
+	}
+	if err := context.filesystem.writeFile(crontab, content, 0600); err != nil {
+		_, err := fmt.Fprintf(context.stderr, "crontab: installing new crontab: %v\n", fsErrorMessage(err))
+		return 1, err
+	}
+	return 0, nil
+}
+
+// lookupCommand finds the emulated command with the given name, preferring
+// the canned commands of the config over the built-ins they shadow.
+func (context commandContext) lookupCommand(name string) command {
+	if context.cfg != nil {
+		if command := context.cfg.namedCommands[name]; command != nil {
+			return command
+		}
+	}
+	return commands[name]
+}
+
+// matchCommandPattern finds the first canned command of the config whose
+// pattern matches the full command line.
+func (context commandContext) matchCommandPattern(line string) *cannedCommand {
+	if context.cfg == nil {
+		return nil
+	}
+	for i := range context.cfg.commandPatterns {
+		if context.cfg.commandPatterns[i].pattern.MatchString(line) {
+			return &context.cfg.commandPatterns[i]
+		}
+	}
+	return nil
+}
+
+type cannedCommand struct {
+	pattern        *regexp.Regexp
+	stdout, stderr string
+	status         uint32
+	delay          time.Duration
+}
+
+func (command cannedCommand) execute(context commandContext) (uint32, error) {
+	time.Sleep(command.delay)
+	if _, err := io.WriteString(context.stdout, command.stdout); err != nil {
+		return 0, err
+	}
+	if _, err := io.WriteString(context.stderr, command.stderr); err != nil {
+		return 0, err
+	}
+	return command.status, nil
+}
+
+// readInput reads all of stdin, preferring the raw byte stream so binary data
+// survives. Input larger than maxUploadSize fails with errTooLarge.
+func (context commandContext) readInput() ([]byte, error) {
+	if reader, ok := context.stdin.(io.Reader); ok {
+		input, err := ioutil.ReadAll(io.LimitReader(reader, maxUploadSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(input) > maxUploadSize {
+			return nil, errTooLarge
+		}
+		return input, nil
+	}
+	var input bytes.Buffer
+	for {
+		line, err := context.stdin.ReadLine()
+		if err == io.EOF {
+			return input.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if input.Len()+len(line)+1 > maxUploadSize {
+			return nil, errTooLarge
+		}
+		input.WriteString(line)
+		input.WriteByte('\n')
+	}
+}
+
+type cmdBase64 struct{}
+
+func (cmdBase64) execute(context commandContext) (uint32, error) {
+	decode := false
+	wrap := 76
+	var files []string
+	args := context.args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-d" || arg == "--decode" || arg == "-di" || arg == "-id":
+			decode = true
+		case arg == "-i" || arg == "--ignore-garbage":
+		case strings.HasPrefix(arg, "--wrap="):
+			wrap, _ = strconv.Atoi(strings.TrimPrefix(arg, "--wrap="))
+		case arg == "-w" && i+1 < len(args):
+			i++
+			wrap, _ = strconv.Atoi(args[i])
+		case strings.HasPrefix(arg, "-w"):
+			wrap, _ = strconv.Atoi(arg[2:])
+		default:
+			files = append(files, arg)
+		}
+	}
+	var input []byte
+	var err error
+	if len(files) == 0 || files[0] == "-" {
+		input, err = context.readInput()
+		if errors.Is(err, errTooLarge) {
+			_, err := fmt.Fprintf(context.stderr, "base64: read error: %v\n", fsErrorMessage(err))
+			return 1, err
+		}
+		if err != nil {
+			return 0, err
+		}
+	} else if input, err = context.filesystem.readFile(resolvePath(context.env.dir, files[0])); err != nil {
+		_, err := fmt.Fprintf(context.stderr, "base64: %v: %v\n", files[0], fsErrorMessage(err))
+		return 1, err
+	}
+	if decode {
+		encoded := strings.Join(strings.Fields(string(input)), "")
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if _, err := context.stdout.Write(decoded); err != nil {
+			return 0, err
+		}
+		if err != nil {
+			_, err := fmt.Fprintln(context.stderr, "base64: invalid input")
+			return 1, err
+		}
+		return 0, nil
+	}
+	encoded := base64.StdEncoding.EncodeToString(input)
+	var output strings.Builder
+	for wrap > 0 && len(encoded) > wrap {
+		output.WriteString(encoded[:wrap])
+		output.WriteByte('\n')
+		encoded = encoded[wrap:]
+	}
+	output.WriteString(encoded)
+	output.WriteByte('\n')
+	_, err = io.WriteString(context.stdout, output.String())
 	return 0, err
 }
@@ -13,23 +13,77 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"path"
+	"regexp"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"gopkg.in/yaml.v2"
 )
 
+type rateLimitConfig struct {
+	Connections int           `yaml:"connections"`
+	Window      time.Duration `yaml:"window"`
+}
+
+type limitsConfig struct {
+	MaxConnections      int             `yaml:"max_connections"`
+	MaxConnectionsPerIP int             `yaml:"max_connections_per_ip"`
+	RateLimit           rateLimitConfig `yaml:"rate_limit"`
+	MaxLifetime         time.Duration   `yaml:"max_lifetime"`
+}
+
+type proxyProtocolConfig struct {
+	Enabled        bool     `yaml:"enabled"`
+	TrustedSources []string `yaml:"trusted_sources"`
+}
+
+// listenerConfig describes an additional address to listen on. Its ssh_proto,
+// auth and persona sections override the matching top-level settings.
+type listenerConfig struct {
+	Name          string                 `yaml:"name"`
+	ListenAddress string                 `yaml:"listen_address"`
+	HostKeys      []string               `yaml:"host_keys"`
+	SSHProto      map[string]interface{} `yaml:"ssh_proto"`
+	Auth          map[string]interface{} `yaml:"auth"`
+	Persona       map[string]interface{} `yaml:"persona"`
+}
+
 type serverConfig struct {
-	ListenAddress string   `yaml:"listen_address"`
-	HostKeys      []string `yaml:"host_keys"`
+	ListenAddress string              `yaml:"listen_address"`
+	HostKeys      []string            `yaml:"host_keys"`
+	Limits        limitsConfig        `yaml:"limits"`
+	ProxyProtocol proxyProtocolConfig `yaml:"proxy_protocol"`
+	Listeners     []listenerConfig    `yaml:"listeners"`
+	DrainTimeout  time.Duration       `yaml:"drain_timeout"`
+	User          string              `yaml:"user"`
+	Group         string              `yaml:"group"`
+	Chroot        bool                `yaml:"chroot"`
+}
+
+// logSinkConfig describes an additional destination for events. Types are
+// file, syslog and http; events filters the event types it receives.
+type logSinkConfig struct {
+	Type       string        `yaml:"type"`
+	Format     string        `yaml:"format"`
+	Path       string        `yaml:"path"`
+	Timestamps bool          `yaml:"timestamps"`
+	Network    string        `yaml:"network"`
+	Address    string        `yaml:"address"`
+	Tag        string        `yaml:"tag"`
+	URL        string        `yaml:"url"`
+	Timeout    time.Duration `yaml:"timeout"`
+	Events     []string      `yaml:"events"`
 }
 
 type loggingConfig struct {
-	File       string `yaml:"file"`
-	JSON       bool   `yaml:"json"`
-	Timestamps bool   `yaml:"timestamps"`
-	Debug      bool   `yaml:"debug"`
+	File       string          `yaml:"file"`
+	JSON       bool            `yaml:"json"`
+	Timestamps bool            `yaml:"timestamps"`
+	Debug      bool            `yaml:"debug"`
+	Sinks      []logSinkConfig `yaml:"sinks"`
 }
 
 type commonAuthConfig struct {
@@ -37,54 +91,162 @@ type commonAuthConfig struct {
 	Accepted bool `yaml:"accepted"`
 }
 
+type publicKeyAuthConfig struct {
+	commonAuthConfig   `yaml:",inline"`
+	AuthorizedKeysFile string   `yaml:"authorized_keys_file"`
+	TrustedUserCAKeys  []string `yaml:"trusted_user_ca_keys"`
+}
+
 type keyboardInteractiveAuthQuestion struct {
 	Text string `yaml:"text"`
 	Echo bool   `yaml:"echo"`
 }
 
+type keyboardInteractiveRound struct {
+	Instruction string                            `yaml:"instruction"`
+	Questions   []keyboardInteractiveAuthQuestion `yaml:"questions"`
+	Rules       []authRuleConfig                  `yaml:"rules"`
+}
+
 type keyboardInteractiveAuthConfig struct {
 	commonAuthConfig `yaml:",inline"`
 	Instruction      string                            `yaml:"instruction"`
 	Questions        []keyboardInteractiveAuthQuestion `yaml:"questions"`
+	Rounds           []keyboardInteractiveRound        `yaml:"rounds"`
+}
+
+type authRuleConfig struct {
+	Methods        []string `yaml:"methods"`
+	User           string   `yaml:"user"`
+	Password       string   `yaml:"password"`
+	PasswordGlob   string   `yaml:"password_glob"`
+	PasswordRegex  string   `yaml:"password_regex"`
+	PasswordList   string   `yaml:"password_list"`
+	KeyFingerprint string   `yaml:"key_fingerprint"`
+	ClientIP       string   `yaml:"client_ip"`
+	Accept         bool     `yaml:"accept"`
+}
+
+type acceptAfterConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Attempts int           `yaml:"attempts"`
+	Window   time.Duration `yaml:"window"`
+	Remember bool          `yaml:"remember"`
+	Methods  []string      `yaml:"methods"`
+}
+
+type authDelayConfig struct {
+	Mode   string        `yaml:"mode"`
+	Delay  time.Duration `yaml:"delay"`
+	Jitter time.Duration `yaml:"jitter"`
+	Max    time.Duration `yaml:"max"`
 }
 
 type authConfig struct {
 	MaxTries                int                           `yaml:"max_tries"`
 	NoAuth                  bool                          `yaml:"no_auth"`
 	PasswordAuth            commonAuthConfig              `yaml:"password_auth"`
-	PublicKeyAuth           commonAuthConfig              `yaml:"public_key_auth"`
+	PublicKeyAuth           publicKeyAuthConfig           `yaml:"public_key_auth"`
 	KeyboardInteractiveAuth keyboardInteractiveAuthConfig `yaml:"keyboard_interactive_auth"`
+	Rules                   []authRuleConfig              `yaml:"rules"`
+	AcceptAfter             acceptAfterConfig             `yaml:"accept_after"`
+	Delay                   authDelayConfig               `yaml:"delay"`
+}
+
+type tarpitConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	Duration time.Duration `yaml:"duration"`
 }
 
 type sshProtoConfig struct {
-	Version        string   `yaml:"version"`
-	Banner         string   `yaml:"banner"`
-	RekeyThreshold uint64   `yaml:"rekey_threshold"`
-	KeyExchanges   []string `yaml:"key_exchanges"`
-	Ciphers        []string `yaml:"ciphers"`
-	MACs           []string `yaml:"macs"`
+	Version        string       `yaml:"version"`
+	Banner         string       `yaml:"banner"`
+	RekeyThreshold uint64       `yaml:"rekey_threshold"`
+	KeyExchanges   []string     `yaml:"key_exchanges"`
+	Ciphers        []string     `yaml:"ciphers"`
+	MACs           []string     `yaml:"macs"`
+	Tarpit         tarpitConfig `yaml:"tarpit"`
+}
+
+type filesystemConfig struct {
+	Image string `yaml:"image"`
+}
+
+type cannedCommandConfig struct {
+	Name    string        `yaml:"name"`
+	Pattern string        `yaml:"pattern"`
+	Stdout  string        `yaml:"stdout"`
+	Stderr  string        `yaml:"stderr"`
+	Status  uint32        `yaml:"status"`
+	Delay   time.Duration `yaml:"delay"`
+}
+
+type userConfig struct {
+	Name           string   `yaml:"name"`
+	UID            uint32   `yaml:"uid"`
+	GID            uint32   `yaml:"gid"`
+	Home           string   `yaml:"home"`
+	Shell          string   `yaml:"shell"`
+	PasswordHash   string   `yaml:"password_hash"`
+	AuthorizedKeys []string `yaml:"authorized_keys"`
+}
+
+type recordingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	MaxSize int  `yaml:"max_size"`
 }
 
 type config struct {
-	Server   serverConfig   `yaml:"server"`
-	Logging  loggingConfig  `yaml:"logging"`
-	Auth     authConfig     `yaml:"auth"`
-	SSHProto sshProtoConfig `yaml:"ssh_proto"`
+	Server     serverConfig          `yaml:"server"`
+	Logging    loggingConfig         `yaml:"logging"`
+	Auth       authConfig            `yaml:"auth"`
+	SSHProto   sshProtoConfig        `yaml:"ssh_proto"`
+	Filesystem filesystemConfig      `yaml:"filesystem"`
+	Persona    personaConfig         `yaml:"persona"`
+	Commands   []cannedCommandConfig `yaml:"commands"`
+	Recording  recordingConfig       `yaml:"recording"`
+	Users      []userConfig          `yaml:"users"`
 
-	parsedHostKeys []ssh.Signer
-	sshConfig      *ssh.ServerConfig
-	logFileHandle  io.WriteCloser
+	parsedHostKeys    []ssh.Signer
+	sshConfig         *ssh.ServerConfig
+	logFileHandle     io.WriteCloser
+	filesystemImage   *virtualFilesystem
+	bootTime          time.Time
+	quarantine        *quarantineStore
+	recordingDir      string
+	authRules         []authRule
+	roundRules        [][]authRule
+	authAttempts      *attemptTracker
+	users             map[string]*userAccount
+	authorizedKeys    []authorizedKey
+	trustedUserCAs    map[string]bool
+	authTimelines     authTimelines
+	connectionLimiter *connectionLimiter
+	trustedProxies    []*net.IPNet
+	listenerName      string
+	listeners         []listener
+	sinks             *logSinks
+	namedCommands     map[string]command
+	commandPatterns   []cannedCommand
 }
 
 func getDefaultConfig() *config {
 	cfg := &config{}
 	cfg.Server.ListenAddress = "127.0.0.1:2022"
+	cfg.Server.DrainTimeout = 10 * time.Second
 	cfg.Logging.Timestamps = true
 	cfg.Auth.PasswordAuth.Enabled = true
 	cfg.Auth.PasswordAuth.Accepted = true
 	cfg.Auth.PublicKeyAuth.Enabled = true
+	cfg.Auth.AcceptAfter.Attempts = 3
+	cfg.Auth.AcceptAfter.Window = time.Hour
+	cfg.Auth.AcceptAfter.Remember = true
 	cfg.SSHProto.Version = "SSH-2.0-sshesame"
 	cfg.SSHProto.Banner = "This is an SSH honeypot. Everything is logged and monitored."
+	cfg.Persona = getDefaultPersona()
+	cfg.Recording.Enabled = true
+	cfg.Recording.MaxSize = 16 * 1024 * 1024
 	return cfg
 }
 
@@ -202,35 +364,140 @@ func (cfg *config) setupSSHConfig() error {
 	return nil
 }
 
+// setupLogging opens the log file and the log sinks. The log itself is only
+// redirected by applyLogging, so a configuration that fails to load leaves the
+// running one untouched.
 func (cfg *config) setupLogging() error {
-	if cfg.logFileHandle != nil {
-		cfg.logFileHandle.Close()
-	}
+	cfg.logFileHandle = nil
 	if cfg.Logging.File != "" {
 		logFile, err := os.OpenFile(cfg.Logging.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
 			return err
 		}
-		log.SetOutput(logFile)
 		cfg.logFileHandle = logFile
+	}
+	if err := cfg.setupSinks(); err != nil {
+		if cfg.logFileHandle != nil {
+			cfg.logFileHandle.Close()
+			cfg.logFileHandle = nil
+		}
+		return err
+	}
+	return nil
+}
+
+// applyLogging redirects the log to the configured file and format.
+func (cfg *config) applyLogging() {
+	if cfg.logFileHandle != nil {
+		log.SetOutput(cfg.logFileHandle)
 	} else {
 		log.SetOutput(os.Stdout)
-		cfg.logFileHandle = nil
 	}
 	if !cfg.Logging.JSON && cfg.Logging.Timestamps {
 		log.SetFlags(log.LstdFlags)
 	} else {
 		log.SetFlags(0)
 	}
+}
+
+var defaultFilesystemImageFiles = []string{"filesystem.yaml", "filesystem.tar.gz", "filesystem.tgz", "filesystem.tar"}
+
+func (cfg *config) setupFilesystem(dataDir string) error {
+	imageFile := cfg.Filesystem.Image
+	if imageFile == "" {
+		for _, file := range defaultFilesystemImageFiles {
+			if _, err := os.Stat(path.Join(dataDir, file)); err == nil {
+				imageFile = file
+				break
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	if imageFile == "" {
+		cfg.filesystemImage = defaultFilesystemImage
+		return nil
+	}
+	if !path.IsAbs(imageFile) {
+		imageFile = path.Join(dataDir, imageFile)
+	}
+	infoLogger.Printf("Loading filesystem image %q", imageFile)
+	image, err := loadFilesystemImage(imageFile)
+	if err != nil {
+		return err
+	}
+	cfg.filesystemImage = image
 	return nil
 }
 
-func getConfig(configString string, dataDir string) (*config, error) {
-	cfg := getDefaultConfig()
+// newFilesystem returns a private copy of the filesystem image for a new
+// connection, so changes made by one client are never seen by another.
+func (cfg *config) newFilesystem() *virtualFilesystem {
+	var filesystem *virtualFilesystem
+	if cfg.filesystemImage == nil {
+		filesystem = defaultFilesystemImage.clone()
+	} else {
+		filesystem = cfg.filesystemImage.clone()
+	}
+	if cfg.Persona.Hostname != "" {
+		if err := cfg.Persona.addPersonaFiles(filesystem, cfg.bootTime); err != nil {
+			warningLogger.Printf("Failed to add persona files: %v", err)
+		}
+	}
+	if err := cfg.addUserFiles(filesystem); err != nil {
+		warningLogger.Printf("Failed to add user files: %v", err)
+	}
+	return filesystem
+}
+
+func (cfg *config) setupCommands() error {
+	named := map[string]command{}
+	var patterns []cannedCommand
+	for i, entry := range cfg.Commands {
+		canned := cannedCommand{stdout: entry.Stdout, stderr: entry.Stderr, status: entry.Status, delay: entry.Delay}
+		switch {
+		case entry.Name != "" && entry.Pattern != "":
+			return fmt.Errorf("command %v: name and pattern are mutually exclusive", i)
+		case entry.Name != "":
+			named[entry.Name] = canned
+		case entry.Pattern != "":
+			pattern, err := regexp.Compile(entry.Pattern)
+			if err != nil {
+				return fmt.Errorf("command %v: %w", i, err)
+			}
+			canned.pattern = pattern
+			patterns = append(patterns, canned)
+		default:
+			return fmt.Errorf("command %v: a name or a pattern is required", i)
+		}
+	}
+	cfg.namedCommands = named
+	cfg.commandPatterns = patterns
+	return nil
+}
 
+// parseConfig parses a configuration without setting anything up.
+func parseConfig(configString string) (*config, error) {
+	cfg := getDefaultConfig()
 	if err := yaml.UnmarshalStrict([]byte(configString), cfg); err != nil {
 		return nil, err
 	}
+	return cfg, nil
+}
+
+// loadConfig parses a configuration, applying the overrides of listenerCfg if
+// it is not nil, and sets up everything but the state shared by all
+// listeners.
+func loadConfig(configString string, dataDir string, listenerCfg *listenerConfig) (*config, error) {
+	cfg, err := parseConfig(configString)
+	if err != nil {
+		return nil, err
+	}
+	if listenerCfg != nil {
+		if err := listenerCfg.apply(cfg); err != nil {
+			return nil, err
+		}
+	}
 
 	if len(cfg.Server.HostKeys) == 0 {
 		infoLogger.Printf("No host keys configured, using keys at %q", dataDir)
@@ -239,9 +506,64 @@ func getConfig(configString string, dataDir string) (*config, error) {
 		}
 	}
 
+	if err := cfg.setupUsers(); err != nil {
+		return nil, err
+	}
+	if err := cfg.setupPublicKeyAuth(dataDir); err != nil {
+		return nil, err
+	}
+	if err := cfg.setupAuthRules(dataDir); err != nil {
+		return nil, err
+	}
+	if err := cfg.setupAuthAttempts(); err != nil {
+		return nil, err
+	}
+	if err := cfg.setupAuthDelay(); err != nil {
+		return nil, err
+	}
+	if err := cfg.setupTarpit(); err != nil {
+		return nil, err
+	}
+	if err := cfg.setupLimits(); err != nil {
+		return nil, err
+	}
+	if err := cfg.setupProxyProtocol(); err != nil {
+		return nil, err
+	}
 	if err := cfg.setupSSHConfig(); err != nil {
 		return nil, err
 	}
+	if err := cfg.setupFilesystem(dataDir); err != nil {
+		return nil, err
+	}
+	cfg.bootTime = time.Now().Add(-cfg.Persona.Uptime)
+	if cfg.Recording.MaxSize < 0 {
+		return nil, errors.New("recording: max_size must not be negative")
+	}
+	if cfg.Recording.Enabled {
+		cfg.recordingDir = path.Join(dataDir, "recordings")
+	}
+	if err := cfg.setupCommands(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func getConfig(configString string, dataDir string) (*config, error) {
+	cfg, err := loadConfig(configString, dataDir, nil)
+	if err != nil {
+		return nil, err
+	}
+	quarantine, err := newQuarantineStore(path.Join(dataDir, "quarantine"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.quarantine = quarantine
+	cfg.sinks = &logSinks{}
+	if err := cfg.setupListeners(configString, dataDir); err != nil {
+		return nil, err
+	}
 	if err := cfg.setupLogging(); err != nil {
 		return nil, err
 	}
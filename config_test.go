@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"path"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -28,11 +32,15 @@ func (publicKey mockPublicKey) Verify(data []byte, sig *ssh.Signature) error {
 }
 
 type mockFile struct {
+	buffer *bytes.Buffer
 	closed bool
 }
 
 func (file *mockFile) Write(p []byte) (n int, err error) {
-	return 0, errors.New("")
+	if file.buffer == nil {
+		return 0, errors.New("")
+	}
+	return file.buffer.Write(p)
 }
 
 func (file *mockFile) Close() error {
@@ -146,6 +154,7 @@ func TestDefaultConfig(t *testing.T) {
 	}
 	expectedConfig := &config{}
 	expectedConfig.Server.ListenAddress = "127.0.0.1:2022"
+	expectedConfig.Server.DrainTimeout = 10 * time.Second
 	expectedConfig.Server.HostKeys = []string{
 		path.Join(dataDir, "host_rsa_key"),
 		path.Join(dataDir, "host_ecdsa_key"),
@@ -155,6 +164,9 @@ func TestDefaultConfig(t *testing.T) {
 	expectedConfig.Auth.PasswordAuth.Enabled = true
 	expectedConfig.Auth.PasswordAuth.Accepted = true
 	expectedConfig.Auth.PublicKeyAuth.Enabled = true
+	expectedConfig.Auth.AcceptAfter.Attempts = 3
+	expectedConfig.Auth.AcceptAfter.Window = time.Hour
+	expectedConfig.Auth.AcceptAfter.Remember = true
 	expectedConfig.SSHProto.Version = "SSH-2.0-sshesame"
 	expectedConfig.SSHProto.Banner = "This is an SSH honeypot. Everything is logged and monitored."
 	verifyConfig(t, cfg, expectedConfig)
@@ -166,6 +178,7 @@ func TestUserConfigDefaultKeys(t *testing.T) {
 	cfgString := fmt.Sprintf(`
 server:
   listen_address: 0.0.0.0:22
+  drain_timeout: 5s
 logging:
   file: %v
   json: true
@@ -206,6 +219,7 @@ ssh_proto:
 	}
 	expectedConfig := &config{}
 	expectedConfig.Server.ListenAddress = "0.0.0.0:22"
+	expectedConfig.Server.DrainTimeout = 5 * time.Second
 	expectedConfig.Server.HostKeys = []string{
 		path.Join(dataDir, "host_rsa_key"),
 		path.Join(dataDir, "host_ecdsa_key"),
@@ -220,6 +234,9 @@ ssh_proto:
 	expectedConfig.Auth.KeyboardInteractiveAuth.Enabled = true
 	expectedConfig.Auth.KeyboardInteractiveAuth.Accepted = true
 	expectedConfig.Auth.KeyboardInteractiveAuth.Instruction = "instruction"
+	expectedConfig.Auth.AcceptAfter.Attempts = 3
+	expectedConfig.Auth.AcceptAfter.Window = time.Hour
+	expectedConfig.Auth.AcceptAfter.Remember = true
 	expectedConfig.Auth.KeyboardInteractiveAuth.Questions = []keyboardInteractiveAuthQuestion{
 		{"q1", true},
 		{"q2", false},
@@ -249,11 +266,15 @@ server:
 	}
 	expectedConfig := &config{}
 	expectedConfig.Server.ListenAddress = "127.0.0.1:2022"
+	expectedConfig.Server.DrainTimeout = 10 * time.Second
 	expectedConfig.Server.HostKeys = []string{keyFile}
 	expectedConfig.Logging.Timestamps = true
 	expectedConfig.Auth.PasswordAuth.Enabled = true
 	expectedConfig.Auth.PasswordAuth.Accepted = true
 	expectedConfig.Auth.PublicKeyAuth.Enabled = true
+	expectedConfig.Auth.AcceptAfter.Attempts = 3
+	expectedConfig.Auth.AcceptAfter.Window = time.Hour
+	expectedConfig.Auth.AcceptAfter.Remember = true
 	expectedConfig.SSHProto.Version = "SSH-2.0-sshesame"
 	expectedConfig.SSHProto.Banner = "This is an SSH honeypot. Everything is logged and monitored."
 	verifyConfig(t, cfg, expectedConfig)
@@ -266,14 +287,19 @@ server:
 	}
 }
 
-func TestSetupLoggingOldHandleClosed(t *testing.T) {
-	file := &mockFile{}
-	cfg := &config{logFileHandle: file}
-	if err := cfg.setupLogging(); err != nil {
-		t.Fatalf("Failed to set up logging: %v", err)
+func TestSetupLoggingFailure(t *testing.T) {
+	output := log.Writer()
+	cfg := &config{}
+	cfg.Logging.File = path.Join(t.TempDir(), "sshpot.log")
+	cfg.Logging.Sinks = []logSinkConfig{{Type: "file"}}
+	if err := cfg.setupLogging(); err == nil {
+		t.Fatalf("setupLogging succeeded, want an error")
+	}
+	if cfg.logFileHandle != nil {
+		t.Errorf("logFileHandle=%v, want the log file closed", cfg.logFileHandle)
 	}
-	if !file.closed {
-		t.Errorf("file.closed=false, want true")
+	if log.Writer() != output {
+		t.Errorf("log.Writer()=%v, want the log left alone", log.Writer())
 	}
 }
 
@@ -299,3 +325,71 @@ func TestExistingKey(t *testing.T) {
 		t.Errorf("oldKey!=newKey")
 	}
 }
+
+func TestConfigCommands(t *testing.T) {
+	cfgString := `
+commands:
+  - name: uname
+    stdout: "FreeBSD\n"
+  - name: lscpu
+    stderr: "lscpu: failed\n"
+    status: 3
+  - pattern: '^cat /proc/cpuinfo \| grep -c processor$'
+    stdout: "8\n"
+`
+	cfg, err := getConfig(cfgString, t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to get config: %v", err)
+	}
+	defaultCfg, err := getConfig("", t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to get config: %v", err)
+	}
+	for _, test := range []struct {
+		cfg            *config
+		command        string
+		status         uint32
+		stdout, stderr string
+	}{
+		{cfg, "uname -a", 0, "FreeBSD\n", ""},
+		{cfg, "lscpu", 3, "", "lscpu: failed\n"},
+		{cfg, "cat /proc/cpuinfo | grep -c processor", 0, "8\n", ""},
+		{cfg, "whoami", 0, "root\n", ""},
+		{cfg, "which lscpu", 0, "/usr/bin/lscpu\n", ""},
+		{defaultCfg, "uname", 0, "Linux\n", ""},
+		{defaultCfg, "lscpu", 127, "", "lscpu: command not found\n"},
+	} {
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		status, err := executeProgram(commandContext{
+			args:       []string{"sh", "-c", test.command},
+			stdin:      newReaderReadLiner(strings.NewReader("")),
+			stdout:     stdout,
+			stderr:     stderr,
+			filesystem: defaultFilesystemImage.clone(),
+			env:        newShellEnvironment("/root", map[string]string{"HOME": "/root"}),
+			cfg:        test.cfg,
+		})
+		if err != nil {
+			t.Fatalf("Failed to execute program: %v", err)
+		}
+		if status != test.status || stdout.String() != test.stdout || stderr.String() != test.stderr {
+			t.Errorf("%q: status=%v stdout=%q stderr=%q, want %v %q %q", test.command, status, stdout, stderr, test.status, test.stdout, test.stderr)
+		}
+	}
+	if _, ok := commands["uname"].(cmdUname); !ok {
+		t.Errorf("commands[uname]=%#v, want the built-in", commands["uname"])
+	}
+	if commands["lscpu"] != nil {
+		t.Errorf("commands[lscpu]=%#v, want nil", commands["lscpu"])
+	}
+
+	for _, cfgString := range []string{
+		"commands: [{stdout: foo}]",
+		"commands: [{name: foo, pattern: foo}]",
+		"commands: [{pattern: '('}]",
+	} {
+		if _, err := getConfig(cfgString, t.TempDir()); err == nil {
+			t.Errorf("getConfig(%q) succeeded, want an error", cfgString)
+		}
+	}
+}
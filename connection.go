@@ -3,6 +3,7 @@ package main
 import (
 	"net"
 	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -11,6 +12,8 @@ type connContext struct {
 	ssh.ConnMetadata
 	cfg            *config
 	noMoreSessions bool
+	filesystem     *virtualFilesystem
+	account        *userAccount
 }
 
 type channelContext struct {
@@ -24,23 +27,60 @@ var channelHandlers = map[string]func(newChannel ssh.NewChannel, context channel
 }
 
 func handleConnection(conn net.Conn, cfg *config) {
-	serverConn, newChannels, requests, err := ssh.NewServerConn(conn, cfg.sshConfig)
+	release, ok := cfg.limitConnection(conn)
+	if !ok {
+		return
+	}
+	defer release()
+	if cfg.SSHProto.Tarpit.Enabled {
+		if err := cfg.tarpit(conn); err != nil {
+			conn.Close()
+			return
+		}
+	}
+	var sessionID []byte
+	recorder := &kexInitRecorder{Conn: conn}
+	serverConn, newChannels, requests, err := ssh.NewServerConn(recorder, cfg.timedSSHConfig(time.Now(), &sessionID))
 	if err != nil {
-		warningLogger.Printf("Failed to establish SSH connection: %v", err)
 		conn.Close()
+		context := connContext{ConnMetadata: netConnMetadata{conn}, cfg: cfg}
+		if summary := cfg.authTimelines.finish(sessionID); len(summary.Attempts) > 0 {
+			context.logEvent(summary)
+		}
+		clientVersion, clientKexInit := recorder.clientKexInit()
+		failure := handshakeFailedLog{
+			ClientVersion: clientVersion,
+			Error:         err.Error(),
+		}
+		if clientKexInit != nil {
+			failure.HASSH, _ = clientKexInit.hassh()
+		}
+		context.logEvent(failure)
 		return
 	}
 	var channels sync.WaitGroup
-	context := connContext{ConnMetadata: serverConn, cfg: cfg}
+	context := connContext{ConnMetadata: serverConn, cfg: cfg, filesystem: cfg.newFilesystem(), account: cfg.account(serverConn.Permissions)}
 	defer func() {
 		serverConn.Close()
 		channels.Wait()
+		context.logEvent(cfg.authTimelines.finish(serverConn.SessionID()))
 		context.logEvent(connectionCloseLog{})
 	}()
 
-	context.logEvent(connectionLog{
+	connection := connectionLog{
 		ClientVersion: string(serverConn.ClientVersion()),
-	})
+	}
+	if _, clientKexInit := recorder.clientKexInit(); clientKexInit != nil {
+		connection.HASSH, connection.HASSHAlgorithms = clientKexInit.hassh()
+		connection.ClientKexInit = clientKexInit
+	}
+	if serverKexInit := recorder.serverKexInit(); serverKexInit != nil {
+		connection.HASSHServer, _ = serverKexInit.hasshServer()
+	}
+	context.logEvent(connection)
+	if clientKexInit, serverKexInit := connection.ClientKexInit, recorder.serverKexInit(); clientKexInit != nil && serverKexInit != nil {
+		context.logEvent(negotiate(clientKexInit, serverKexInit))
+	}
 
 	if _, _, err := serverConn.SendRequest("hostkeys-00@openssh.com", false, createHostkeysRequestPayload(cfg.parsedHostKeys)); err != nil {
 		warningLogger.Printf("Failed to send hostkeys-00@openssh.com request: %v", err)
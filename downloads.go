@@ -0,0 +1,512 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// downloadOptions describes the options a download tool accepts. Long options
+// are mapped to their short equivalent where one exists, and options listed
+// in values consume an argument.
+type downloadOptions struct {
+	values  string
+	aliases map[string]string
+	long    map[string]bool
+}
+
+// parse splits args into options and operands. Options are keyed by their
+// short name, or by their long name when there is no short equivalent.
+func (spec downloadOptions) parse(args []string) (map[string]string, []string) {
+	options := map[string]string{}
+	var operands []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			return options, append(operands, args[i+1:]...)
+		case strings.HasPrefix(arg, "--"):
+			name, value := arg[2:], ""
+			hasValue := false
+			if index := strings.Index(name, "="); index != -1 {
+				name, value, hasValue = name[:index], name[index+1:], true
+			}
+			if alias, ok := spec.aliases[name]; ok {
+				name = alias
+			}
+			takesValue := spec.long[name] || (len(name) == 1 && strings.Contains(spec.values, name))
+			if takesValue && !hasValue && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			options[name] = value
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			for j, flag := range arg[1:] {
+				if !strings.ContainsRune(spec.values, flag) {
+					options[string(flag)] = ""
+					continue
+				}
+				value := arg[j+2:]
+				if value == "" && i+1 < len(args) {
+					i++
+					value = args[i]
+				}
+				options[string(flag)] = value
+				break
+			}
+		default:
+			operands = append(operands, arg)
+		}
+	}
+	return options, operands
+}
+
+// fakeAddress returns a stable made-up IPv4 address for host so that name
+// resolution looks plausible without touching the network.
+func fakeAddress(host string) string {
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(host))
+	sum := hash.Sum32()
+	return fmt.Sprintf("104.%v.%v.%v", 16+sum%16, (sum>>8)%256, 1+(sum>>16)%254)
+}
+
+func parseDownloadURL(rawURL string) (*url.URL, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	result, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if result.Host == "" {
+		return nil, fmt.Errorf("missing host in %v", rawURL)
+	}
+	return result, nil
+}
+
+func defaultPort(scheme string) string {
+	switch scheme {
+	case "https":
+		return "443"
+	case "ftp":
+		return "21"
+	case "tftp":
+		return "69"
+	}
+	return "80"
+}
+
+func remoteFileName(location *url.URL) string {
+	name := path.Base(location.Path)
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// saveDownload creates an empty placeholder for a downloaded file, owned by
+// the session user. A name of "-" means the download went to stdout.
+func saveDownload(context commandContext, name string) error {
+	if name == "-" || name == "/dev/null" {
+		return nil
+	}
+	file := resolvePath(context.env.dir, name)
+	if err := context.filesystem.writeFile(file, nil, 0644); err != nil {
+		return err
+	}
+	_, uid, gid := context.user()
+	return context.filesystem.chown(file, fileOwner{uid, gid})
+}
+
+func (context commandContext) logDownload(tool, method, location, output string) {
+	context.logEvent(downloadAttemptLog{
+		channelLog: channelLog{
+			ChannelID: context.channelID,
+		},
+		Tool:   tool,
+		Method: method,
+		URL:    location,
+		Output: output,
+	})
+}
+
+var wgetOptions = downloadOptions{
+	values: "OoaPUtTwiYeB",
+	aliases: map[string]string{
+		"output-document":  "O",
+		"output-file":      "o",
+		"append-output":    "a",
+		"directory-prefix": "P",
+		"user-agent":       "U",
+		"tries":            "t",
+		"timeout":          "T",
+		"quiet":            "q",
+	},
+	long: map[string]bool{
+		"post-data": true,
+		"post-file": true,
+		"method":    true,
+		"header":    true,
+		"user":      true,
+		"password":  true,
+		"body-data": true,
+	},
+}
+
+type cmdWget struct {
+	busybox bool
+}
+
+func (wget cmdWget) outputName(context commandContext, options map[string]string, location *url.URL) string {
+	if output, ok := options["O"]; ok {
+		return output
+	}
+	name := remoteFileName(location)
+	if name == "" {
+		name = "index.html"
+	}
+	if prefix, ok := options["P"]; ok {
+		name = path.Join(prefix, name)
+	}
+	if wget.busybox {
+		return name
+	}
+	candidate := name
+	for i := 1; ; i++ {
+		if _, err := context.filesystem.lstat(resolvePath(context.env.dir, candidate)); err != nil {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%v.%v", name, i)
+	}
+}
+
+func (wget cmdWget) progress(location *url.URL, output string) string {
+	host, port := location.Hostname(), location.Port()
+	if port == "" {
+		port = defaultPort(location.Scheme)
+	}
+	address := fakeAddress(host)
+	var result strings.Builder
+	if wget.busybox {
+		fmt.Fprintf(&result, "Connecting to %v (%v)\n", host, net.JoinHostPort(address, port))
+		if output == "-" {
+			fmt.Fprintf(&result, "writing to stdout\n")
+		} else {
+			fmt.Fprintf(&result, "saving to '%v'\n", output)
+		}
+		fmt.Fprintf(&result, "%-20v 100%% |%v|     0  0:00:00 ETA\n", path.Base(output), strings.Repeat("*", 32))
+		if output == "-" {
+			fmt.Fprintf(&result, "written to stdout\n")
+		} else {
+			fmt.Fprintf(&result, "'%v' saved\n", output)
+		}
+		return result.String()
+	}
+	now := time.Now().Format("2006-01-02 15:04:05")
+	fmt.Fprintf(&result, "--%v--  %v\n", now, location)
+	if address != host {
+		fmt.Fprintf(&result, "Resolving %v (%v)... %v\n", host, host, address)
+		fmt.Fprintf(&result, "Connecting to %v (%v)|%v|:%v... connected.\n", host, host, address, port)
+	} else {
+		fmt.Fprintf(&result, "Connecting to %v... connected.\n", net.JoinHostPort(address, port))
+	}
+	fmt.Fprintf(&result, "HTTP request sent, awaiting response... 200 OK\n")
+	fmt.Fprintf(&result, "Length: 0 [application/octet-stream]\n")
+	name := output
+	if output == "-" {
+		name = "STDOUT"
+	}
+	fmt.Fprintf(&result, "Saving to: ‘%v’\n\n", name)
+	fmt.Fprintf(&result, "%-19v 100%%[%v>]       0  --.-KB/s    in 0s      \n\n", path.Base(name), strings.Repeat("=", 19))
+	if output == "-" {
+		fmt.Fprintf(&result, "%v (0.00 B/s) - written to stdout [0/0]\n\n", now)
+	} else {
+		fmt.Fprintf(&result, "%v (0.00 B/s) - ‘%v’ saved [0/0]\n\n", now, output)
+	}
+	return result.String()
+}
+
+func (wget cmdWget) execute(context commandContext) (uint32, error) {
+	tool := "wget"
+	if wget.busybox {
+		tool = "busybox wget"
+	}
+	options, operands := wgetOptions.parse(context.args[1:])
+	if len(operands) == 0 {
+		if wget.busybox {
+			_, err := fmt.Fprintln(context.stderr, "BusyBox v1.30.1 (Ubuntu 1:1.30.1-4ubuntu6.3) multi-call binary.\n\nUsage: wget [-c|--continue] [--spider] [-q|--quiet] [-O|--output-document FILE]\n\t[--header 'header: value'] [-Y|--proxy on/off] [-P DIR]\n\t[-S|--server-response] [-U|--user-agent AGENT] [-T SEC] URL...")
+			return 1, err
+		}
+		_, err := fmt.Fprintln(context.stderr, "wget: missing URL\nUsage: wget [OPTION]... [URL]...\n\nTry `wget --help' for more options.")
+		return 1, err
+	}
+	method := "GET"
+	if _, ok := options["post-data"]; ok {
+		method = "POST"
+	} else if _, ok := options["post-file"]; ok {
+		method = "POST"
+	} else if value, ok := options["method"]; ok {
+		method = strings.ToUpper(value)
+	}
+	_, quiet := options["q"]
+	var status uint32
+	for _, operand := range operands {
+		location, err := parseDownloadURL(operand)
+		if err != nil {
+			status = 1
+			if _, err := fmt.Fprintf(context.stderr, "%v: Invalid URL %v: Unsupported scheme\n", operand, operand); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		output := wget.outputName(context, options, location)
+		context.logDownload(tool, method, location.String(), output)
+		if !quiet {
+			if _, err := fmt.Fprint(context.stderr, wget.progress(location, output)); err != nil {
+				return 0, err
+			}
+		}
+		if err := saveDownload(context, output); err != nil {
+			status = 1
+			if _, err := fmt.Fprintf(context.stderr, "%v: %v\n", output, fsErrorMessage(err)); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return status, nil
+}
+
+var curlOptions = downloadOptions{
+	values: "oXdAHuemxTbcFrwKEyYzCQ",
+	aliases: map[string]string{
+		"output":         "o",
+		"remote-name":    "O",
+		"request":        "X",
+		"data":           "d",
+		"data-ascii":     "d",
+		"data-binary":    "d",
+		"data-raw":       "d",
+		"data-urlencode": "d",
+		"user-agent":     "A",
+		"header":         "H",
+		"user":           "u",
+		"referer":        "e",
+		"max-time":       "m",
+		"proxy":          "x",
+		"upload-file":    "T",
+		"cookie":         "b",
+		"cookie-jar":     "c",
+		"form":           "F",
+		"silent":         "s",
+		"head":           "I",
+		"location":       "L",
+		"insecure":       "k",
+		"fail":           "f",
+	},
+	long: map[string]bool{
+		"connect-timeout": true,
+		"retry":           true,
+		"url":             true,
+	},
+}
+
+type cmdCurl struct{}
+
+func (cmdCurl) execute(context commandContext) (uint32, error) {
+	options, operands := curlOptions.parse(context.args[1:])
+	if value, ok := options["url"]; ok {
+		operands = append(operands, value)
+	}
+	if len(operands) == 0 {
+		_, err := fmt.Fprintln(context.stderr, "curl: try 'curl --help' or 'curl --manual' for more information")
+		return 2, err
+	}
+	method := "GET"
+	if _, ok := options["I"]; ok {
+		method = "HEAD"
+	}
+	if _, ok := options["d"]; ok {
+		method = "POST"
+	} else if _, ok := options["F"]; ok {
+		method = "POST"
+	} else if _, ok := options["T"]; ok {
+		method = "PUT"
+	}
+	if value, ok := options["X"]; ok {
+		method = strings.ToUpper(value)
+	}
+	_, silent := options["s"]
+	_, remoteName := options["O"]
+	var status uint32
+	for i, operand := range operands {
+		location, err := parseDownloadURL(operand)
+		if err != nil {
+			status = 3
+			if !silent {
+				if _, err := fmt.Fprintln(context.stderr, "curl: (3) URL using bad/illegal format or missing URL"); err != nil {
+					return 0, err
+				}
+			}
+			continue
+		}
+		output := "-"
+		if value, ok := options["o"]; ok && i == 0 {
+			output = value
+		} else if remoteName {
+			output = remoteFileName(location)
+			if output == "" {
+				status = 23
+				if _, err := fmt.Fprintln(context.stderr, "curl: Remote file name has no length!\ncurl: try 'curl --help' or 'curl --manual' for more information"); err != nil {
+					return 0, err
+				}
+				continue
+			}
+		}
+		context.logDownload("curl", method, location.String(), output)
+		if !silent && (output != "-" || !context.pty) {
+			if _, err := fmt.Fprint(context.stderr, "  % Total    % Received % Xferd  Average Speed   Time    Time     Time  Current\n                                 Dload  Upload   Total   Spent    Left  Speed\n100     0  100     0    0     0      0      0 --:--:-- --:--:-- --:--:--     0\n"); err != nil {
+				return 0, err
+			}
+		}
+		if err := saveDownload(context, output); err != nil {
+			status = 23
+			if _, err := fmt.Fprintf(context.stderr, "Warning: Failed to create the file %v: %v\ncurl: (23) Failure writing output to destination\n", output, fsErrorMessage(err)); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return status, nil
+}
+
+var tftpOptions = downloadOptions{
+	values: "lrbc",
+	aliases: map[string]string{
+		"local":     "l",
+		"remote":    "r",
+		"blocksize": "b",
+		"get":       "g",
+		"put":       "p",
+	},
+}
+
+type cmdTftp struct{}
+
+func (cmdTftp) execute(context commandContext) (uint32, error) {
+	options, operands := tftpOptions.parse(context.args[1:])
+	local, remote := options["l"], options["r"]
+	_, put := options["p"]
+	if command, ok := options["c"]; ok {
+		// tftp-hpa style: tftp HOST -c get REMOTE [LOCAL]
+		put = command == "put"
+		if len(operands) > 1 {
+			remote = operands[1]
+		}
+		if len(operands) > 2 {
+			local = operands[2]
+		}
+		if len(operands) > 1 {
+			operands = operands[:1]
+		}
+	}
+	if len(operands) == 0 || (remote == "" && local == "") {
+		_, err := fmt.Fprintln(context.stderr, "BusyBox v1.30.1 (Ubuntu 1:1.30.1-4ubuntu6.3) multi-call binary.\n\nUsage: tftp [OPTIONS] HOST [PORT]\n\nTransfer a file from/to tftp server\n\n\t-l FILE\tLocal FILE\n\t-r FILE\tRemote FILE\n\t-g\tGet file\n\t-p\tPut file\n\t-b SIZE\tTransfer blocks of SIZE octets")
+		return 1, err
+	}
+	if remote == "" {
+		remote = path.Base(local)
+	}
+	if local == "" {
+		local = path.Base(remote)
+	}
+	host := operands[0]
+	if len(operands) > 1 {
+		host = net.JoinHostPort(host, operands[1])
+	}
+	location := (&url.URL{Scheme: "tftp", Host: host, Path: "/" + strings.TrimPrefix(remote, "/")}).String()
+	if put {
+		context.logDownload("tftp", "PUT", location, local)
+		return 0, nil
+	}
+	context.logDownload("tftp", "GET", location, local)
+	if err := saveDownload(context, local); err != nil {
+		_, err := fmt.Fprintf(context.stderr, "tftp: can't open '%v': %v\n", local, fsErrorMessage(err))
+		return 1, err
+	}
+	return 0, nil
+}
+
+var ftpgetOptions = downloadOptions{
+	values: "upP",
+	aliases: map[string]string{
+		"username": "u",
+		"password": "p",
+		"port":     "P",
+		"continue": "c",
+		"verbose":  "v",
+	},
+}
+
+type cmdFtpget struct{}
+
+func (cmdFtpget) execute(context commandContext) (uint32, error) {
+	options, operands := ftpgetOptions.parse(context.args[1:])
+	if len(operands) < 2 {
+		_, err := fmt.Fprintln(context.stderr, "BusyBox v1.30.1 (Ubuntu 1:1.30.1-4ubuntu6.3) multi-call binary.\n\nUsage: ftpget [OPTIONS] HOST [LOCAL_FILE] REMOTE_FILE\n\nDownload a file via FTP\n\n\t-c\tContinue previous transfer\n\t-v\tVerbose\n\t-u USER\tUsername\n\t-p PASS\tPassword\n\t-P NUM\tPort")
+		return 1, err
+	}
+	host, local := operands[0], operands[1]
+	remote := local
+	if len(operands) > 2 {
+		remote = operands[2]
+	}
+	if port, ok := options["P"]; ok {
+		host = net.JoinHostPort(host, port)
+	}
+	location := &url.URL{Scheme: "ftp", Host: host, Path: "/" + strings.TrimPrefix(remote, "/")}
+	if user, ok := options["u"]; ok {
+		if password, ok := options["p"]; ok {
+			location.User = url.UserPassword(user, password)
+		} else {
+			location.User = url.User(user)
+		}
+	}
+	context.logDownload("ftpget", "GET", location.String(), local)
+	if err := saveDownload(context, local); err != nil {
+		_, err := fmt.Fprintf(context.stderr, "ftpget: can't open '%v': %v\n", local, fsErrorMessage(err))
+		return 1, err
+	}
+	return 0, nil
+}
+
+var busyboxApplets = map[string]command{
+	"wget":   cmdWget{busybox: true},
+	"tftp":   cmdTftp{},
+	"ftpget": cmdFtpget{},
+}
+
+type cmdBusybox struct{}
+
+func (cmdBusybox) execute(context commandContext) (uint32, error) {
+	if len(context.args) < 2 || strings.HasPrefix(context.args[1], "-") {
+		_, err := fmt.Fprintln(context.stdout, "BusyBox v1.30.1 (Ubuntu 1:1.30.1-4ubuntu6.3) multi-call binary.\nBusyBox is copyrighted by many authors between 1998-2015.\nLicensed under GPLv2. See source distribution for detailed\ncopyright notices.\n\nUsage: busybox [function [arguments]...]\n   or: busybox --list[-full]\n   or: busybox --install [-s] [DIR]\n   or: function [arguments]...")
+		return 0, err
+	}
+	applet := path.Base(context.args[1])
+	command := busyboxApplets[applet]
+	if command == nil && applet != "busybox" {
+		command = context.lookupCommand(applet)
+	}
+	if command == nil {
+		_, err := fmt.Fprintf(context.stderr, "%v: applet not found\n", context.args[1])
+		return 127, err
+	}
+	context.args = context.args[1:]
+	return command.execute(context)
+}
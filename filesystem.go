@@ -0,0 +1,692 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	errNotExist   = errors.New("No such file or directory")
+	errExist      = errors.New("File exists")
+	errNotDir     = errors.New("Not a directory")
+	errIsDir      = errors.New("Is a directory")
+	errNotEmpty   = errors.New("Directory not empty")
+	errPermission = errors.New("Permission denied")
+	errLoop       = errors.New("Too many levels of symbolic links")
+	errInvalid    = errors.New("Invalid argument")
+	errTooLarge   = errors.New("File too large")
+)
+
+const maxSymlinks = 40
+
+type fileOwner struct {
+	UID, GID uint32
+}
+
+type fsNode struct {
+	mode     os.FileMode
+	owner    fileOwner
+	modTime  time.Time
+	data     []byte
+	target   string
+	children map[string]*fsNode
+}
+
+func (node *fsNode) clone() *fsNode {
+	result := *node
+	result.data = append([]byte(nil), node.data...)
+	if node.children != nil {
+		result.children = make(map[string]*fsNode, len(node.children))
+		for name, child := range node.children {
+			result.children[name] = child.clone()
+		}
+	}
+	return &result
+}
+
+type fileInfo struct {
+	name  string
+	size  int64
+	mode  os.FileMode
+	owner fileOwner
+	mtime time.Time
+	nlink int
+}
+
+func (info fileInfo) Name() string       { return info.name }
+func (info fileInfo) Size() int64        { return info.size }
+func (info fileInfo) Mode() os.FileMode  { return info.mode }
+func (info fileInfo) ModTime() time.Time { return info.mtime }
+func (info fileInfo) IsDir() bool        { return info.mode.IsDir() }
+func (info fileInfo) Sys() interface{}   { return info.owner }
+
+func (node *fsNode) info(name string) fileInfo {
+	info := fileInfo{name, int64(len(node.data)), node.mode, node.owner, node.modTime, 1}
+	switch {
+	case node.mode.IsDir():
+		info.size = 4096
+		info.nlink = 2
+		for _, child := range node.children {
+			if child.mode.IsDir() {
+				info.nlink++
+			}
+		}
+	case node.mode&os.ModeSymlink != 0:
+		info.size = int64(len(node.target))
+	}
+	return info
+}
+
+// virtualFilesystem is an in-memory tree of files exposed to the emulated
+// commands. Paths are always absolute and use forward slashes.
+// filesystemQuota bounds how many bytes the files written to a cloned
+// filesystem may add up to, so a connection cannot pin memory by uploading
+// over and over.
+const filesystemQuota = 2 * maxUploadSize
+
+type virtualFilesystem struct {
+	mutex sync.Mutex
+	root  *fsNode
+	// used counts the bytes added since the filesystem was cloned and quota
+	// bounds it. A zero quota means no limit.
+	used  int
+	quota int
+}
+
+func newVirtualFilesystem(modTime time.Time) *virtualFilesystem {
+	return &virtualFilesystem{root: &fsNode{
+		mode:     os.ModeDir | 0755,
+		modTime:  modTime,
+		children: map[string]*fsNode{},
+	}}
+}
+
+func (filesystem *virtualFilesystem) clone() *virtualFilesystem {
+	filesystem.mutex.Lock()
+	defer filesystem.mutex.Unlock()
+	return &virtualFilesystem{root: filesystem.root.clone(), quota: filesystemQuota}
+}
+
+func splitPath(name string) []string {
+	var components []string
+	for _, component := range strings.Split(name, "/") {
+		if component != "" && component != "." {
+			components = append(components, component)
+		}
+	}
+	return components
+}
+
+// resolvePath makes name absolute relative to the working directory dir.
+func resolvePath(dir, name string) string {
+	if !strings.HasPrefix(name, "/") {
+		name = path.Join(dir, name)
+	}
+	return path.Clean("/" + name)
+}
+
+// walk resolves name to its node and parent directory, following symbolic
+// links in every component except the last one unless follow is set.
+func (filesystem *virtualFilesystem) walk(name string, follow bool) (parent *fsNode, base string, node *fsNode, err error) {
+	links := 0
+	components := splitPath(name)
+	stack := []*fsNode{filesystem.root}
+	for len(components) > 0 {
+		dir := stack[len(stack)-1]
+		component := components[0]
+		components = components[1:]
+		if !dir.mode.IsDir() {
+			return nil, "", nil, errNotDir
+		}
+		if component == ".." {
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			parent, base, node = nil, "", stack[len(stack)-1]
+			continue
+		}
+		child := dir.children[component]
+		if child == nil {
+			if len(components) > 0 {
+				return nil, "", nil, errNotExist
+			}
+			return dir, component, nil, nil
+		}
+		if child.mode&os.ModeSymlink != 0 && (len(components) > 0 || follow) {
+			links++
+			if links > maxSymlinks {
+				return nil, "", nil, errLoop
+			}
+			if strings.HasPrefix(child.target, "/") {
+				stack = stack[:1]
+			}
+			components = append(splitPath(child.target), components...)
+			parent, base, node = nil, "", stack[len(stack)-1]
+			continue
+		}
+		stack = append(stack, child)
+		parent, base, node = dir, component, child
+	}
+	if node == nil {
+		node = filesystem.root
+	}
+	return parent, base, node, nil
+}
+
+func (filesystem *virtualFilesystem) lookup(op, name string, follow bool) (*fsNode, error) {
+	_, _, node, err := filesystem.walk(name, follow)
+	if err == nil && node == nil {
+		err = errNotExist
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	return node, nil
+}
+
+func (filesystem *virtualFilesystem) stat(name string) (os.FileInfo, error) {
+	filesystem.mutex.Lock()
+	defer filesystem.mutex.Unlock()
+	node, err := filesystem.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(path.Base(name)), nil
+}
+
+func (filesystem *virtualFilesystem) lstat(name string) (os.FileInfo, error) {
+	filesystem.mutex.Lock()
+	defer filesystem.mutex.Unlock()
+	node, err := filesystem.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(path.Base(name)), nil
+}
+
+func (filesystem *virtualFilesystem) readlink(name string) (string, error) {
+	filesystem.mutex.Lock()
+	defer filesystem.mutex.Unlock()
+	node, err := filesystem.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if node.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: errInvalid}
+	}
+	return node.target, nil
+}
+
+func (filesystem *virtualFilesystem) readFile(name string) ([]byte, error) {
+	filesystem.mutex.Lock()
+	defer filesystem.mutex.Unlock()
+	node, err := filesystem.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if node.mode.IsDir() {
+		return nil, &os.PathError{Op: "read", Path: name, Err: errIsDir}
+	}
+	return append([]byte(nil), node.data...), nil
+}
+
+func (filesystem *virtualFilesystem) readDir(name string) ([]os.FileInfo, error) {
+	filesystem.mutex.Lock()
+	defer filesystem.mutex.Unlock()
+	node, err := filesystem.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !node.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+	result := make([]os.FileInfo, 0, len(node.children))
+	for childName, child := range node.children {
+		result = append(result, child.info(childName))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name() < result[j].Name() })
+	return result, nil
+}
+
+// createFile opens or creates the regular file name. resize is called with
+// the file before it is linked into its parent, so a failure leaves no file
+// behind.
+func (filesystem *virtualFilesystem) createFile(op, name string, perm os.FileMode, resize func(node *fsNode) error) (*fsNode, error) {
+	parent, base, node, err := filesystem.walk(name, true)
+	if err == nil && parent == nil && node == nil {
+		err = errNotExist
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	if node != nil {
+		if node.mode.IsDir() {
+			return nil, &os.PathError{Op: op, Path: name, Err: errIsDir}
+		}
+		return node, resize(node)
+	}
+	if base == "" {
+		return nil, &os.PathError{Op: op, Path: name, Err: errIsDir}
+	}
+	node = &fsNode{mode: perm & os.ModePerm}
+	if err := resize(node); err != nil {
+		return nil, err
+	}
+	parent.children[base] = node
+	parent.modTime = time.Now()
+	return node, nil
+}
+
+// grow accounts for a file growing by delta bytes, failing if that exceeds
+// the quota.
+func (filesystem *virtualFilesystem) grow(name string, delta int) error {
+	if filesystem.quota > 0 && delta > 0 && filesystem.used+delta > filesystem.quota {
+		return &os.PathError{Op: "write", Path: name, Err: errTooLarge}
+	}
+	filesystem.used += delta
+	return nil
+}
+
+// fits reports whether size more bytes fit within the quota.
+func (filesystem *virtualFilesystem) fits(size int) bool {
+	filesystem.mutex.Lock()
+	defer filesystem.mutex.Unlock()
+	return filesystem.quota == 0 || filesystem.used+size <= filesystem.quota
+}
+
+func (filesystem *virtualFilesystem) writeFile(name string, data []byte, perm os.FileMode) error {
+	filesystem.mutex.Lock()
+	defer filesystem.mutex.Unlock()
+	node, err := filesystem.createFile("open", name, perm, func(node *fsNode) error {
+		return filesystem.grow(name, len(data)-len(node.data))
+	})
+	if err != nil {
+		return err
+	}
+	node.data = append([]byte(nil), data...)
+	node.modTime = time.Now()
+	return nil
+}
+
+func (filesystem *virtualFilesystem) appendFile(name string, data []byte, perm os.FileMode) error {
+	filesystem.mutex.Lock()
+	defer filesystem.mutex.Unlock()
+	node, err := filesystem.createFile("open", name, perm, func(node *fsNode) error {
+		if len(node.data)+len(data) > maxUploadSize {
+			return &os.PathError{Op: "write", Path: name, Err: errTooLarge}
+		}
+		return filesystem.grow(name, len(data))
+	})
+	if err != nil {
+		return err
+	}
+	node.data = append(node.data, data...)
+	node.modTime = time.Now()
+	return nil
+}
+
+func (filesystem *virtualFilesystem) addNode(op, name string, node *fsNode) error {
+	parent, base, existing, err := filesystem.walk(name, false)
+	if err == nil && existing != nil {
+		err = errExist
+	}
+	if err == nil && parent == nil {
+		err = errNotExist
+	}
+	if err != nil {
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+	parent.children[base] = node
+	parent.modTime = time.Now()
+	return nil
+}
+
+func (filesystem *virtualFilesystem) mkdir(name string, perm os.FileMode) error {
+	filesystem.mutex.Lock()
+	defer filesystem.mutex.Unlock()
+	return filesystem.addNode("mkdir", name, &fsNode{
+		mode:     os.ModeDir | perm&os.ModePerm,
+		modTime:  time.Now(),
+		children: map[string]*fsNode{},
+	})
+}
+
+func (filesystem *virtualFilesystem) mkdirAll(name string, perm os.FileMode) error {
+	current := "/"
+	for _, component := range splitPath(name) {
+		current = path.Join(current, component)
+		info, err := filesystem.stat(current)
+		if err == nil {
+			if !info.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: current, Err: errNotDir}
+			}
+			continue
+		}
+		if err := filesystem.mkdir(current, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (filesystem *virtualFilesystem) symlink(target, name string) error {
+	filesystem.mutex.Lock()
+	defer filesystem.mutex.Unlock()
+	return filesystem.addNode("symlink", name, &fsNode{
+		mode:    os.ModeSymlink | 0777,
+		modTime: time.Now(),
+		target:  target,
+	})
+}
+
+func (filesystem *virtualFilesystem) remove(name string) error {
+	filesystem.mutex.Lock()
+	defer filesystem.mutex.Unlock()
+	parent, base, node, err := filesystem.walk(name, false)
+	if err == nil && node == nil {
+		err = errNotExist
+	}
+	if err == nil && parent == nil {
+		err = errInvalid
+	}
+	if err == nil && node.mode.IsDir() && len(node.children) != 0 {
+		err = errNotEmpty
+	}
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	filesystem.used -= len(node.data)
+	delete(parent.children, base)
+	parent.modTime = time.Now()
+	return nil
+}
+
+func (filesystem *virtualFilesystem) rename(oldName, newName string) error {
+	filesystem.mutex.Lock()
+	defer filesystem.mutex.Unlock()
+	oldParent, oldBase, node, err := filesystem.walk(oldName, false)
+	if err == nil && node == nil {
+		err = errNotExist
+	}
+	if err == nil && oldParent == nil {
+		err = errInvalid
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: err}
+	}
+	newParent, newBase, existing, err := filesystem.walk(newName, false)
+	if err == nil && newParent == nil {
+		err = errInvalid
+	}
+	if err == nil && existing != nil && existing.mode.IsDir() != node.mode.IsDir() {
+		if existing.mode.IsDir() {
+			err = errIsDir
+		} else {
+			err = errNotDir
+		}
+	}
+	if err == nil && existing != nil && existing.mode.IsDir() && len(existing.children) != 0 {
+		err = errNotEmpty
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: err}
+	}
+	if existing != nil && existing != node {
+		filesystem.used -= len(existing.data)
+	}
+	delete(oldParent.children, oldBase)
+	newParent.children[newBase] = node
+	oldParent.modTime = time.Now()
+	newParent.modTime = oldParent.modTime
+	return nil
+}
+
+func (filesystem *virtualFilesystem) chmod(name string, mode os.FileMode) error {
+	filesystem.mutex.Lock()
+	defer filesystem.mutex.Unlock()
+	node, err := filesystem.lookup("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	node.mode = node.mode&os.ModeType | mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+	return nil
+}
+
+func (filesystem *virtualFilesystem) chown(name string, owner fileOwner) error {
+	filesystem.mutex.Lock()
+	defer filesystem.mutex.Unlock()
+	node, err := filesystem.lookup("chown", name, true)
+	if err != nil {
+		return err
+	}
+	node.owner = owner
+	return nil
+}
+
+func (filesystem *virtualFilesystem) chtimes(name string, modTime time.Time) error {
+	filesystem.mutex.Lock()
+	defer filesystem.mutex.Unlock()
+	node, err := filesystem.lookup("utime", name, true)
+	if err != nil {
+		return err
+	}
+	node.modTime = modTime
+	return nil
+}
+
+// fsErrorMessage formats filesystem errors the way coreutils does, without
+// the operation prefix Go adds to path errors.
+func fsErrorMessage(err error) string {
+	var pathError *os.PathError
+	if errors.As(err, &pathError) {
+		return pathError.Err.Error()
+	}
+	var linkError *os.LinkError
+	if errors.As(err, &linkError) {
+		return linkError.Err.Error()
+	}
+	return err.Error()
+}
+
+type filesystemImageEntry struct {
+	Path    string `yaml:"path"`
+	Type    string `yaml:"type"`
+	Mode    string `yaml:"mode"`
+	UID     uint32 `yaml:"uid"`
+	GID     uint32 `yaml:"gid"`
+	ModTime string `yaml:"mtime"`
+	Content string `yaml:"content"`
+	Target  string `yaml:"target"`
+}
+
+type filesystemImage struct {
+	ModTime string                 `yaml:"mtime"`
+	Files   []filesystemImageEntry `yaml:"files"`
+}
+
+// unixMode converts a numeric Unix mode to an os.FileMode, keeping the
+// setuid, setgid and sticky bits.
+func unixMode(mode uint64) os.FileMode {
+	result := os.FileMode(mode) & os.ModePerm
+	if mode&04000 != 0 {
+		result |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		result |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		result |= os.ModeSticky
+	}
+	return result
+}
+
+func parseImageTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func (filesystem *virtualFilesystem) addImageEntry(entry filesystemImageEntry, defaultModTime time.Time) error {
+	name := resolvePath("/", entry.Path)
+	modTime, err := parseImageTime(entry.ModTime, defaultModTime)
+	if err != nil {
+		return err
+	}
+	var perm uint64 = 0644
+	if entry.Type == "dir" {
+		perm = 0755
+	}
+	if entry.Mode != "" {
+		if perm, err = strconv.ParseUint(entry.Mode, 8, 32); err != nil {
+			return err
+		}
+	}
+	if err := filesystem.mkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+	switch entry.Type {
+	case "", "file":
+		err = filesystem.writeFile(name, []byte(entry.Content), 0)
+	case "dir":
+		err = filesystem.mkdirAll(name, 0)
+	case "symlink":
+		err = filesystem.symlink(entry.Target, name)
+	default:
+		err = fmt.Errorf("unsupported file type %q", entry.Type)
+	}
+	if err != nil {
+		return err
+	}
+	filesystem.mutex.Lock()
+	defer filesystem.mutex.Unlock()
+	node, err := filesystem.lookup("stat", name, false)
+	if err != nil {
+		return err
+	}
+	if node.mode&os.ModeSymlink == 0 {
+		node.mode = node.mode&os.ModeType | unixMode(perm)
+	}
+	node.owner = fileOwner{entry.UID, entry.GID}
+	node.modTime = modTime
+	return nil
+}
+
+func parseYAMLFilesystemImage(imageBytes []byte) (*virtualFilesystem, error) {
+	image := filesystemImage{}
+	if err := yaml.UnmarshalStrict(imageBytes, &image); err != nil {
+		return nil, err
+	}
+	modTime, err := parseImageTime(image.ModTime, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	filesystem := newVirtualFilesystem(modTime)
+	for _, entry := range image.Files {
+		if err := filesystem.addImageEntry(entry, modTime); err != nil {
+			return nil, err
+		}
+	}
+	return filesystem, nil
+}
+
+func parseTarFilesystemImage(reader io.Reader) (*virtualFilesystem, error) {
+	filesystem := newVirtualFilesystem(time.Now())
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry := filesystemImageEntry{
+			Path:    header.Name,
+			Mode:    strconv.FormatInt(header.Mode&07777, 8),
+			UID:     uint32(header.Uid),
+			GID:     uint32(header.Gid),
+			ModTime: header.ModTime.Format(time.RFC3339),
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			entry.Type = "dir"
+		case tar.TypeSymlink:
+			entry.Type = "symlink"
+			entry.Target = header.Linkname
+		case tar.TypeLink:
+			content, err := filesystem.readFile(resolvePath("/", header.Linkname))
+			if err != nil {
+				return nil, err
+			}
+			entry.Content = string(content)
+		case tar.TypeReg, tar.TypeRegA:
+			content, err := ioutil.ReadAll(tarReader)
+			if err != nil {
+				return nil, err
+			}
+			entry.Content = string(content)
+		default:
+			continue
+		}
+		if resolvePath("/", entry.Path) == "/" {
+			continue
+		}
+		if err := filesystem.addImageEntry(entry, header.ModTime); err != nil {
+			return nil, err
+		}
+	}
+	return filesystem, nil
+}
+
+func loadFilesystemImage(imageFile string) (*virtualFilesystem, error) {
+	file, err := os.Open(imageFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	switch {
+	case strings.HasSuffix(imageFile, ".tar.gz"), strings.HasSuffix(imageFile, ".tgz"):
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		return parseTarFilesystemImage(gzipReader)
+	case strings.HasSuffix(imageFile, ".tar"):
+		return parseTarFilesystemImage(file)
+	default:
+		imageBytes, err := ioutil.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+		return parseYAMLFilesystemImage(imageBytes)
+	}
+}
+
+//go:embed filesystem.yaml
+var defaultFilesystemImageBytes []byte
+
+var defaultFilesystemImage *virtualFilesystem
+
+func init() {
+	var err error
+	defaultFilesystemImage, err = parseYAMLFilesystemImage(defaultFilesystemImageBytes)
+	if err != nil {
+		panic(fmt.Sprintf("invalid default filesystem image: %v", err))
+	}
+}
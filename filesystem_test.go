@@ -0,0 +1,239 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDefaultFilesystemImage(t *testing.T) {
+	filesystem := defaultFilesystemImage.clone()
+	passwd, err := filesystem.readFile("/etc/passwd")
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if !bytes.HasPrefix(passwd, []byte("root:x:0:0:root:/root:/bin/bash\n")) {
+		t.Errorf("passwd=%v, want a root entry first", string(passwd))
+	}
+	release, err := filesystem.readFile("/etc/os-release")
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if !bytes.Contains(release, []byte("Ubuntu")) {
+		t.Errorf("release=%v, want Ubuntu", string(release))
+	}
+	info, err := filesystem.stat("/tmp")
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if expectedMode := os.ModeDir | os.ModeSticky | 0777; info.Mode() != expectedMode {
+		t.Errorf("info.Mode()=%v, want %v", info.Mode(), expectedMode)
+	}
+	info, err = filesystem.stat("/usr/bin/../../etc/shadow")
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if owner := info.Sys().(fileOwner); owner != (fileOwner{0, 42}) {
+		t.Errorf("owner=%v, want %v", owner, fileOwner{0, 42})
+	}
+}
+
+func TestFilesystemOperations(t *testing.T) {
+	filesystem := newVirtualFilesystem(time.Now())
+	if err := filesystem.mkdirAll("/a/b", 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := filesystem.writeFile("/a/b/c", []byte("foo"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := filesystem.appendFile("/a/b/c", []byte("bar"), 0644); err != nil {
+		t.Fatalf("Failed to append to file: %v", err)
+	}
+	if err := filesystem.symlink("b/c", "/a/link"); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	content, err := filesystem.readFile("/a/link")
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if string(content) != "foobar" {
+		t.Errorf("content=%v, want foobar", string(content))
+	}
+	if err := filesystem.rename("/a/b/c", "/a/d"); err != nil {
+		t.Fatalf("Failed to rename file: %v", err)
+	}
+	if _, err := filesystem.readFile("/a/link"); !errors.Is(err, errNotExist) {
+		t.Errorf("err=%v, want %v", err, errNotExist)
+	}
+	if err := filesystem.remove("/a"); !errors.Is(err, errNotEmpty) {
+		t.Errorf("err=%v, want %v", err, errNotEmpty)
+	}
+	if err := filesystem.writeFile("/a/d/e", nil, 0644); !errors.Is(err, errNotDir) {
+		t.Errorf("err=%v, want %v", err, errNotDir)
+	}
+	if _, err := filesystem.readFile("/a"); !errors.Is(err, errIsDir) {
+		t.Errorf("err=%v, want %v", err, errIsDir)
+	}
+	entries, err := filesystem.readDir("/a")
+	if err != nil {
+		t.Fatalf("Failed to read directory: %v", err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if expectedNames := []string{"b", "d", "link"}; !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("names=%v, want %v", names, expectedNames)
+	}
+
+	clone := filesystem.clone()
+	if err := clone.remove("/a/d"); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	if _, err := filesystem.stat("/a/d"); err != nil {
+		t.Errorf("err=%v, want nil", err)
+	}
+}
+
+func TestYAMLFilesystemImage(t *testing.T) {
+	filesystem, err := parseYAMLFilesystemImage([]byte(`
+mtime: 2020-01-02T03:04:05Z
+files:
+  - path: /etc/motd
+    mode: "0600"
+    uid: 1000
+    gid: 1000
+    content: hello
+  - path: /var/run
+    type: symlink
+    target: /run
+  - path: /srv/www
+    type: dir
+    mode: "2750"
+    mtime: 2019-01-02T03:04:05Z
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse image: %v", err)
+	}
+	info, err := filesystem.stat("/etc/motd")
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	expectedInfo := fileInfo{"motd", 5, 0600, fileOwner{1000, 1000}, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), 1}
+	if !reflect.DeepEqual(info, expectedInfo) {
+		t.Errorf("info=%v, want %v", info, expectedInfo)
+	}
+	target, err := filesystem.readlink("/var/run")
+	if err != nil {
+		t.Fatalf("Failed to read link: %v", err)
+	}
+	if target != "/run" {
+		t.Errorf("target=%v, want /run", target)
+	}
+	info, err = filesystem.stat("/srv/www")
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if expectedMode := os.ModeDir | os.ModeSetgid | 0750; info.Mode() != expectedMode {
+		t.Errorf("info.Mode()=%v, want %v", info.Mode(), expectedMode)
+	}
+	if expectedTime := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC); !info.ModTime().Equal(expectedTime) {
+		t.Errorf("info.ModTime()=%v, want %v", info.ModTime(), expectedTime)
+	}
+}
+
+func TestTarFilesystemImage(t *testing.T) {
+	imageFile := path.Join(t.TempDir(), "filesystem.tar")
+	buffer := &bytes.Buffer{}
+	writer := tar.NewWriter(buffer)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, header := range []*tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0755, ModTime: modTime},
+		{Name: "./etc/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: modTime},
+		{Name: "./etc/hostname", Typeflag: tar.TypeReg, Mode: 0644, Size: 4, ModTime: modTime},
+		{Name: "./etc/host", Typeflag: tar.TypeSymlink, Linkname: "hostname", ModTime: modTime},
+	} {
+		if err := writer.WriteHeader(header); err != nil {
+			t.Fatalf("Failed to write header: %v", err)
+		}
+		if header.Size != 0 {
+			if _, err := writer.Write([]byte("box\n")); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close archive: %v", err)
+	}
+	if err := ioutil.WriteFile(imageFile, buffer.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write image: %v", err)
+	}
+	filesystem, err := loadFilesystemImage(imageFile)
+	if err != nil {
+		t.Fatalf("Failed to load image: %v", err)
+	}
+	content, err := filesystem.readFile("/etc/host")
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if string(content) != "box\n" {
+		t.Errorf("content=%v, want box", string(content))
+	}
+}
+
+func TestCat(t *testing.T) {
+	filesystem := defaultFilesystemImage.clone()
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	status, err := executeProgram(commandContext{
+		args:       []string{"cat", "../etc/hostname", "/nonexistent", "/etc"},
+		stdout:     stdout,
+		stderr:     stderr,
+		filesystem: filesystem,
+		env:        newShellEnvironment("/root", nil),
+	})
+	if err != nil {
+		t.Fatalf("Failed to execute program: %v", err)
+	}
+	if status != 1 {
+		t.Errorf("status=%v, want 1", status)
+	}
+	if stdout.String() != "ubuntu\n" {
+		t.Errorf("stdout=%v, want ubuntu", stdout.String())
+	}
+	expectedStderr := "cat: /nonexistent: No such file or directory\ncat: /etc: Is a directory\n"
+	if stderr.String() != expectedStderr {
+		t.Errorf("stderr=%v, want %v", stderr.String(), expectedStderr)
+	}
+}
+
+func TestFilesystemQuota(t *testing.T) {
+	filesystem := newVirtualFilesystem(time.Now())
+	filesystem.quota = 8
+	if err := filesystem.writeFile("/a", []byte("12345"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := filesystem.appendFile("/a", []byte("6789"), 0644); !errors.Is(err, errTooLarge) {
+		t.Errorf("err=%v, want %v", err, errTooLarge)
+	}
+	if err := filesystem.writeFile("/b", []byte("6789"), 0644); !errors.Is(err, errTooLarge) {
+		t.Errorf("err=%v, want %v", err, errTooLarge)
+	}
+	if err := filesystem.writeFile("/a", []byte("1"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := filesystem.writeFile("/b", []byte("2345678"), 0644); err != nil {
+		t.Errorf("err=%v, want nil", err)
+	}
+	if err := filesystem.remove("/b"); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	if err := filesystem.appendFile("/a", []byte("2345678"), 0644); err != nil {
+		t.Errorf("err=%v, want nil", err)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	msgKexInit = 20
+	// maxKexInitCapture bounds how much of each direction is buffered while
+	// looking for the KEXINIT packet.
+	maxKexInitCapture = 64 * 1024
+)
+
+// kexInit holds the algorithm lists of an SSH_MSG_KEXINIT packet.
+type kexInit struct {
+	KexAlgorithms                       []string `json:"kex_algorithms"`
+	ServerHostKeyAlgorithms             []string `json:"server_host_key_algorithms"`
+	EncryptionAlgorithmsClientToServer  []string `json:"encryption_algorithms_client_to_server"`
+	EncryptionAlgorithmsServerToClient  []string `json:"encryption_algorithms_server_to_client"`
+	MACAlgorithmsClientToServer         []string `json:"mac_algorithms_client_to_server"`
+	MACAlgorithmsServerToClient         []string `json:"mac_algorithms_server_to_client"`
+	CompressionAlgorithmsClientToServer []string `json:"compression_algorithms_client_to_server"`
+	CompressionAlgorithmsServerToClient []string `json:"compression_algorithms_server_to_client"`
+}
+
+func readNameList(data []byte) ([]string, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, errors.New("truncated name-list")
+	}
+	length := binary.BigEndian.Uint32(data)
+	if uint32(len(data)-4) < length {
+		return nil, nil, errors.New("truncated name-list")
+	}
+	list := string(data[4 : 4+length])
+	if list == "" {
+		return []string{}, data[4+length:], nil
+	}
+	return strings.Split(list, ","), data[4+length:], nil
+}
+
+// parseKexInit parses the payload of a KEXINIT packet.
+func parseKexInit(payload []byte) (*kexInit, error) {
+	if len(payload) < 17 || payload[0] != msgKexInit {
+		return nil, errors.New("not a KEXINIT packet")
+	}
+	data := payload[17:]
+	result := &kexInit{}
+	for _, list := range []*[]string{
+		&result.KexAlgorithms,
+		&result.ServerHostKeyAlgorithms,
+		&result.EncryptionAlgorithmsClientToServer,
+		&result.EncryptionAlgorithmsServerToClient,
+		&result.MACAlgorithmsClientToServer,
+		&result.MACAlgorithmsServerToClient,
+		&result.CompressionAlgorithmsClientToServer,
+		&result.CompressionAlgorithmsServerToClient,
+	} {
+		var err error
+		if *list, data, err = readNameList(data); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// hassh returns the HASSH of a client KEXINIT and the string it hashes.
+func (kex *kexInit) hassh() (string, string) {
+	algorithms := strings.Join([]string{
+		strings.Join(kex.KexAlgorithms, ","),
+		strings.Join(kex.EncryptionAlgorithmsClientToServer, ","),
+		strings.Join(kex.MACAlgorithmsClientToServer, ","),
+		strings.Join(kex.CompressionAlgorithmsClientToServer, ","),
+	}, ";")
+	sum := md5.Sum([]byte(algorithms))
+	return hex.EncodeToString(sum[:]), algorithms
+}
+
+// hasshServer returns the HASSHServer of a server KEXINIT and the string it
+// hashes.
+func (kex *kexInit) hasshServer() (string, string) {
+	algorithms := strings.Join([]string{
+		strings.Join(kex.KexAlgorithms, ","),
+		strings.Join(kex.EncryptionAlgorithmsServerToClient, ","),
+		strings.Join(kex.MACAlgorithmsServerToClient, ","),
+		strings.Join(kex.CompressionAlgorithmsServerToClient, ","),
+	}, ";")
+	sum := md5.Sum([]byte(algorithms))
+	return hex.EncodeToString(sum[:]), algorithms
+}
+
+// firstCommon returns the first client algorithm the server also supports,
+// which is how SSH picks each algorithm.
+func firstCommon(client, server []string) string {
+	for _, clientAlgorithm := range client {
+		for _, serverAlgorithm := range server {
+			if clientAlgorithm == serverAlgorithm {
+				return clientAlgorithm
+			}
+		}
+	}
+	return ""
+}
+
+// aeadCiphers authenticate the data themselves, so no MAC is used with them.
+var aeadCiphers = map[string]bool{
+	"aes128-gcm@openssh.com":        true,
+	"aes256-gcm@openssh.com":        true,
+	"chacha20-poly1305@openssh.com": true,
+}
+
+// negotiateMAC returns the MAC agreed on for a direction using cipher, which
+// is empty for AEAD ciphers.
+func negotiateMAC(cipher string, client, server []string) string {
+	if aeadCiphers[cipher] {
+		return ""
+	}
+	return firstCommon(client, server)
+}
+
+// negotiate returns the algorithms agreed on by a client and server KEXINIT.
+func negotiate(client, server *kexInit) handshakeLog {
+	cipherClientToServer := firstCommon(client.EncryptionAlgorithmsClientToServer, server.EncryptionAlgorithmsClientToServer)
+	cipherServerToClient := firstCommon(client.EncryptionAlgorithmsServerToClient, server.EncryptionAlgorithmsServerToClient)
+	return handshakeLog{
+		Kex:                       firstCommon(client.KexAlgorithms, server.KexAlgorithms),
+		HostKey:                   firstCommon(client.ServerHostKeyAlgorithms, server.ServerHostKeyAlgorithms),
+		CipherClientToServer:      cipherClientToServer,
+		CipherServerToClient:      cipherServerToClient,
+		MACClientToServer:         negotiateMAC(cipherClientToServer, client.MACAlgorithmsClientToServer, server.MACAlgorithmsClientToServer),
+		MACServerToClient:         negotiateMAC(cipherServerToClient, client.MACAlgorithmsServerToClient, server.MACAlgorithmsServerToClient),
+		CompressionClientToServer: firstCommon(client.CompressionAlgorithmsClientToServer, server.CompressionAlgorithmsClientToServer),
+		CompressionServerToClient: firstCommon(client.CompressionAlgorithmsServerToClient, server.CompressionAlgorithmsServerToClient),
+	}
+}
+
+// handshakeCapture accumulates the start of one direction of a connection
+// until the version line and the first binary packet, which is always the
+// unencrypted KEXINIT, have been seen.
+type handshakeCapture struct {
+	buffer  []byte
+	done    bool
+	version string
+	kexInit *kexInit
+}
+
+func (capture *handshakeCapture) add(data []byte) {
+	if capture.done {
+		return
+	}
+	capture.buffer = append(capture.buffer, data...)
+	for capture.version == "" {
+		end := bytes.IndexByte(capture.buffer, '\n')
+		if end < 0 {
+			capture.giveUpIfFull()
+			return
+		}
+		line := strings.TrimRight(string(capture.buffer[:end]), "\r")
+		capture.buffer = capture.buffer[end+1:]
+		if strings.HasPrefix(line, "SSH-") {
+			capture.version = line
+		}
+	}
+	rest := capture.buffer
+	if len(rest) < 5 {
+		capture.giveUpIfFull()
+		return
+	}
+	length := binary.BigEndian.Uint32(rest)
+	if length > maxKexInitCapture {
+		capture.finish()
+		return
+	}
+	if uint32(len(rest)-4) < length {
+		capture.giveUpIfFull()
+		return
+	}
+	padding := uint32(rest[4])
+	if padding+1 <= length {
+		capture.kexInit, _ = parseKexInit(rest[5 : 4+length-padding])
+	}
+	capture.finish()
+}
+
+func (capture *handshakeCapture) giveUpIfFull() {
+	if len(capture.buffer) > maxKexInitCapture {
+		capture.finish()
+	}
+}
+
+func (capture *handshakeCapture) finish() {
+	capture.done = true
+	capture.buffer = nil
+}
+
+// kexInitRecorder wraps a connection to capture the version lines and KEXINIT
+// packets sent by both sides.
+type kexInitRecorder struct {
+	net.Conn
+	mutex          sync.Mutex
+	client, server handshakeCapture
+}
+
+func (conn *kexInitRecorder) Read(p []byte) (int, error) {
+	n, err := conn.Conn.Read(p)
+	conn.mutex.Lock()
+	conn.client.add(p[:n])
+	conn.mutex.Unlock()
+	return n, err
+}
+
+func (conn *kexInitRecorder) Write(p []byte) (int, error) {
+	conn.mutex.Lock()
+	conn.server.add(p)
+	conn.mutex.Unlock()
+	return conn.Conn.Write(p)
+}
+
+// clientKexInit returns the client's version line and KEXINIT, if they have
+// been seen.
+func (conn *kexInitRecorder) clientKexInit() (string, *kexInit) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.client.version, conn.client.kexInit
+}
+
+// serverKexInit returns the server's KEXINIT, if it has been seen.
+func (conn *kexInitRecorder) serverKexInit() *kexInit {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.server.kexInit
+}
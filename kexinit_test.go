@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func appendUint32(data []byte, value uint32) []byte {
+	var encoded [4]byte
+	binary.BigEndian.PutUint32(encoded[:], value)
+	return append(data, encoded[:]...)
+}
+
+func buildKexInitPacket(lists [8]string) []byte {
+	payload := append([]byte{msgKexInit}, make([]byte, 16)...)
+	for _, list := range lists {
+		payload = appendUint32(payload, uint32(len(list)))
+		payload = append(payload, list...)
+	}
+	// first_kex_packet_follows and reserved.
+	payload = append(payload, 0, 0, 0, 0, 0)
+	padding := 8 - (len(payload)+5)%8
+	if padding < 4 {
+		padding += 8
+	}
+	packet := appendUint32(nil, uint32(1+len(payload)+padding))
+	packet = append(packet, byte(padding))
+	packet = append(packet, payload...)
+	return append(packet, make([]byte, padding)...)
+}
+
+var testKexInitLists = [8]string{
+	"curve25519-sha256,diffie-hellman-group14-sha1",
+	"ssh-ed25519",
+	"aes128-ctr,aes256-ctr",
+	"aes256-ctr",
+	"hmac-sha2-256",
+	"hmac-sha1",
+	"none",
+	"none,zlib@openssh.com",
+}
+
+func TestParseKexInit(t *testing.T) {
+	packet := buildKexInitPacket(testKexInitLists)
+	kex, err := parseKexInit(packet[5 : len(packet)-int(packet[4])])
+	if err != nil {
+		t.Fatalf("Failed to parse KEXINIT: %v", err)
+	}
+	expectedKex := &kexInit{
+		KexAlgorithms:                       []string{"curve25519-sha256", "diffie-hellman-group14-sha1"},
+		ServerHostKeyAlgorithms:             []string{"ssh-ed25519"},
+		EncryptionAlgorithmsClientToServer:  []string{"aes128-ctr", "aes256-ctr"},
+		EncryptionAlgorithmsServerToClient:  []string{"aes256-ctr"},
+		MACAlgorithmsClientToServer:         []string{"hmac-sha2-256"},
+		MACAlgorithmsServerToClient:         []string{"hmac-sha1"},
+		CompressionAlgorithmsClientToServer: []string{"none"},
+		CompressionAlgorithmsServerToClient: []string{"none", "zlib@openssh.com"},
+	}
+	if !reflect.DeepEqual(kex, expectedKex) {
+		t.Errorf("kex=%+v, want %+v", kex, expectedKex)
+	}
+
+	hassh, algorithms := kex.hassh()
+	expectedAlgorithms := "curve25519-sha256,diffie-hellman-group14-sha1;aes128-ctr,aes256-ctr;hmac-sha2-256;none"
+	if algorithms != expectedAlgorithms {
+		t.Errorf("algorithms=%v, want %v", algorithms, expectedAlgorithms)
+	}
+	if sum := md5.Sum([]byte(expectedAlgorithms)); hassh != hex.EncodeToString(sum[:]) {
+		t.Errorf("hassh=%v, want MD5 of %v", hassh, expectedAlgorithms)
+	}
+	_, serverAlgorithms := kex.hasshServer()
+	expectedServerAlgorithms := "curve25519-sha256,diffie-hellman-group14-sha1;aes256-ctr;hmac-sha1;none,zlib@openssh.com"
+	if serverAlgorithms != expectedServerAlgorithms {
+		t.Errorf("serverAlgorithms=%v, want %v", serverAlgorithms, expectedServerAlgorithms)
+	}
+
+	if _, err := parseKexInit([]byte{msgKexInit}); err == nil {
+		t.Errorf("Expected an error for a truncated KEXINIT")
+	}
+}
+
+func TestKexInitRecorder(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		chunks []string
+	}{
+		{"single write", []string{"SSH-2.0-Test\r\n" + string(buildKexInitPacket(testKexInitLists))}},
+		{"byte by byte", strings.Split("SSH-2.0-Test\r\n"+string(buildKexInitPacket(testKexInitLists)), "")},
+		{"preceding lines", []string{"hello\r\n", "SSH-2.0-Test\r\n", string(buildKexInitPacket(testKexInitLists))}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			recorder := &kexInitRecorder{Conn: server}
+			go func() {
+				for _, chunk := range test.chunks {
+					client.Write([]byte(chunk))
+				}
+				client.Close()
+			}()
+			buffer := make([]byte, 1024)
+			for {
+				if _, err := recorder.Read(buffer); err != nil {
+					break
+				}
+			}
+			version, kex := recorder.clientKexInit()
+			if version != "SSH-2.0-Test" {
+				t.Errorf("version=%q, want %q", version, "SSH-2.0-Test")
+			}
+			if kex == nil {
+				t.Fatalf("KEXINIT not captured")
+			}
+			if !reflect.DeepEqual(kex.ServerHostKeyAlgorithms, []string{"ssh-ed25519"}) {
+				t.Errorf("ServerHostKeyAlgorithms=%v, want [ssh-ed25519]", kex.ServerHostKeyAlgorithms)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	packet := buildKexInitPacket(testKexInitLists)
+	client, err := parseKexInit(packet[5 : len(packet)-int(packet[4])])
+	if err != nil {
+		t.Fatalf("Failed to parse KEXINIT: %v", err)
+	}
+	server := &kexInit{
+		KexAlgorithms:                       []string{"diffie-hellman-group14-sha1", "curve25519-sha256"},
+		ServerHostKeyAlgorithms:             []string{"ssh-rsa", "ssh-ed25519"},
+		EncryptionAlgorithmsClientToServer:  []string{"aes256-ctr", "aes128-ctr"},
+		EncryptionAlgorithmsServerToClient:  []string{"aes256-ctr"},
+		MACAlgorithmsClientToServer:         []string{"hmac-sha2-256"},
+		MACAlgorithmsServerToClient:         []string{"hmac-sha2-256", "hmac-sha1"},
+		CompressionAlgorithmsClientToServer: []string{"none"},
+		CompressionAlgorithmsServerToClient: []string{"zlib@openssh.com", "none"},
+	}
+	handshake := negotiate(client, server)
+	expectedHandshake := handshakeLog{
+		Kex:                       "curve25519-sha256",
+		HostKey:                   "ssh-ed25519",
+		CipherClientToServer:      "aes128-ctr",
+		CipherServerToClient:      "aes256-ctr",
+		MACClientToServer:         "hmac-sha2-256",
+		MACServerToClient:         "hmac-sha1",
+		CompressionClientToServer: "none",
+		CompressionServerToClient: "none",
+	}
+	if handshake != expectedHandshake {
+		t.Errorf("handshake=%+v, want %+v", handshake, expectedHandshake)
+	}
+
+	server.EncryptionAlgorithmsClientToServer = []string{"chacha20-poly1305@openssh.com", "aes128-ctr"}
+	server.EncryptionAlgorithmsServerToClient = []string{"aes128-gcm@openssh.com"}
+	client.EncryptionAlgorithmsClientToServer = []string{"chacha20-poly1305@openssh.com"}
+	client.EncryptionAlgorithmsServerToClient = []string{"aes128-gcm@openssh.com"}
+	handshake = negotiate(client, server)
+	if handshake.MACClientToServer != "" || handshake.MACServerToClient != "" {
+		t.Errorf("MACs=%q %q, want none with AEAD ciphers", handshake.MACClientToServer, handshake.MACServerToClient)
+	}
+}
+
+func TestHandshakeFailed(t *testing.T) {
+	dataDir := t.TempDir()
+	key, err := generateKey(dataDir, ecdsa_key)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	cfg := &config{}
+	cfg.Server.HostKeys = []string{key}
+	cfg.Logging.JSON = true
+	cfg.Auth.NoAuth = true
+	if err := cfg.setupSSHConfig(); err != nil {
+		t.Fatalf("Failed to setup SSH config: %v", err)
+	}
+	logBuffer := setupLogBuffer(t, cfg)
+
+	client, server := net.Pipe()
+	done := make(chan interface{})
+	go func() {
+		handleConnection(server, cfg)
+		close(done)
+	}()
+	go ioutil.ReadAll(client)
+	lists := testKexInitLists
+	lists[0] = "unsupported-kex"
+	packet := buildKexInitPacket(lists)
+	client.Write([]byte("SSH-2.0-Scanner\r\n"))
+	client.Write(packet)
+	<-done
+	client.Close()
+
+	kex, err := parseKexInit(packet[5 : len(packet)-int(packet[4])])
+	if err != nil {
+		t.Fatalf("Failed to parse KEXINIT: %v", err)
+	}
+	hassh, _ := kex.hassh()
+	var entry struct {
+		Source    string             `json:"source"`
+		EventType string             `json:"event_type"`
+		Event     handshakeFailedLog `json:"event"`
+	}
+	if err := json.Unmarshal(logBuffer.Bytes(), &entry); err != nil {
+		t.Fatalf("Failed to parse logs %q: %v", logBuffer.String(), err)
+	}
+	if entry.EventType != "handshake_failed" || entry.Event.ClientVersion != "SSH-2.0-Scanner" || entry.Event.HASSH != hassh || entry.Event.Error == "" {
+		t.Errorf("entry=%+v, want a handshake_failed event from SSH-2.0-Scanner with HASSH %v and an error", entry, hassh)
+	}
+}
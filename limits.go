@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// connectionLimiter admits new connections within the global and per IP
+// concurrency limits and the per IP rate limit.
+type connectionLimiter struct {
+	mutex     sync.Mutex
+	active    int
+	activeIPs map[string]int
+	recent    map[string][]time.Time
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+// connectionIP returns the key connections from the same client share, which
+// is empty for non-TCP connections.
+func connectionIP(addr net.Addr) string {
+	if addr, ok := addr.(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+func (limiter *connectionLimiter) prune(now time.Time, window time.Duration) {
+	if now.Sub(limiter.lastPrune) < window {
+		return
+	}
+	for ip, times := range limiter.recent {
+		if now.Sub(times[len(times)-1]) >= window {
+			delete(limiter.recent, ip)
+		}
+	}
+	limiter.lastPrune = now
+}
+
+// admit records a new connection from ip and returns why it is rejected, or
+// an empty string if it is admitted. Every attempt counts towards the rate
+// limit so clients that keep hammering stay rejected. Admitted connections
+// must be released.
+func (limiter *connectionLimiter) admit(ip string, limits limitsConfig) string {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if limiter.activeIPs == nil {
+		limiter.activeIPs = map[string]int{}
+		limiter.recent = map[string][]time.Time{}
+	}
+	if limiter.now == nil {
+		limiter.now = time.Now
+	}
+	if limits.RateLimit.Connections > 0 {
+		now := limiter.now()
+		limiter.prune(now, limits.RateLimit.Window)
+		var times []time.Time
+		for _, connected := range limiter.recent[ip] {
+			if now.Sub(connected) < limits.RateLimit.Window {
+				times = append(times, connected)
+			}
+		}
+		limiter.recent[ip] = append(times, now)
+		if len(times) >= limits.RateLimit.Connections {
+			return "rate_limit"
+		}
+	}
+	if limits.MaxConnectionsPerIP > 0 && limiter.activeIPs[ip] >= limits.MaxConnectionsPerIP {
+		return "max_connections_per_ip"
+	}
+	if limits.MaxConnections > 0 && limiter.active >= limits.MaxConnections {
+		return "max_connections"
+	}
+	limiter.active++
+	limiter.activeIPs[ip]++
+	return ""
+}
+
+func (limiter *connectionLimiter) release(ip string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.active--
+	if limiter.activeIPs[ip]--; limiter.activeIPs[ip] <= 0 {
+		delete(limiter.activeIPs, ip)
+	}
+}
+
+func (cfg *config) setupLimits() error {
+	limits := cfg.Server.Limits
+	if limits.MaxConnections < 0 || limits.MaxConnectionsPerIP < 0 || limits.RateLimit.Connections < 0 || limits.MaxLifetime < 0 {
+		return errors.New("limits: values must not be negative")
+	}
+	if limits.RateLimit.Connections > 0 && limits.RateLimit.Window <= 0 {
+		return errors.New("limits: rate limit window must be positive")
+	}
+	cfg.connectionLimiter = &connectionLimiter{}
+	return nil
+}
+
+// limitConnection admits a new connection, logging and closing it if it is
+// rejected, and closes it once it outlives the maximum lifetime. The returned
+// function must be called when the connection is done. Nothing is limited
+// until the limits are set up.
+func (cfg *config) limitConnection(conn net.Conn) (func(), bool) {
+	if cfg.connectionLimiter == nil {
+		return func() {}, true
+	}
+	limits := cfg.Server.Limits
+	context := connContext{ConnMetadata: netConnMetadata{conn}, cfg: cfg}
+	ip := connectionIP(conn.RemoteAddr())
+	if reason := cfg.connectionLimiter.admit(ip, limits); reason != "" {
+		context.logEvent(connectionRejectedLog{Reason: reason})
+		conn.Close()
+		return nil, false
+	}
+	var lifetime *time.Timer
+	if limits.MaxLifetime > 0 {
+		lifetime = time.AfterFunc(limits.MaxLifetime, func() {
+			context.logEvent(connectionRejectedLog{Reason: "max_lifetime"})
+			conn.Close()
+		})
+	}
+	return func() {
+		if lifetime != nil {
+			lifetime.Stop()
+		}
+		cfg.connectionLimiter.release(ip)
+	}, true
+}
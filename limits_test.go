@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnectionLimiter(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := &connectionLimiter{now: func() time.Time { return now }}
+	limits := limitsConfig{
+		MaxConnections:      2,
+		MaxConnectionsPerIP: 2,
+		RateLimit:           rateLimitConfig{Connections: 3, Window: time.Minute},
+	}
+	for i, test := range []struct {
+		ip      string
+		release string
+		reason  string
+	}{
+		{ip: "1.2.3.4"},
+		{ip: "1.2.3.4"},
+		{ip: "1.2.3.4", reason: "max_connections_per_ip"},
+		{ip: "1.2.3.4", release: "1.2.3.4", reason: "rate_limit"},
+		{ip: "5.6.7.8"},
+		{ip: "9.9.9.9", reason: "max_connections"},
+	} {
+		if test.release != "" {
+			limiter.release(test.release)
+		}
+		if reason := limiter.admit(test.ip, limits); reason != test.reason {
+			t.Errorf("%v: reason=%q, want %q", i, reason, test.reason)
+		}
+	}
+	limiter.release("5.6.7.8")
+	now = now.Add(time.Minute)
+	if reason := limiter.admit("1.2.3.4", limits); reason != "" {
+		t.Errorf("reason=%q, want the connection admitted once the window passed", reason)
+	}
+	if len(limiter.recent) != 1 {
+		t.Errorf("recent=%v, want idle clients pruned", limiter.recent)
+	}
+}
+
+func TestLimitConnection(t *testing.T) {
+	cfg := &config{}
+	cfg.Server.Limits.MaxConnections = 1
+	cfg.Server.Limits.MaxLifetime = 10 * time.Millisecond
+	if err := cfg.setupLimits(); err != nil {
+		t.Fatalf("Failed to setup limits: %v", err)
+	}
+	logBuffer := setupLogBuffer(t, cfg)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	release, ok := cfg.limitConnection(server)
+	if !ok {
+		t.Fatalf("First connection rejected")
+	}
+	rejectedClient, rejectedServer := net.Pipe()
+	if _, ok := cfg.limitConnection(rejectedServer); ok {
+		t.Errorf("Second connection admitted")
+	}
+	if _, err := rejectedClient.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Rejected connection not closed")
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Connection not closed after its lifetime")
+	}
+	release()
+
+	expectedLogs := `[pipe] connection rejected: max_connections
+[pipe] connection rejected: max_lifetime
+`
+	if logs := logBuffer.String(); logs != expectedLogs {
+		t.Errorf("logs=%v, want %v", logs, expectedLogs)
+	}
+}
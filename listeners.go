@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// listener is an address to accept connections on and the configuration
+// used for them.
+type listener struct {
+	name    string
+	address string
+	cfg     *config
+}
+
+// apply overrides the settings of cfg with those of the listener.
+func (listenerCfg *listenerConfig) apply(cfg *config) error {
+	cfg.Server.ListenAddress = listenerCfg.ListenAddress
+	if len(listenerCfg.HostKeys) > 0 {
+		cfg.Server.HostKeys = listenerCfg.HostKeys
+	}
+	for _, override := range []struct {
+		section string
+		values  map[string]interface{}
+		target  interface{}
+	}{
+		{"ssh_proto", listenerCfg.SSHProto, &cfg.SSHProto},
+		{"auth", listenerCfg.Auth, &cfg.Auth},
+		{"persona", listenerCfg.Persona, &cfg.Persona},
+	} {
+		if override.values == nil {
+			continue
+		}
+		values, err := yaml.Marshal(override.values)
+		if err != nil {
+			return err
+		}
+		if err := yaml.UnmarshalStrict(values, override.target); err != nil {
+			return fmt.Errorf("listener %q: %v: %w", listenerCfg.Name, override.section, err)
+		}
+	}
+	cfg.listenerName = listenerCfg.Name
+	return nil
+}
+
+// listenAddresses returns the name and address of each listener, naming
+// listeners after their address unless they have a name. Without configured
+// listeners the top-level listen address is used.
+func (serverCfg *serverConfig) listenAddresses() ([]listener, error) {
+	if len(serverCfg.Listeners) == 0 {
+		return []listener{{address: serverCfg.ListenAddress}}, nil
+	}
+	var listeners []listener
+	names := map[string]bool{}
+	for i := range serverCfg.Listeners {
+		listenerCfg := &serverCfg.Listeners[i]
+		if listenerCfg.ListenAddress == "" {
+			return nil, fmt.Errorf("listener %v: listen address must be set", i)
+		}
+		if listenerCfg.Name == "" {
+			listenerCfg.Name = listenerCfg.ListenAddress
+		}
+		if names[listenerCfg.Name] {
+			return nil, fmt.Errorf("listener %q: duplicate name", listenerCfg.Name)
+		}
+		names[listenerCfg.Name] = true
+		listeners = append(listeners, listener{name: listenerCfg.Name, address: listenerCfg.ListenAddress})
+	}
+	return listeners, nil
+}
+
+// setupListeners creates the configuration of each listener. The log, the
+// connection limits and the quarantine are shared by all listeners.
+func (cfg *config) setupListeners(configString string, dataDir string) error {
+	listeners, err := cfg.Server.listenAddresses()
+	if err != nil {
+		return err
+	}
+	if len(cfg.Server.Listeners) == 0 {
+		listeners[0].cfg = cfg
+		cfg.listeners = listeners
+		return nil
+	}
+	for i := range listeners {
+		listenerConfig, err := loadConfig(configString, dataDir, &cfg.Server.Listeners[i])
+		if err != nil {
+			return err
+		}
+		listenerConfig.connectionLimiter = cfg.connectionLimiter
+		listenerConfig.quarantine = cfg.quarantine
+		listenerConfig.sinks = cfg.sinks
+		listeners[i].cfg = listenerConfig
+	}
+	cfg.listeners = listeners
+	return nil
+}
+
+// shareState hands the state that outlives a configuration on to its
+// replacement: the connection limiter counting the open connections, the
+// quarantine and the log sinks, which switch to the new configuration's sinks.
+// Listeners kept across the reload also keep the clients tracked by accept
+// after N attempts and, unless the configured uptime changed, their boot time.
+func (cfg *config) shareState(previous *config) {
+	if previous.sinks != nil {
+		previous.sinks.replace(cfg.sinks.take())
+		cfg.sinks = previous.sinks
+	}
+	cfg.connectionLimiter = previous.connectionLimiter
+	cfg.quarantine = previous.quarantine
+	for _, listener := range cfg.listeners {
+		listener.cfg.connectionLimiter = previous.connectionLimiter
+		listener.cfg.quarantine = previous.quarantine
+		listener.cfg.sinks = cfg.sinks
+		for _, previousListener := range previous.listeners {
+			if previousListener.name != listener.name {
+				continue
+			}
+			if listener.cfg.authAttempts != nil && previousListener.cfg.authAttempts != nil {
+				listener.cfg.authAttempts.state = previousListener.cfg.authAttempts.state
+			}
+			if listener.cfg.Persona.Uptime == previousListener.cfg.Persona.Uptime {
+				listener.cfg.bootTime = previousListener.cfg.bootTime
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestListeners(t *testing.T) {
+	keyFile, err := generateKey(t.TempDir(), ecdsa_key)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	routerKeyFile, err := generateKey(t.TempDir(), ed25519_key)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	cfgString := fmt.Sprintf(`
+server:
+  host_keys: [%v]
+  listeners:
+    - name: ubuntu
+      listen_address: 0.0.0.0:22
+      ssh_proto:
+        version: SSH-2.0-OpenSSH_8.2p1 Ubuntu-4ubuntu0.5
+    - listen_address: 0.0.0.0:2222
+      host_keys: [%v]
+      ssh_proto:
+        banner: Authorized access only
+      auth:
+        no_auth: true
+      persona:
+        hostname: router
+ssh_proto:
+  banner: Welcome
+`, keyFile, routerKeyFile)
+	cfg, err := getConfig(cfgString, t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to get config: %v", err)
+	}
+	if len(cfg.listeners) != 2 {
+		t.Fatalf("listeners=%v, want 2", cfg.listeners)
+	}
+
+	ubuntu, router := cfg.listeners[0], cfg.listeners[1]
+	if ubuntu.name != "ubuntu" || ubuntu.address != "0.0.0.0:22" || ubuntu.cfg.listenerName != "ubuntu" {
+		t.Errorf("ubuntu=%+v, want ubuntu on 0.0.0.0:22", ubuntu)
+	}
+	if router.name != "0.0.0.0:2222" || router.address != "0.0.0.0:2222" {
+		t.Errorf("router=%+v, want it named after its address", router)
+	}
+	if ubuntu.cfg.SSHProto.Version != "SSH-2.0-OpenSSH_8.2p1 Ubuntu-4ubuntu0.5" || ubuntu.cfg.SSHProto.Banner != "Welcome" {
+		t.Errorf("ubuntu SSHProto=%+v, want the version overridden and the banner inherited", ubuntu.cfg.SSHProto)
+	}
+	if router.cfg.SSHProto.Version != "SSH-2.0-sshesame" || router.cfg.SSHProto.Banner != "Authorized access only" {
+		t.Errorf("router SSHProto=%+v, want the version inherited and the banner overridden", router.cfg.SSHProto)
+	}
+	if ubuntu.cfg.Auth.NoAuth || !router.cfg.Auth.NoAuth || !router.cfg.Auth.PasswordAuth.Enabled {
+		t.Errorf("NoAuth=%v/%v, want only the router to skip authentication", ubuntu.cfg.Auth.NoAuth, router.cfg.Auth.NoAuth)
+	}
+	if ubuntu.cfg.Persona.Hostname != cfg.Persona.Hostname || router.cfg.Persona.Hostname != "router" {
+		t.Errorf("Hostname=%v/%v, want the router's overridden", ubuntu.cfg.Persona.Hostname, router.cfg.Persona.Hostname)
+	}
+	if len(ubuntu.cfg.parsedHostKeys) != 1 || ubuntu.cfg.parsedHostKeys[0].PublicKey().Type() != "ecdsa-sha2-nistp256" {
+		t.Errorf("ubuntu host keys=%v, want the top-level key", ubuntu.cfg.parsedHostKeys)
+	}
+	if len(router.cfg.parsedHostKeys) != 1 || router.cfg.parsedHostKeys[0].PublicKey().Type() != "ssh-ed25519" {
+		t.Errorf("router host keys=%v, want its own key", router.cfg.parsedHostKeys)
+	}
+	for _, listener := range cfg.listeners {
+		if listener.cfg.connectionLimiter != cfg.connectionLimiter || listener.cfg.quarantine != cfg.quarantine {
+			t.Errorf("listener %v does not share the connection limiter and quarantine", listener.name)
+		}
+	}
+
+	ubuntu.cfg.Logging.Timestamps = false
+	logBuffer := setupLogBuffer(t, ubuntu.cfg)
+	connContext{ConnMetadata: mockConnContext{}, cfg: ubuntu.cfg}.logEvent(connectionCloseLog{})
+	ubuntu.cfg.Logging.JSON = true
+	connContext{ConnMetadata: mockConnContext{}, cfg: ubuntu.cfg}.logEvent(connectionCloseLog{})
+	expectedLogs := `[127.0.0.1:1234] [listener ubuntu] connection closed
+{"source":"127.0.0.1:1234","listener":"ubuntu","event_type":"connection_close","event":{}}
+`
+	if logs := logBuffer.String(); logs != expectedLogs {
+		t.Errorf("logs=%v, want %v", logs, expectedLogs)
+	}
+}
+
+func TestListenersDefault(t *testing.T) {
+	cfg, err := getConfig("", t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to get config: %v", err)
+	}
+	if len(cfg.listeners) != 1 || cfg.listeners[0].address != "127.0.0.1:2022" || cfg.listeners[0].cfg != cfg {
+		t.Errorf("listeners=%+v, want the top-level listen address", cfg.listeners)
+	}
+}
+
+func TestListenersInvalid(t *testing.T) {
+	for _, cfgString := range []string{
+		`
+server:
+  listeners:
+    - name: ubuntu
+`,
+		`
+server:
+  listeners:
+    - name: ubuntu
+      listen_address: 0.0.0.0:22
+    - name: ubuntu
+      listen_address: 0.0.0.0:2222
+`,
+		`
+server:
+  listeners:
+    - listen_address: 0.0.0.0:22
+      ssh_proto:
+        unknown: true
+`,
+	} {
+		if _, err := getConfig(cfgString, t.TempDir()); err == nil {
+			t.Errorf("Expected an error for %v", cfgString)
+		}
+	}
+}
+
+func TestListenersShareState(t *testing.T) {
+	keyFile, err := generateKey(t.TempDir(), ecdsa_key)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	cfgString := fmt.Sprintf(`
+server:
+  host_keys: [%v]
+auth:
+  accept_after:
+    enabled: true
+persona:
+  uptime: 1h
+`, keyFile)
+	previous, err := getConfig(cfgString, t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to get config: %v", err)
+	}
+	previous.authAttempts.attempt(authRequest{Method: "password", User: "root", ClientIP: net.ParseIP("192.0.2.1")})
+	cfg, err := getConfig(cfgString, t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to get config: %v", err)
+	}
+	cfg.shareState(previous)
+	if cfg.authAttempts.state != previous.authAttempts.state {
+		t.Errorf("authAttempts.state not carried over")
+	}
+	if !cfg.bootTime.Equal(previous.bootTime) {
+		t.Errorf("bootTime=%v, want %v", cfg.bootTime, previous.bootTime)
+	}
+
+	changed, err := getConfig(strings.Replace(cfgString, "1h", "2h", 1), t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to get config: %v", err)
+	}
+	changed.shareState(cfg)
+	if changed.bootTime.Equal(cfg.bootTime) {
+		t.Errorf("bootTime=%v, want it reset after the uptime changed", changed.bootTime)
+	}
+}
@@ -3,9 +3,10 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"strings"
 	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 type logEntry interface {
@@ -50,12 +51,40 @@ func (entry passwordAuthLog) eventType() string {
 	return "password_auth"
 }
 
+// certificateLog describes an OpenSSH certificate offered for public key
+// authentication. Validity bounds are Unix times as stored in the
+// certificate.
+type certificateLog struct {
+	CAFingerprint  string   `json:"ca_fingerprint"`
+	KeyFingerprint string   `json:"key_fingerprint"`
+	Principals     []string `json:"principals"`
+	Serial         uint64   `json:"serial"`
+	KeyID          string   `json:"key_id"`
+	ValidAfter     uint64   `json:"valid_after"`
+	ValidBefore    uint64   `json:"valid_before"`
+}
+
+func formatCertTime(value uint64) string {
+	if value == ssh.CertTimeInfinity {
+		return "forever"
+	}
+	return time.Unix(int64(value), 0).UTC().Format(time.RFC3339)
+}
+
 type publicKeyAuthLog struct {
 	authLog
-	PublicKeyFingerprint string `json:"public_key"`
+	PublicKeyFingerprint string          `json:"public_key"`
+	KeyType              string          `json:"key_type"`
+	KeyBits              int             `json:"key_bits"`
+	KeyBlob              string          `json:"key_blob"`
+	Certificate          *certificateLog `json:"certificate,omitempty"`
 }
 
 func (entry publicKeyAuthLog) String() string {
+	if entry.Certificate != nil {
+		cert := entry.Certificate
+		return fmt.Sprintf("authentication for user %q with certificate %q (key ID %q, serial %v, principals %q, valid from %v to %v) signed by CA %q %v", entry.User, cert.KeyFingerprint, cert.KeyID, cert.Serial, cert.Principals, formatCertTime(cert.ValidAfter), formatCertTime(cert.ValidBefore), cert.CAFingerprint, entry.Accepted)
+	}
 	return fmt.Sprintf("authentication for user %q with public key %q %v", entry.User, entry.PublicKeyFingerprint, entry.Accepted)
 }
 func (entry publicKeyAuthLog) eventType() string {
@@ -65,26 +94,112 @@ func (entry publicKeyAuthLog) eventType() string {
 type keyboardInteractiveAuthLog struct {
 	authLog
 	Answers []string `json:"answers"`
+	Round   int      `json:"round,omitempty"`
 }
 
 func (entry keyboardInteractiveAuthLog) String() string {
+	if entry.Round > 0 {
+		return fmt.Sprintf("authentication for user %q with keyboard interactive answers %q in round %v %v", entry.User, entry.Answers, entry.Round, entry.Accepted)
+	}
 	return fmt.Sprintf("authentication for user %q with keyboard interactive answers %q %v", entry.User, entry.Answers, entry.Accepted)
 }
 func (entry keyboardInteractiveAuthLog) eventType() string {
 	return "keyboard_interactive_auth"
 }
 
+// authAttempt is one entry of a connection's authentication timeline.
+type authAttempt struct {
+	Index     int          `json:"index"`
+	Method    string       `json:"method"`
+	User      string       `json:"user"`
+	ElapsedMS int64        `json:"elapsed_ms"`
+	Accepted  authAccepted `json:"accepted"`
+}
+
+type authSummaryLog struct {
+	Attempts []authAttempt `json:"attempts"`
+	Methods  []string      `json:"methods"`
+	Accepted authAccepted  `json:"accepted"`
+}
+
+func (entry authSummaryLog) String() string {
+	return fmt.Sprintf("authentication finished after %v attempts with methods %q %v", len(entry.Attempts), entry.Methods, entry.Accepted)
+}
+func (entry authSummaryLog) eventType() string {
+	return "auth_summary"
+}
+
 type connectionLog struct {
-	ClientVersion string `json:"client_version"`
+	ClientVersion   string   `json:"client_version"`
+	HASSH           string   `json:"hassh,omitempty"`
+	HASSHAlgorithms string   `json:"hassh_algorithms,omitempty"`
+	HASSHServer     string   `json:"hassh_server,omitempty"`
+	ClientKexInit   *kexInit `json:"client_kex_init,omitempty"`
 }
 
 func (entry connectionLog) String() string {
+	if entry.HASSH != "" {
+		return fmt.Sprintf("connection with client version %q and HASSH %v established", entry.ClientVersion, entry.HASSH)
+	}
 	return fmt.Sprintf("connection with client version %q established", entry.ClientVersion)
 }
 func (entry connectionLog) eventType() string {
 	return "connection"
 }
 
+type handshakeLog struct {
+	Kex                       string `json:"kex"`
+	HostKey                   string `json:"host_key"`
+	CipherClientToServer      string `json:"cipher_client_to_server"`
+	CipherServerToClient      string `json:"cipher_server_to_client"`
+	MACClientToServer         string `json:"mac_client_to_server"`
+	MACServerToClient         string `json:"mac_server_to_client"`
+	CompressionClientToServer string `json:"compression_client_to_server"`
+	CompressionServerToClient string `json:"compression_server_to_client"`
+}
+
+func (entry handshakeLog) String() string {
+	// AEAD ciphers have no separate MAC, which OpenSSH shows as implicit.
+	macClientToServer, macServerToClient := entry.MACClientToServer, entry.MACServerToClient
+	if macClientToServer == "" {
+		macClientToServer = "<implicit>"
+	}
+	if macServerToClient == "" {
+		macServerToClient = "<implicit>"
+	}
+	return fmt.Sprintf("handshake negotiated kex %v and host key %v, client to server %v/%v/%v, server to client %v/%v/%v",
+		entry.Kex, entry.HostKey,
+		entry.CipherClientToServer, macClientToServer, entry.CompressionClientToServer,
+		entry.CipherServerToClient, macServerToClient, entry.CompressionServerToClient)
+}
+func (entry handshakeLog) eventType() string {
+	return "handshake"
+}
+
+type handshakeFailedLog struct {
+	ClientVersion string `json:"client_version"`
+	HASSH         string `json:"hassh,omitempty"`
+	Error         string `json:"error"`
+}
+
+func (entry handshakeFailedLog) String() string {
+	return fmt.Sprintf("handshake with client version %q failed: %v", entry.ClientVersion, entry.Error)
+}
+func (entry handshakeFailedLog) eventType() string {
+	return "handshake_failed"
+}
+
+type connectionRejectedLog struct {
+	Reason string `json:"reason"`
+}
+
+func (entry connectionRejectedLog) String() string {
+	return fmt.Sprintf("connection rejected: %v", entry.Reason)
+}
+func (entry connectionRejectedLog) eventType() string {
+	return "connection_rejected"
+}
+
 type connectionCloseLog struct {
 }
 
@@ -165,6 +280,242 @@ func (entry sessionInputLog) eventType() string {
 	return "session_input"
 }
 
+type sessionCommandLog struct {
+	channelLog
+	Command string    `json:"command"`
+	Tree    shellList `json:"tree"`
+}
+
+func (entry sessionCommandLog) String() string {
+	return fmt.Sprintf("[channel %v] shell command %q parsed as %v", entry.ChannelID, entry.Command, entry.Tree)
+}
+func (entry sessionCommandLog) eventType() string {
+	return "session_command"
+}
+
+type downloadAttemptLog struct {
+	channelLog
+	Tool   string `json:"tool"`
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Output string `json:"output"`
+}
+
+func (entry downloadAttemptLog) String() string {
+	return fmt.Sprintf("[channel %v] %v download attempt: %v %v to %v", entry.ChannelID, entry.Tool, entry.Method, entry.URL, entry.Output)
+}
+func (entry downloadAttemptLog) eventType() string {
+	return "download_attempt"
+}
+
+type sftpOpenLog struct {
+	channelLog
+	Path  string `json:"path"`
+	Flags string `json:"flags"`
+}
+
+func (entry sftpOpenLog) String() string {
+	return fmt.Sprintf("[channel %v] SFTP open of %v (%v)", entry.ChannelID, entry.Path, entry.Flags)
+}
+func (entry sftpOpenLog) eventType() string {
+	return "sftp_open"
+}
+
+type sftpReadLog struct {
+	channelLog
+	Path string `json:"path"`
+	Size int    `json:"size"`
+}
+
+func (entry sftpReadLog) String() string {
+	return fmt.Sprintf("[channel %v] SFTP read of %v (%v bytes)", entry.ChannelID, entry.Path, entry.Size)
+}
+func (entry sftpReadLog) eventType() string {
+	return "sftp_read"
+}
+
+type sftpWriteLog struct {
+	channelLog
+	Path   string `json:"path"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func (entry sftpWriteLog) String() string {
+	return fmt.Sprintf("[channel %v] SFTP write of %v (%v bytes, SHA-256 %v)", entry.ChannelID, entry.Path, entry.Size, entry.SHA256)
+}
+func (entry sftpWriteLog) eventType() string {
+	return "sftp_write"
+}
+
+type sftpStatLog struct {
+	channelLog
+	Path string `json:"path"`
+}
+
+func (entry sftpStatLog) String() string {
+	return fmt.Sprintf("[channel %v] SFTP stat of %v", entry.ChannelID, entry.Path)
+}
+func (entry sftpStatLog) eventType() string {
+	return "sftp_stat"
+}
+
+type sftpSetstatLog struct {
+	channelLog
+	Path string `json:"path"`
+}
+
+func (entry sftpSetstatLog) String() string {
+	return fmt.Sprintf("[channel %v] SFTP attribute change of %v", entry.ChannelID, entry.Path)
+}
+func (entry sftpSetstatLog) eventType() string {
+	return "sftp_setstat"
+}
+
+type sftpOpendirLog struct {
+	channelLog
+	Path string `json:"path"`
+}
+
+func (entry sftpOpendirLog) String() string {
+	return fmt.Sprintf("[channel %v] SFTP listing of %v", entry.ChannelID, entry.Path)
+}
+func (entry sftpOpendirLog) eventType() string {
+	return "sftp_opendir"
+}
+
+type sftpRemoveLog struct {
+	channelLog
+	Path string `json:"path"`
+}
+
+func (entry sftpRemoveLog) String() string {
+	return fmt.Sprintf("[channel %v] SFTP removal of %v", entry.ChannelID, entry.Path)
+}
+func (entry sftpRemoveLog) eventType() string {
+	return "sftp_remove"
+}
+
+type sftpMkdirLog struct {
+	channelLog
+	Path string `json:"path"`
+}
+
+func (entry sftpMkdirLog) String() string {
+	return fmt.Sprintf("[channel %v] SFTP directory creation of %v", entry.ChannelID, entry.Path)
+}
+func (entry sftpMkdirLog) eventType() string {
+	return "sftp_mkdir"
+}
+
+type sftpRmdirLog struct {
+	channelLog
+	Path string `json:"path"`
+}
+
+func (entry sftpRmdirLog) String() string {
+	return fmt.Sprintf("[channel %v] SFTP directory removal of %v", entry.ChannelID, entry.Path)
+}
+func (entry sftpRmdirLog) eventType() string {
+	return "sftp_rmdir"
+}
+
+type sftpRenameLog struct {
+	channelLog
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func (entry sftpRenameLog) String() string {
+	return fmt.Sprintf("[channel %v] SFTP rename of %v to %v", entry.ChannelID, entry.From, entry.To)
+}
+func (entry sftpRenameLog) eventType() string {
+	return "sftp_rename"
+}
+
+type sftpSymlinkLog struct {
+	channelLog
+	Target string `json:"target"`
+	Path   string `json:"path"`
+}
+
+func (entry sftpSymlinkLog) String() string {
+	return fmt.Sprintf("[channel %v] SFTP symlink from %v to %v", entry.ChannelID, entry.Path, entry.Target)
+}
+func (entry sftpSymlinkLog) eventType() string {
+	return "sftp_symlink"
+}
+
+type fileUploadLog struct {
+	channelLog
+	Tool   string `json:"tool"`
+	Path   string `json:"path"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func (entry fileUploadLog) String() string {
+	return fmt.Sprintf("[channel %v] %v upload of %v (%v bytes, SHA-256 %v)", entry.ChannelID, entry.Tool, entry.Path, entry.Size, entry.SHA256)
+}
+func (entry fileUploadLog) eventType() string {
+	return "file_upload"
+}
+
+type fileCaptureLog struct {
+	channelLog
+	Tool   string `json:"tool"`
+	Path   string `json:"path"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+	SHA1   string `json:"sha1"`
+	MD5    string `json:"md5"`
+}
+
+func (entry fileCaptureLog) String() string {
+	return fmt.Sprintf("[channel %v] captured %v bytes written to %v by %v (SHA-256 %v)", entry.ChannelID, entry.Size, entry.Path, entry.Tool, entry.SHA256)
+}
+func (entry fileCaptureLog) eventType() string {
+	return "file_capture"
+}
+
+type fileDownloadLog struct {
+	channelLog
+	Tool string `json:"tool"`
+	Path string `json:"path"`
+}
+
+func (entry fileDownloadLog) String() string {
+	return fmt.Sprintf("[channel %v] %v download of %v", entry.ChannelID, entry.Tool, entry.Path)
+}
+func (entry fileDownloadLog) eventType() string {
+	return "file_download"
+}
+
+type sessionRecordingLog struct {
+	channelLog
+	File string `json:"file"`
+}
+
+func (entry sessionRecordingLog) String() string {
+	return fmt.Sprintf("[channel %v] recording session to %v", entry.ChannelID, entry.File)
+}
+func (entry sessionRecordingLog) eventType() string {
+	return "session_recording"
+}
+
+type sessionRecordingLimitLog struct {
+	channelLog
+	File string `json:"file"`
+	Size int    `json:"size"`
+}
+
+func (entry sessionRecordingLimitLog) String() string {
+	return fmt.Sprintf("[channel %v] recording to %v stopped at its size limit after %v bytes", entry.ChannelID, entry.File, entry.Size)
+}
+func (entry sessionRecordingLimitLog) eventType() string {
+	return "session_recording_limit"
+}
+
 type directTCPIPLog struct {
 	channelLog
 	From string `json:"from"`
@@ -347,29 +698,9 @@ func (context connContext) logEvent(entry logEntry) {
 	if strings.HasPrefix(entry.eventType(), "debug_") && !context.cfg.Logging.Debug {
 		return
 	}
-	if context.cfg.Logging.JSON {
-		var jsonEntry interface{}
-		if context.cfg.Logging.Timestamps {
-			jsonEntry = struct {
-				Time      string   `json:"time"`
-				Source    string   `json:"source"`
-				EventType string   `json:"event_type"`
-				Event     logEntry `json:"event"`
-			}{time.Now().Format(time.RFC3339), context.RemoteAddr().String(), entry.eventType(), entry}
-		} else {
-			jsonEntry = struct {
-				Source    string   `json:"source"`
-				EventType string   `json:"event_type"`
-				Event     logEntry `json:"event"`
-			}{context.RemoteAddr().String(), entry.eventType(), entry}
-		}
-		logBytes, err := json.Marshal(jsonEntry)
-		if err != nil {
-			warningLogger.Printf("Failed to log event: %v", err)
-			return
-		}
-		log.Print(string(logBytes))
-	} else {
-		log.Printf("[%v] %v", context.RemoteAddr().String(), entry)
+	event := context.newLoggedEvent(entry)
+	if err := (standardSink{json: context.cfg.Logging.JSON, timestamps: context.cfg.Logging.Timestamps}).write(event); err != nil {
+		warningLogger.Printf("Failed to log event: %v", err)
 	}
+	context.cfg.sinks.write(event)
 }
@@ -4,9 +4,12 @@ import (
 	"flag"
 	"io/ioutil"
 	"log"
-	"net"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/adrg/xdg"
 )
@@ -24,38 +27,128 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplay(os.Args[2:]); err != nil {
+			errorLogger.Fatalf("Failed to replay session: %v", err)
+		}
+		return
+	}
+
 	configFile := flag.String("config", "", "config file")
 	dataDir := flag.String("data_dir", path.Join(xdg.DataHome, "sshesame"), "data directory")
 	flag.Parse()
 
-	configString := ""
-	if *configFile != "" {
-		configBytes, err := ioutil.ReadFile(*configFile)
-		if err != nil {
-			errorLogger.Fatalf("Failed to read config file: %v", err)
+	configString, err := readConfigFile(*configFile)
+	if err != nil {
+		errorLogger.Fatalf("Failed to read config file: %v", err)
+	}
+	serverCfg, err := parseConfig(configString)
+	if err != nil {
+		errorLogger.Fatalf("Failed to get config: %v", err)
+	}
+
+	sockets, err := inheritListeners(listenFDsStart)
+	if err != nil {
+		errorLogger.Fatalf("Failed to inherit sockets: %v", err)
+	}
+	listeners, err := listen(&serverCfg.Server, sockets)
+	if err != nil {
+		errorLogger.Fatalf("Failed to listen for connections: %v", err)
+	}
+
+	// Listeners are bound, so root is no longer needed.
+	rootDataDir := *dataDir
+	if *dataDir, err = dropPrivileges(serverCfg.Server, *dataDir); err != nil {
+		errorLogger.Fatalf("Failed to drop privileges: %v", err)
+	}
+	if serverCfg.Server.Chroot && *configFile != "" {
+		if chrootedConfigFile := chrootPath(rootDataDir, *configFile); chrootedConfigFile != "" {
+			*configFile = chrootedConfigFile
+		} else {
+			warningLogger.Printf("Config file is outside of the chroot, reloading will fail")
 		}
-		configString = string(configBytes)
+		warnChrootLogging(serverCfg.Logging)
 	}
 
 	cfg, err := getConfig(configString, *dataDir)
 	if err != nil {
 		errorLogger.Fatalf("Failed to get config: %v", err)
 	}
+	cfg.applyLogging()
 
-	listener, err := net.Listen("tcp", cfg.Server.ListenAddress)
+	srv, err := newServer(cfg, listeners)
 	if err != nil {
-		errorLogger.Fatalf("Failed to listen for connections: %v", err)
+		errorLogger.Fatalf("Failed to start server: %v", err)
 	}
-	defer listener.Close()
-
-	infoLogger.Printf("Listening on %v", listener.Addr())
+	go srv.serve()
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			warningLogger.Printf("Failed to accept connection: %v", err)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			cfg, err := readConfig(*configFile, *dataDir)
+			if err != nil {
+				warningLogger.Printf("Failed to reload config: %v", err)
+				continue
+			}
+			srv.reload(cfg)
 			continue
 		}
-		go handleConnection(conn, cfg)
+		infoLogger.Printf("Received %v, shutting down", sig)
+		srv.shutdown()
+		return
+	}
+}
+
+func readConfigFile(configFile string) (string, error) {
+	if configFile == "" {
+		return "", nil
+	}
+	configBytes, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return "", err
+	}
+	return string(configBytes), nil
+}
+
+func readConfig(configFile string, dataDir string) (*config, error) {
+	configString, err := readConfigFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return getConfig(configString, dataDir)
+}
+
+// warnChrootLogging warns about log destinations that cannot be opened from
+// inside the chroot, as the config is only loaded after chrooting.
+func warnChrootLogging(loggingCfg loggingConfig) {
+	if filepath.IsAbs(loggingCfg.File) {
+		warningLogger.Printf("Log file %q is resolved inside the chroot", loggingCfg.File)
+	}
+	for i, sinkCfg := range loggingCfg.Sinks {
+		switch {
+		case sinkCfg.Type == "file" && filepath.IsAbs(sinkCfg.Path):
+			warningLogger.Printf("Log sink %v file %q is resolved inside the chroot", i, sinkCfg.Path)
+		case sinkCfg.Type == "syslog" && sinkCfg.Network == "":
+			warningLogger.Printf("Log sink %v uses the local syslog socket, which is outside of the chroot", i)
+		}
+	}
+}
+
+// chrootPath returns where a file is found after chrooting into dir, or an
+// empty string if it is outside of it.
+func chrootPath(dir string, file string) string {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return ""
+	}
+	relative, err := filepath.Rel(absDir, absFile)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, "../") {
+		return ""
 	}
+	return filepath.Join("/", relative)
 }
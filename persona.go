@@ -0,0 +1,565 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+type personaConfig struct {
+	Hostname        string        `yaml:"hostname"`
+	KernelName      string        `yaml:"kernel_name"`
+	KernelRelease   string        `yaml:"kernel_release"`
+	KernelVersion   string        `yaml:"kernel_version"`
+	Machine         string        `yaml:"machine"`
+	OperatingSystem string        `yaml:"operating_system"`
+	CPUModel        string        `yaml:"cpu_model"`
+	CPUMHz          float64       `yaml:"cpu_mhz"`
+	CPUs            int           `yaml:"cpus"`
+	MemoryMB        int           `yaml:"memory_mb"`
+	Uptime          time.Duration `yaml:"uptime"`
+	Processes       []string      `yaml:"processes"`
+}
+
+var defaultProcesses = []string{
+	"/sbin/init",
+	"[kthreadd]",
+	"[rcu_gp]",
+	"[kworker/0:0H-kblockd]",
+	"[ksoftirqd/0]",
+	"[migration/0]",
+	"/lib/systemd/systemd-journald",
+	"/lib/systemd/systemd-udevd",
+	"/lib/systemd/systemd-networkd",
+	"/lib/systemd/systemd-resolved",
+	"/usr/sbin/cron -f",
+	"/usr/bin/dbus-daemon --system --address=systemd: --nofork --nopidfile --systemd-activation --syslog-only",
+	"/usr/sbin/rsyslogd -n -iNONE",
+	"/lib/systemd/systemd-logind",
+	"/sbin/agetty -o -p -- \\u --noclear tty1 linux",
+	"sshd: /usr/sbin/sshd -D [listener] 0 of 10-100 startups",
+}
+
+func getDefaultPersona() personaConfig {
+	return personaConfig{
+		Hostname:        "ubuntu",
+		KernelName:      "Linux",
+		KernelRelease:   "5.4.0-73-generic",
+		KernelVersion:   "#82-Ubuntu SMP Wed Apr 14 17:39:42 UTC 2021",
+		Machine:         "x86_64",
+		OperatingSystem: "GNU/Linux",
+		CPUModel:        "Intel(R) Xeon(R) CPU E5-2680 v4 @ 2.40GHz",
+		CPUMHz:          2399.998,
+		CPUs:            2,
+		MemoryMB:        3936,
+		Uptime:          38*24*time.Hour + 5*time.Hour + 17*time.Minute,
+		Processes:       defaultProcesses,
+	}
+}
+
+// persona returns the machine persona commands should impersonate, falling
+// back to the defaults for contexts created without a config.
+func (context commandContext) persona() personaConfig {
+	if context.cfg == nil {
+		return getDefaultPersona()
+	}
+	return context.cfg.Persona
+}
+
+func (context commandContext) bootTime() time.Time {
+	if context.cfg == nil || context.cfg.bootTime.IsZero() {
+		return time.Now().Add(-getDefaultPersona().Uptime)
+	}
+	return context.cfg.bootTime
+}
+
+func (persona personaConfig) procVersion() string {
+	return fmt.Sprintf("%v version %v (buildd@lcy01-amd64-029) (gcc version 9.3.0 (Ubuntu 9.3.0-17ubuntu1~20.04)) %v\n", persona.KernelName, persona.KernelRelease, persona.KernelVersion)
+}
+
+func (persona personaConfig) procCPUInfo() string {
+	var result strings.Builder
+	for cpu := 0; cpu < persona.CPUs; cpu++ {
+		fmt.Fprintf(&result, `processor	: %v
+vendor_id	: GenuineIntel
+cpu family	: 6
+model		: 79
+model name	: %v
+stepping	: 1
+microcode	: 0xb000038
+cpu MHz		: %.3f
+cache size	: 35840 KB
+physical id	: 0
+siblings	: %v
+core id		: %v
+cpu cores	: %v
+apicid		: %v
+initial apicid	: %v
+fpu		: yes
+fpu_exception	: yes
+cpuid level	: 13
+wp		: yes
+flags		: fpu vme de pse tsc msr pae mce cx8 apic sep mtrr pge mca cmov pat pse36 clflush mmx fxsr sse sse2 ss ht syscall nx pdpe1gb rdtscp lm constant_tsc rep_good nopl xtopology cpuid pni pclmulqdq ssse3 fma cx16 pcid sse4_1 sse4_2 x2apic movbe popcnt aes xsave avx f16c rdrand hypervisor lahf_lm abm 3dnowprefetch invpcid_single pti fsgsbase bmi1 hle avx2 smep bmi2 erms invpcid rtm rdseed adx smap xsaveopt arat
+bugs		: cpu_meltdown spectre_v1 spectre_v2 spec_store_bypass l1tf mds swapgs taa itlb_multihit
+bogomips	: %.2f
+clflush size	: 64
+cache_alignment	: 64
+address sizes	: 46 bits physical, 48 bits virtual
+power management:
+
+`, cpu, persona.CPUModel, persona.CPUMHz, persona.CPUs, cpu, persona.CPUs, cpu, cpu, persona.CPUMHz*2)
+	}
+	return result.String()
+}
+
+type memoryUsage struct {
+	total, used, free, shared, buffers, cached, available, swapTotal, swapUsed int
+}
+
+// memoryUsage returns plausible memory statistics in kibibytes.
+func (persona personaConfig) memoryUsage() memoryUsage {
+	total := persona.MemoryMB * 1024
+	usage := memoryUsage{
+		total:     total,
+		used:      total * 23 / 100,
+		shared:    total / 300,
+		buffers:   total * 3 / 100,
+		cached:    total * 41 / 100,
+		swapTotal: 2 * 1024 * 1024,
+		swapUsed:  1792,
+	}
+	usage.free = total - usage.used - usage.buffers - usage.cached
+	usage.available = total - usage.used
+	return usage
+}
+
+func (persona personaConfig) procMemInfo() string {
+	usage := persona.memoryUsage()
+	return fmt.Sprintf(`MemTotal:       %8d kB
+MemFree:        %8d kB
+MemAvailable:   %8d kB
+Buffers:        %8d kB
+Cached:         %8d kB
+SwapCached:     %8d kB
+Shmem:          %8d kB
+SwapTotal:      %8d kB
+SwapFree:       %8d kB
+`, usage.total, usage.free, usage.available, usage.buffers, usage.cached, 0, usage.shared, usage.swapTotal, usage.swapTotal-usage.swapUsed)
+}
+
+// addPersonaFiles writes the files whose content is derived from the persona
+// into a filesystem, overriding those from the image.
+func (persona personaConfig) addPersonaFiles(filesystem *virtualFilesystem, bootTime time.Time) error {
+	uptime := time.Since(bootTime).Seconds()
+	files := map[string]string{
+		"/etc/hostname":             persona.Hostname + "\n",
+		"/proc/version":             persona.procVersion(),
+		"/proc/cpuinfo":             persona.procCPUInfo(),
+		"/proc/meminfo":             persona.procMemInfo(),
+		"/proc/uptime":              fmt.Sprintf("%.2f %.2f\n", uptime, uptime*float64(persona.CPUs)*0.97),
+		"/proc/loadavg":             "0.00 0.01 0.05 1/123 4242\n",
+		"/proc/sys/kernel/hostname": persona.Hostname + "\n",
+	}
+	for name, content := range files {
+		if err := filesystem.mkdirAll(path.Dir(name), 0555); err != nil {
+			return err
+		}
+		if err := filesystem.writeFile(name, []byte(content), 0444); err != nil {
+			return err
+		}
+		if err := filesystem.chtimes(name, bootTime); err != nil {
+			return err
+		}
+	}
+	return filesystem.chmod("/etc/hostname", 0644)
+}
+
+type cmdUname struct{}
+
+func (cmdUname) execute(context commandContext) (uint32, error) {
+	persona := context.persona()
+	fields := []struct {
+		flag  rune
+		value string
+	}{
+		{'s', persona.KernelName},
+		{'n', persona.Hostname},
+		{'r', persona.KernelRelease},
+		{'v', persona.KernelVersion},
+		{'m', persona.Machine},
+		{'p', persona.Machine},
+		{'i', persona.Machine},
+		{'o', persona.OperatingSystem},
+	}
+	longFlags := map[string]rune{
+		"--kernel-name": 's', "--nodename": 'n', "--kernel-release": 'r', "--kernel-version": 'v',
+		"--machine": 'm', "--processor": 'p', "--hardware-platform": 'i', "--operating-system": 'o', "--all": 'a',
+	}
+	selected := map[rune]bool{}
+	for _, arg := range context.args[1:] {
+		if flag, ok := longFlags[arg]; ok {
+			selected[flag] = true
+			continue
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			_, err := fmt.Fprintf(context.stderr, "uname: extra operand '%v'\nTry 'uname --help' for more information.\n", arg)
+			return 1, err
+		}
+		for _, flag := range arg[1:] {
+			if !strings.ContainsRune("asnrvmpio", flag) {
+				_, err := fmt.Fprintf(context.stderr, "uname: invalid option -- '%c'\nTry 'uname --help' for more information.\n", flag)
+				return 1, err
+			}
+			selected[flag] = true
+		}
+	}
+	if len(selected) == 0 {
+		selected['s'] = true
+	}
+	var values []string
+	for _, field := range fields {
+		if selected[field.flag] || selected['a'] {
+			values = append(values, field.value)
+		}
+	}
+	_, err := fmt.Fprintln(context.stdout, strings.Join(values, " "))
+	return 0, err
+}
+
+type cmdHostname struct{}
+
+func (cmdHostname) execute(context commandContext) (uint32, error) {
+	if len(context.args) > 1 && !strings.HasPrefix(context.args[1], "-") {
+		_, err := fmt.Fprintln(context.stderr, "hostname: you must be root to change the host name")
+		return 1, err
+	}
+	_, err := fmt.Fprintln(context.stdout, context.persona().Hostname)
+	return 0, err
+}
+
+type cmdNproc struct{}
+
+func (cmdNproc) execute(context commandContext) (uint32, error) {
+	_, err := fmt.Fprintln(context.stdout, context.persona().CPUs)
+	return 0, err
+}
+
+type cmdFree struct{}
+
+func (cmdFree) execute(context commandContext) (uint32, error) {
+	unit := 1
+	for _, arg := range context.args[1:] {
+		switch arg {
+		case "-m", "--mebi":
+			unit = 1024
+		case "-g", "--gibi":
+			unit = 1024 * 1024
+		case "-k", "--kibi":
+			unit = 1
+		case "-h", "--human":
+			unit = 1024
+		}
+	}
+	usage := context.persona().memoryUsage()
+	_, err := fmt.Fprintf(context.stdout, `              total        used        free      shared  buff/cache   available
+Mem:    %11d %11d %11d %11d %11d %11d
+Swap:   %11d %11d %11d
+`, usage.total/unit, usage.used/unit, usage.free/unit, usage.shared/unit, (usage.buffers+usage.cached)/unit, usage.available/unit,
+		usage.swapTotal/unit, usage.swapUsed/unit, (usage.swapTotal-usage.swapUsed)/unit)
+	return 0, err
+}
+
+func formatUptime(uptime time.Duration) string {
+	days := int(uptime.Hours()) / 24
+	hours := int(uptime.Hours()) % 24
+	minutes := int(uptime.Minutes()) % 60
+	result := ""
+	if days == 1 {
+		result = "1 day, "
+	} else if days > 1 {
+		result = fmt.Sprintf("%v days, ", days)
+	}
+	if hours == 0 {
+		return fmt.Sprintf("%v%v min", result, minutes)
+	}
+	return fmt.Sprintf("%v%2d:%02d", result, hours, minutes)
+}
+
+func (context commandContext) uptimeLine() string {
+	now := time.Now()
+	return fmt.Sprintf(" %v up %v,  1 user,  load average: 0.00, 0.01, 0.05", now.Format("15:04:05"), formatUptime(now.Sub(context.bootTime())))
+}
+
+type cmdUptime struct{}
+
+func (cmdUptime) execute(context commandContext) (uint32, error) {
+	if len(context.args) > 1 && (context.args[1] == "-p" || context.args[1] == "--pretty") {
+		_, err := fmt.Fprintf(context.stdout, "up %v\n", formatUptime(time.Since(context.bootTime())))
+		return 0, err
+	}
+	if len(context.args) > 1 && (context.args[1] == "-s" || context.args[1] == "--since") {
+		_, err := fmt.Fprintln(context.stdout, context.bootTime().Format("2006-01-02 15:04:05"))
+		return 0, err
+	}
+	_, err := fmt.Fprintln(context.stdout, context.uptimeLine())
+	return 0, err
+}
+
+func (context commandContext) clientHost() string {
+	fields := strings.Fields(context.env.get("SSH_CLIENT"))
+	if len(fields) == 0 {
+		return "-"
+	}
+	return fields[0]
+}
+
+func (context commandContext) tty() string {
+	if tty := context.env.get("SSH_TTY"); tty != "" {
+		return strings.TrimPrefix(tty, "/dev/")
+	}
+	return "?"
+}
+
+type cmdW struct{}
+
+func (cmdW) execute(context commandContext) (uint32, error) {
+	name, _, _ := context.user()
+	host := context.clientHost()
+	if ip := net.ParseIP(host); ip == nil {
+		host = "-"
+	}
+	loginTime := context.env.started.Format("15:04")
+	_, err := fmt.Fprintf(context.stdout, `%v
+USER     TTY      FROM             LOGIN@   IDLE   JCPU   PCPU WHAT
+%-8.8v %-8.8v %-16.16v %-7v  0.00s  0.02s  0.00s w
+`, context.uptimeLine(), name, context.tty(), host, loginTime)
+	return 0, err
+}
+
+type process struct {
+	pid      int
+	user     string
+	tty      string
+	start    time.Time
+	cpuTime  string
+	vsz, rss int
+	stat     string
+	command  string
+}
+
+func (context commandContext) processes() []process {
+	persona := context.persona()
+	bootTime := context.bootTime()
+	user, _, _ := context.user()
+	var result []process
+	pid := 1
+	for i, command := range persona.Processes {
+		stat := "Ss"
+		vsz, rss := 0, 0
+		if !strings.HasPrefix(command, "[") {
+			vsz, rss = 9000+(i*7919)%160000, 3000+(i*4271)%20000
+		} else {
+			stat = "I<"
+		}
+		result = append(result, process{pid, "root", "?", bootTime, "00:00:00", vsz, rss, stat, command})
+		pid += 1 + (i*37)%211
+	}
+	sessionPid := context.env.pid
+	if sessionPid <= pid {
+		sessionPid = pid + 1000
+	}
+	sshd := fmt.Sprintf("sshd: %v@%v", user, context.tty())
+	shell := "-bash"
+	result = append(result,
+		process{sessionPid - 2, "root", "?", context.env.started, "00:00:00", 13924, 8972, "Ss", fmt.Sprintf("sshd: %v [priv]", user)},
+		process{sessionPid - 1, user, "?", context.env.started, "00:00:00", 14056, 6044, "S", sshd},
+		process{sessionPid, user, context.tty(), context.env.started, "00:00:00", 8276, 5164, "Ss", shell},
+	)
+	return result
+}
+
+type cmdPs struct{}
+
+func (cmdPs) execute(context commandContext) (uint32, error) {
+	all, full, bsd := false, false, false
+	for _, arg := range context.args[1:] {
+		flags := strings.TrimPrefix(arg, "-")
+		if flags == arg {
+			bsd = true
+		}
+		if strings.ContainsAny(flags, "aAex") {
+			all = true
+		}
+		if strings.ContainsAny(flags, "fu") {
+			full = true
+		}
+	}
+	processes := context.processes()
+	ownPid := processes[len(processes)-1].pid + 7
+	processes = append(processes, process{ownPid, processes[len(processes)-1].user, context.tty(), time.Now(), "00:00:00", 10616, 3316, "R+", strings.Join(context.args, " ")})
+	if !all {
+		processes = processes[len(processes)-2:]
+	}
+	var output strings.Builder
+	switch {
+	case bsd && full:
+		fmt.Fprintln(&output, "USER         PID %CPU %MEM    VSZ   RSS TTY      STAT START   TIME COMMAND")
+		for _, p := range processes {
+			fmt.Fprintf(&output, "%-8.8v %7d  0.0  0.%d %6d %5d %-8.8v %-4v %5v   0:00 %v\n", p.user, p.pid, p.rss/10000, p.vsz, p.rss, p.tty, p.stat, p.start.Format("Jan02"), p.command)
+		}
+	case full:
+		fmt.Fprintln(&output, "UID          PID    PPID  C STIME TTY          TIME CMD")
+		for i, p := range processes {
+			ppid := 0
+			if i > 0 {
+				ppid = 1
+			}
+			fmt.Fprintf(&output, "%-8.8v %7d %7d  0 %v %-8.8v %8v %v\n", p.user, p.pid, ppid, p.start.Format("Jan02"), p.tty, p.cpuTime, p.command)
+		}
+	default:
+		fmt.Fprintln(&output, "    PID TTY          TIME CMD")
+		for _, p := range processes {
+			var command string
+			if fields := strings.Fields(strings.Trim(p.command, "[]")); len(fields) > 0 {
+				command = fields[0]
+			}
+			if strings.HasPrefix(command, "-") {
+				command = command[1:]
+			}
+			fmt.Fprintf(&output, "%7d %-8.8v %8v %v\n", p.pid, p.tty, p.cpuTime, strings.TrimSuffix(programName(command), ":"))
+		}
+	}
+	_, err := fmt.Fprint(context.stdout, output.String())
+	return 0, err
+}
+
+func programName(command string) string {
+	if i := strings.LastIndex(command, "/"); i >= 0 {
+		return command[i+1:]
+	}
+	return command
+}
+
+// lookupID returns the name of the entry with the given numeric ID in a
+// passwd or group style file of the virtual filesystem.
+func lookupID(filesystem *virtualFilesystem, file string, id uint32) string {
+	if filesystem != nil {
+		if content, err := filesystem.readFile(file); err == nil {
+			for _, line := range strings.Split(string(content), "\n") {
+				fields := strings.Split(line, ":")
+				if len(fields) > 2 && fields[2] == fmt.Sprint(id) {
+					return fields[0]
+				}
+			}
+		}
+	}
+	return fmt.Sprint(id)
+}
+
+// user returns the name, UID and GID of the logged in user, as looked up in
+// the /etc/passwd of the virtual filesystem.
+func (context commandContext) user() (string, uint32, uint32) {
+	name := context.env.get("USER")
+	if name == "" {
+		name = "root"
+	}
+	if context.filesystem != nil {
+		if content, err := context.filesystem.readFile("/etc/passwd"); err == nil {
+			for _, line := range strings.Split(string(content), "\n") {
+				fields := strings.Split(line, ":")
+				if len(fields) < 4 || fields[0] != name {
+					continue
+				}
+				var uid, gid uint32
+				if _, err := fmt.Sscan(fields[2], &uid); err != nil {
+					break
+				}
+				if _, err := fmt.Sscan(fields[3], &gid); err != nil {
+					break
+				}
+				return name, uid, gid
+			}
+		}
+	}
+	return name, 0, 0
+}
+
+// groups returns the supplementary groups the logged in user belongs to.
+func (context commandContext) groups(name string, gid uint32) []uint32 {
+	result := []uint32{gid}
+	if context.filesystem == nil {
+		return result
+	}
+	content, err := context.filesystem.readFile("/etc/group")
+	if err != nil {
+		return result
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 4 {
+			continue
+		}
+		for _, member := range strings.Split(fields[3], ",") {
+			var groupID uint32
+			if member == name {
+				if _, err := fmt.Sscan(fields[2], &groupID); err == nil && groupID != gid {
+					result = append(result, groupID)
+				}
+			}
+		}
+	}
+	sort.Slice(result[1:], func(i, j int) bool { return result[i+1] < result[j+1] })
+	return result
+}
+
+type cmdID struct{}
+
+func (cmdID) execute(context commandContext) (uint32, error) {
+	name, uid, gid := context.user()
+	groups := context.groups(name, gid)
+	var flags string
+	for _, arg := range context.args[1:] {
+		if strings.HasPrefix(arg, "-") {
+			flags += arg[1:]
+		}
+	}
+	names := strings.ContainsRune(flags, 'n')
+	format := func(file string, id uint32) string {
+		if names {
+			return lookupID(context.filesystem, file, id)
+		}
+		return fmt.Sprint(id)
+	}
+	var output string
+	switch {
+	case strings.ContainsRune(flags, 'u'):
+		output = format("/etc/passwd", uid)
+	case strings.ContainsRune(flags, 'g') && !strings.ContainsRune(flags, 'G'):
+		output = format("/etc/group", gid)
+	case strings.ContainsRune(flags, 'G'):
+		var values []string
+		for _, group := range groups {
+			values = append(values, format("/etc/group", group))
+		}
+		output = strings.Join(values, " ")
+	default:
+		var values []string
+		for _, group := range groups {
+			values = append(values, fmt.Sprintf("%v(%v)", group, lookupID(context.filesystem, "/etc/group", group)))
+		}
+		output = fmt.Sprintf("uid=%v(%v) gid=%v(%v) groups=%v", uid, name, gid, lookupID(context.filesystem, "/etc/group", gid), strings.Join(values, ","))
+	}
+	_, err := fmt.Fprintln(context.stdout, output)
+	return 0, err
+}
+
+type cmdWhoami struct{}
+
+func (cmdWhoami) execute(context commandContext) (uint32, error) {
+	name, _, _ := context.user()
+	_, err := fmt.Fprintln(context.stdout, name)
+	return 0, err
+}
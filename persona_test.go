@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPersonaCommands(t *testing.T) {
+	filesystem := defaultFilesystemImage.clone()
+	persona := getDefaultPersona()
+	persona.addPersonaFiles(filesystem, time.Now().Add(-persona.Uptime))
+	for _, test := range []struct {
+		command        string
+		status         uint32
+		stdout, stderr string
+	}{
+		{`uname -a`, 0, "Linux ubuntu 5.4.0-73-generic #82-Ubuntu SMP Wed Apr 14 17:39:42 UTC 2021 x86_64 x86_64 x86_64 GNU/Linux\n", ""},
+		{`uname -srm`, 0, "Linux 5.4.0-73-generic x86_64\n", ""},
+		{`/bin/hostname; nproc`, 0, "ubuntu\n2\n", ""},
+		{`id; whoami`, 0, "uid=0(root) gid=0(root) groups=0(root)\nroot\n", ""},
+		{`cd /etc; pwd; cd /nonexistent; cd -`, 0, "/etc\n/root\n", "sh: 1: cd: can't cd to /nonexistent\n"},
+		{`ls /root`, 0, "", ""},
+		{`ls -A /root /nonexistent`, 2, "/root:\n.bashrc\n.profile\n.ssh\n", "ls: cannot access '/nonexistent': No such file or directory\n"},
+		{`ls -ld /tmp /etc/shadow`, 0, "drwxrwxrwt 2 root root   4096 Apr 21  2021 /tmp\n-rw-r----- 1 root shadow  311 Apr 21  2021 /etc/shadow\n", ""},
+		{`which ls cd nosuchcommand`, 1, "/usr/bin/ls\n", ""},
+		{`export FOO="it's"; sh -c 'echo $FOO'`, 0, "it's\n", ""},
+		{`crontab -l`, 1, "", "no crontab for root\n"},
+		{`echo '* * * * * /tmp/x' | crontab -; crontab -l`, 0, "* * * * * /tmp/x\n", ""},
+		{`cat /proc/sys/kernel/hostname`, 0, "ubuntu\n", ""},
+	} {
+		status, stdout, stderr := runTestShell(t, filesystem, []string{"sh", "-c", test.command}, "")
+		if status != test.status {
+			t.Errorf("%q: status=%v, want %v", test.command, status, test.status)
+		}
+		if stdout != test.stdout {
+			t.Errorf("%q: stdout=%q, want %q", test.command, stdout, test.stdout)
+		}
+		if stderr != test.stderr {
+			t.Errorf("%q: stderr=%q, want %q", test.command, stderr, test.stderr)
+		}
+	}
+}
+
+func TestPsBlankProcesses(t *testing.T) {
+	cfg := &config{Persona: getDefaultPersona()}
+	cfg.Persona.Processes = []string{"", " ", "[]", "/sbin/init"}
+	stdout := &bytes.Buffer{}
+	status, err := executeProgram(commandContext{
+		args:       []string{"ps", "-e"},
+		stdin:      newReaderReadLiner(strings.NewReader("")),
+		stdout:     stdout,
+		stderr:     &bytes.Buffer{},
+		filesystem: defaultFilesystemImage.clone(),
+		env:        newShellEnvironment("/root", map[string]string{"HOME": "/root"}),
+		cfg:        cfg,
+	})
+	if err != nil {
+		t.Fatalf("Failed to execute program: %v", err)
+	}
+	if status != 0 {
+		t.Errorf("status=%v, want 0", status)
+	}
+	if !strings.Contains(stdout.String(), " init\n") {
+		t.Errorf("stdout=%q, want init listed", stdout)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestChrootPath(t *testing.T) {
+	for _, test := range []struct {
+		dir, file, expected string
+	}{
+		{"/var/lib/sshpot", "/var/lib/sshpot/sshpot.yaml", "/sshpot.yaml"},
+		{"/var/lib/sshpot/", "/var/lib/sshpot/etc/sshpot.yaml", "/etc/sshpot.yaml"},
+		{"/var/lib/sshpot", "/etc/sshpot.yaml", ""},
+		{"/var/lib/sshpot", "/var/lib/sshpot2/sshpot.yaml", ""},
+		{"/var/lib/sshpot", "/var/lib/..sshpot", ""},
+	} {
+		if result := chrootPath(test.dir, test.file); result != test.expected {
+			t.Errorf("chrootPath(%q, %q)=%q, want %q", test.dir, test.file, result, test.expected)
+		}
+	}
+}
+
+func TestDropPrivilegesDisabled(t *testing.T) {
+	dataDir, err := dropPrivileges(serverConfig{}, "/var/lib/sshpot")
+	if err != nil {
+		t.Fatalf("Failed to drop privileges: %v", err)
+	}
+	if dataDir != "/var/lib/sshpot" {
+		t.Errorf("dataDir=%v, want it unchanged", dataDir)
+	}
+}
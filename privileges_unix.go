@@ -0,0 +1,92 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches to the configured user and group, optionally
+// chrooting into the data directory first. It must run after the listeners
+// are bound and before anything is written to the data directory. It returns
+// the data directory as seen by the process afterwards.
+func dropPrivileges(serverCfg serverConfig, dataDir string) (string, error) {
+	if serverCfg.User == "" && serverCfg.Group == "" && !serverCfg.Chroot {
+		return dataDir, nil
+	}
+	uid, gid := -1, -1
+	if serverCfg.User != "" {
+		account, err := user.Lookup(serverCfg.User)
+		if err != nil {
+			return "", err
+		}
+		if uid, err = strconv.Atoi(account.Uid); err != nil {
+			return "", fmt.Errorf("user %q: %w", serverCfg.User, err)
+		}
+		if gid, err = strconv.Atoi(account.Gid); err != nil {
+			return "", fmt.Errorf("user %q: %w", serverCfg.User, err)
+		}
+	}
+	if serverCfg.Group != "" {
+		group, err := user.LookupGroup(serverCfg.Group)
+		if err != nil {
+			return "", err
+		}
+		if gid, err = strconv.Atoi(group.Gid); err != nil {
+			return "", fmt.Errorf("group %q: %w", serverCfg.Group, err)
+		}
+	}
+
+	// Host keys are generated in the data directory as the new user.
+	if _, err := os.Stat(dataDir); os.IsNotExist(err) {
+		if err := os.MkdirAll(dataDir, 0700); err != nil {
+			return "", err
+		}
+		if err := os.Chown(dataDir, uid, gid); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	if serverCfg.Chroot {
+		if uid == -1 {
+			warningLogger.Printf("Chrooting without dropping privileges, root can escape the chroot")
+		}
+		absDataDir, err := filepath.Abs(dataDir)
+		if err != nil {
+			return "", err
+		}
+		if err := syscall.Chroot(absDataDir); err != nil {
+			return "", fmt.Errorf("chroot %q: %w", absDataDir, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return "", err
+		}
+		dataDir = "/"
+	}
+	if gid != -1 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return "", fmt.Errorf("setgroups: %w", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return "", fmt.Errorf("setgid: %w", err)
+		}
+	}
+	if uid != -1 {
+		if err := syscall.Setuid(uid); err != nil {
+			return "", fmt.Errorf("setuid: %w", err)
+		}
+		if syscall.Setuid(0) == nil {
+			return "", errors.New("regained root after dropping privileges")
+		}
+	}
+	return dataDir, nil
+}
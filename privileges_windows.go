@@ -0,0 +1,10 @@
+package main
+
+import "errors"
+
+func dropPrivileges(serverCfg serverConfig, dataDir string) (string, error) {
+	if serverCfg.User == "" && serverCfg.Group == "" && !serverCfg.Chroot {
+		return dataDir, nil
+	}
+	return "", errors.New("dropping privileges is not supported on Windows")
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// proxyHeaderTimeout bounds how long a trusted source may take to send
+	// the PROXY protocol header.
+	proxyHeaderTimeout = 10 * time.Second
+	// proxyV1MaxLength is the longest valid v1 header, including CRLF.
+	proxyV1MaxLength = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a connection whose addresses were taken from a PROXY protocol
+// header.
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (conn *proxyConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+func (conn *proxyConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+func (conn *proxyConn) LocalAddr() net.Addr {
+	return conn.localAddr
+}
+
+// readProxyV1 parses a human readable header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\n".
+func readProxyV1(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("v1 header too long")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+	source, err := parseProxyV1Address(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	destination, err := parseProxyV1Address(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return source, destination, nil
+}
+
+func parseProxyV1Address(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid v1 address %q", host)
+	}
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(portNumber)}, nil
+}
+
+// readProxyV2 parses a binary header. LOCAL commands and address families
+// other than TCP over IPv4 or IPv6 keep the connection's own addresses.
+func readProxyV2(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported v2 version %v", header[12]>>4)
+	}
+	addresses := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, addresses); err != nil {
+		return nil, nil, err
+	}
+	switch command := header[12] & 0xf; command {
+	case 0:
+		return nil, nil, nil
+	case 1:
+	default:
+		return nil, nil, fmt.Errorf("unsupported v2 command %v", command)
+	}
+	var ipLength int
+	switch header[13] {
+	case 0x11:
+		ipLength = net.IPv4len
+	case 0x21:
+		ipLength = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(addresses) < 2*ipLength+4 {
+		return nil, nil, errors.New("truncated v2 addresses")
+	}
+	source := &net.TCPAddr{
+		IP:   net.IP(addresses[:ipLength]),
+		Port: int(binary.BigEndian.Uint16(addresses[2*ipLength:])),
+	}
+	destination := &net.TCPAddr{
+		IP:   net.IP(addresses[ipLength : 2*ipLength]),
+		Port: int(binary.BigEndian.Uint16(addresses[2*ipLength+2:])),
+	}
+	return source, destination, nil
+}
+
+// readProxyHeader reads a v1 or v2 header from the start of a connection and
+// returns the connection with the addresses it carries.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+	var source, destination net.Addr
+	var err error
+	if signature, _ := reader.Peek(len(proxyV2Signature)); bytes.Equal(signature, proxyV2Signature) {
+		source, destination, err = readProxyV2(reader)
+	} else if prefix, _ := reader.Peek(6); string(prefix) == "PROXY " {
+		source, destination, err = readProxyV1(reader)
+	} else {
+		return nil, errors.New("missing PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	proxied := &proxyConn{Conn: conn, reader: reader, remoteAddr: conn.RemoteAddr(), localAddr: conn.LocalAddr()}
+	if source != nil {
+		proxied.remoteAddr, proxied.localAddr = source, destination
+	}
+	return proxied, nil
+}
+
+func (cfg *config) setupProxyProtocol() error {
+	cfg.trustedProxies = nil
+	if !cfg.Server.ProxyProtocol.Enabled {
+		return nil
+	}
+	if len(cfg.Server.ProxyProtocol.TrustedSources) == 0 {
+		return errors.New("proxy protocol: trusted sources must not be empty")
+	}
+	for _, source := range cfg.Server.ProxyProtocol.TrustedSources {
+		network, err := parseIPNet(source)
+		if err != nil {
+			return fmt.Errorf("proxy protocol: %w", err)
+		}
+		cfg.trustedProxies = append(cfg.trustedProxies, network)
+	}
+	return nil
+}
+
+func (cfg *config) trustedProxy(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range cfg.trustedProxies {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptProxyProtocol replaces the addresses of connections from trusted
+// sources with the ones in their PROXY protocol header. Connections from
+// other sources are used as they are.
+func (cfg *config) acceptProxyProtocol(conn net.Conn) (net.Conn, error) {
+	if !cfg.Server.ProxyProtocol.Enabled || !cfg.trustedProxy(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+	proxied, err := readProxyHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return proxied, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func proxyV2Header(command byte, family byte, addresses []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, byte(len(addresses)>>8), byte(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		input          string
+		expectedRemote string
+		expectedLocal  string
+		expectedError  bool
+	}{
+		{
+			name:           "v1 TCP4",
+			input:          "PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\n",
+			expectedRemote: "192.0.2.1:56324",
+			expectedLocal:  "198.51.100.1:22",
+		},
+		{
+			name:           "v1 TCP6",
+			input:          "PROXY TCP6 2001:db8::1 2001:db8::2 56324 22\r\n",
+			expectedRemote: "[2001:db8::1]:56324",
+			expectedLocal:  "[2001:db8::2]:22",
+		},
+		{
+			name:           "v1 UNKNOWN",
+			input:          "PROXY UNKNOWN\r\n",
+			expectedRemote: "pipe",
+			expectedLocal:  "pipe",
+		},
+		{
+			name:          "v1 invalid",
+			input:         "PROXY TCP4 192.0.2.1 56324 22\r\n",
+			expectedError: true,
+		},
+		{
+			name:           "v2 TCP4",
+			input:          string(proxyV2Header(1, 0x11, []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0, 22})),
+			expectedRemote: "192.0.2.1:56324",
+			expectedLocal:  "198.51.100.1:22",
+		},
+		{
+			name: "v2 TCP6",
+			input: string(proxyV2Header(1, 0x21, []byte{
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+				0xdc, 0x04, 0, 22,
+			})),
+			expectedRemote: "[2001:db8::1]:56324",
+			expectedLocal:  "[2001:db8::2]:22",
+		},
+		{
+			name:           "v2 LOCAL",
+			input:          string(proxyV2Header(0, 0, nil)),
+			expectedRemote: "pipe",
+			expectedLocal:  "pipe",
+		},
+		{
+			name:          "v2 truncated",
+			input:         string(proxyV2Header(1, 0x11, []byte{192, 0, 2, 1})),
+			expectedError: true,
+		},
+		{
+			name:          "missing",
+			input:         "SSH-2.0-OpenSSH\r\n",
+			expectedError: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				client.Write([]byte(test.input + "SSH-2.0-Test\r\n"))
+				client.Close()
+			}()
+			conn, err := readProxyHeader(server)
+			if test.expectedError {
+				if err == nil {
+					t.Errorf("Expected an error")
+				}
+				go ioutil.ReadAll(server)
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to read header: %v", err)
+			}
+			if remote := conn.RemoteAddr().String(); remote != test.expectedRemote {
+				t.Errorf("RemoteAddr=%v, want %v", remote, test.expectedRemote)
+			}
+			if local := conn.LocalAddr().String(); local != test.expectedLocal {
+				t.Errorf("LocalAddr=%v, want %v", local, test.expectedLocal)
+			}
+			rest, err := ioutil.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("Failed to read connection: %v", err)
+			}
+			if string(rest) != "SSH-2.0-Test\r\n" {
+				t.Errorf("rest=%q, want %q", rest, "SSH-2.0-Test\r\n")
+			}
+		})
+	}
+}
+
+func TestTrustedProxy(t *testing.T) {
+	cfg := &config{}
+	cfg.Server.ProxyProtocol.Enabled = true
+	if err := cfg.setupProxyProtocol(); err == nil {
+		t.Errorf("Expected an error without trusted sources")
+	}
+	cfg.Server.ProxyProtocol.TrustedSources = []string{"10.0.0.0/8", "192.0.2.1"}
+	if err := cfg.setupProxyProtocol(); err != nil {
+		t.Fatalf("Failed to setup PROXY protocol: %v", err)
+	}
+	for _, test := range []struct {
+		addr    net.Addr
+		trusted bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.2")}, false},
+		{&net.UnixAddr{Name: "client.sock", Net: "unix"}, false},
+	} {
+		if trusted := cfg.trustedProxy(test.addr); trusted != test.trusted {
+			t.Errorf("trustedProxy(%v)=%v, want %v", test.addr, trusted, test.trusted)
+		}
+	}
+}
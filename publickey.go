@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authorizedKey is a key from an authorized_keys list with the options we
+// honour.
+type authorizedKey struct {
+	fingerprint string
+	from        []string
+}
+
+// parseAuthorizedKeys parses authorized_keys content, skipping blank lines and
+// comments.
+func parseAuthorizedKeys(content []byte) ([]authorizedKey, error) {
+	var keys []authorizedKey
+	for lineNumber, line := range bytes.Split(content, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, _, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", lineNumber+1, err)
+		}
+		entry := authorizedKey{fingerprint: ssh.FingerprintSHA256(key)}
+		for _, option := range options {
+			name := strings.SplitN(option, "=", 2)
+			if strings.ToLower(name[0]) == "from" && len(name) == 2 {
+				entry.from = strings.Split(strings.Trim(name[1], `"`), ",")
+			}
+		}
+		keys = append(keys, entry)
+	}
+	return keys, nil
+}
+
+// matchFromPattern matches a single from= pattern, which is either a CIDR
+// block or a glob over the client address.
+func matchFromPattern(pattern string, ip net.IP) bool {
+	if strings.Contains(pattern, "/") {
+		_, network, err := net.ParseCIDR(pattern)
+		return err == nil && network.Contains(ip)
+	}
+	return globPattern(pattern).MatchString(ip.String())
+}
+
+// matchFrom evaluates a from= pattern list the way sshd does: a matching
+// negated pattern rejects the client outright, otherwise any matching pattern
+// accepts it.
+func matchFrom(patterns []string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	matched := false
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "!") {
+			if matchFromPattern(pattern[1:], ip) {
+				return false
+			}
+			continue
+		}
+		if matchFromPattern(pattern, ip) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// authorizes reports whether any of the keys authorizes the attempt.
+func authorizes(keys []authorizedKey, request authRequest) bool {
+	for _, key := range keys {
+		if key.fingerprint != request.KeyFingerprint {
+			continue
+		}
+		if key.from == nil || matchFrom(key.from, request.ClientIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyBits returns the size of a public key in bits, or 0 if it is unknown.
+func keyBits(key ssh.PublicKey) int {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	cryptoKey, ok := key.(ssh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+	switch publicKey := cryptoKey.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return publicKey.N.BitLen()
+	case *dsa.PublicKey:
+		return publicKey.P.BitLen()
+	case *ecdsa.PublicKey:
+		return publicKey.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return 256
+	}
+	return 0
+}
+
+func newCertificateLog(cert *ssh.Certificate) *certificateLog {
+	return &certificateLog{
+		CAFingerprint:  ssh.FingerprintSHA256(cert.SignatureKey),
+		KeyFingerprint: ssh.FingerprintSHA256(cert.Key),
+		Principals:     cert.ValidPrincipals,
+		Serial:         cert.Serial,
+		KeyID:          cert.KeyId,
+		ValidAfter:     cert.ValidAfter,
+		ValidBefore:    cert.ValidBefore,
+	}
+}
+
+// checkCertificate reports whether a user certificate is signed by a trusted
+// CA and valid for the user connecting from clientIP. The force-command
+// critical option is accepted like sshd does, and source-address is enforced.
+func (cfg *config) checkCertificate(cert *ssh.Certificate, user string, clientIP net.IP) error {
+	if cert.CertType != ssh.UserCert {
+		return errors.New("not a user certificate")
+	}
+	checker := ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return cfg.trustedUserCAs[ssh.FingerprintSHA256(auth)]
+		},
+		SupportedCriticalOptions: []string{"force-command", "source-address"},
+	}
+	if !checker.IsUserAuthority(cert.SignatureKey) {
+		return errors.New("certificate signed by an untrusted CA")
+	}
+	if err := checker.CheckCert(user, cert); err != nil {
+		return err
+	}
+	if sourceAddress, ok := cert.CriticalOptions["source-address"]; ok {
+		return checkSourceAddress(clientIP, sourceAddress)
+	}
+	return nil
+}
+
+// checkSourceAddress checks a client IP against the comma separated
+// addresses and CIDR ranges of a source-address critical option.
+func checkSourceAddress(clientIP net.IP, sourceAddress string) error {
+	for _, address := range strings.Split(sourceAddress, ",") {
+		if ip := net.ParseIP(address); ip != nil {
+			if ip.Equal(clientIP) {
+				return nil
+			}
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(address)
+		if err != nil {
+			return fmt.Errorf("invalid source-address %q", address)
+		}
+		if clientIP != nil && ipNet.Contains(clientIP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("source address %v not allowed by the certificate", clientIP)
+}
+
+func (cfg *config) setupPublicKeyAuth(dataDir string) error {
+	cfg.authorizedKeys = nil
+	if keysFile := cfg.Auth.PublicKeyAuth.AuthorizedKeysFile; keysFile != "" {
+		if !path.IsAbs(keysFile) {
+			keysFile = path.Join(dataDir, keysFile)
+		}
+		content, err := ioutil.ReadFile(keysFile)
+		if err != nil {
+			return err
+		}
+		if cfg.authorizedKeys, err = parseAuthorizedKeys(content); err != nil {
+			return fmt.Errorf("%v: %w", keysFile, err)
+		}
+	}
+	cfg.trustedUserCAs = map[string]bool{}
+	for _, line := range cfg.Auth.PublicKeyAuth.TrustedUserCAKeys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return fmt.Errorf("trusted user CA key %q: %w", line, err)
+		}
+		cfg.trustedUserCAs[ssh.FingerprintSHA256(key)] = true
+	}
+	return nil
+}
+
+// authenticatePublicKey decides a public key attempt from the authorized keys
+// file or, for certificates, the trusted CAs. It returns false for decided
+// when neither applies to the key.
+func (cfg *config) authenticatePublicKey(request authRequest) (decided bool, accepted bool) {
+	if cert, ok := request.Key.(*ssh.Certificate); ok && len(cfg.trustedUserCAs) > 0 {
+		if err := cfg.checkCertificate(cert, request.User, request.ClientIP); err != nil {
+			return true, false
+		}
+		return true, true
+	}
+	if authorizes(cfg.authorizedKeys, request) {
+		return true, true
+	}
+	return false, false
+}
+
+func encodeKeyBlob(key ssh.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key.Marshal())
+}
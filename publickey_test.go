@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func generateTestKey(t *testing.T) (ssh.PublicKey, ssh.Signer) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	return signer.PublicKey(), signer
+}
+
+func TestAuthorizedKeysFile(t *testing.T) {
+	key, _ := generateTestKey(t)
+	otherKey, _ := generateTestKey(t)
+	dataDir := t.TempDir()
+	content := fmt.Sprintf("# keys\n\nfrom=\"10.0.0.0/8,192.0.2.*,!192.0.2.66\",no-pty %s\n", ssh.MarshalAuthorizedKey(key))
+	if err := ioutil.WriteFile(path.Join(dataDir, "authorized_keys"), []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write authorized_keys: %v", err)
+	}
+	cfg := &config{}
+	cfg.Auth.PublicKeyAuth.AuthorizedKeysFile = "authorized_keys"
+	if err := cfg.setupPublicKeyAuth(dataDir); err != nil {
+		t.Fatalf("Failed to set up public key auth: %v", err)
+	}
+	for _, test := range []struct {
+		key      ssh.PublicKey
+		ip       string
+		expected bool
+	}{
+		{key, "10.1.2.3", true},
+		{key, "192.0.2.1", true},
+		{key, "192.0.2.66", false},
+		{key, "198.51.100.1", false},
+		{otherKey, "10.1.2.3", false},
+	} {
+		request := authRequest{Method: "public_key", User: "root", ClientIP: net.ParseIP(test.ip), Key: test.key, KeyFingerprint: ssh.FingerprintSHA256(test.key)}
+		if accepted := cfg.authenticate(request, false); accepted != test.expected {
+			t.Errorf("authenticate(%v from %v)=%v, want %v", request.KeyFingerprint, test.ip, accepted, test.expected)
+		}
+	}
+}
+
+func TestCertificateAuth(t *testing.T) {
+	userKey, _ := generateTestKey(t)
+	caKey, caSigner := generateTestKey(t)
+	_, rogueSigner := generateTestKey(t)
+	cfg := &config{}
+	cfg.Auth.PublicKeyAuth.TrustedUserCAKeys = []string{string(ssh.MarshalAuthorizedKey(caKey))}
+	if err := cfg.setupPublicKeyAuth(t.TempDir()); err != nil {
+		t.Fatalf("Failed to set up public key auth: %v", err)
+	}
+	newCert := func(signer ssh.Signer, principals []string, validBefore uint64, criticalOptions map[string]string) *ssh.Certificate {
+		cert := &ssh.Certificate{
+			Key:             userKey,
+			Serial:          42,
+			CertType:        ssh.UserCert,
+			KeyId:           "deploy",
+			ValidPrincipals: principals,
+			ValidBefore:     validBefore,
+			Permissions:     ssh.Permissions{CriticalOptions: criticalOptions},
+		}
+		if err := cert.SignCert(rand.Reader, signer); err != nil {
+			t.Fatalf("Failed to sign certificate: %v", err)
+		}
+		return cert
+	}
+	for _, test := range []struct {
+		cert     *ssh.Certificate
+		expected bool
+	}{
+		{newCert(caSigner, []string{"root"}, ssh.CertTimeInfinity, nil), true},
+		{newCert(caSigner, []string{"deploy"}, ssh.CertTimeInfinity, nil), false},
+		{newCert(caSigner, []string{"root"}, 1, nil), false},
+		{newCert(rogueSigner, []string{"root"}, ssh.CertTimeInfinity, nil), false},
+		{newCert(caSigner, []string{"root"}, ssh.CertTimeInfinity, map[string]string{"force-command": "/bin/true"}), true},
+		{newCert(caSigner, []string{"root"}, ssh.CertTimeInfinity, map[string]string{"source-address": "10.0.0.1,192.0.2.0/24"}), true},
+		{newCert(caSigner, []string{"root"}, ssh.CertTimeInfinity, map[string]string{"source-address": "10.0.0.0/8"}), false},
+		{newCert(caSigner, []string{"root"}, ssh.CertTimeInfinity, map[string]string{"source-address": "bogus"}), false},
+		{newCert(caSigner, []string{"root"}, ssh.CertTimeInfinity, map[string]string{"unknown-option": ""}), false},
+	} {
+		request := authRequest{Method: "public_key", User: "root", ClientIP: net.ParseIP("192.0.2.7"), Key: test.cert, KeyFingerprint: ssh.FingerprintSHA256(test.cert)}
+		if accepted := cfg.authenticate(request, true); accepted != test.expected {
+			t.Errorf("authenticate(%+v)=%v, want %v", newCertificateLog(test.cert), accepted, test.expected)
+		}
+	}
+
+	cert := newCert(caSigner, []string{"root", "admin"}, ssh.CertTimeInfinity, nil)
+	entry := publicKeyAuthLog{
+		authLog:              authLog{User: "root", Accepted: true},
+		PublicKeyFingerprint: ssh.FingerprintSHA256(cert),
+		KeyType:              cert.Type(),
+		KeyBits:              keyBits(cert),
+		KeyBlob:              encodeKeyBlob(cert),
+		Certificate:          newCertificateLog(cert),
+	}
+	expected := fmt.Sprintf(`authentication for user "root" with certificate %q (key ID "deploy", serial 42, principals ["root" "admin"], valid from 1970-01-01T00:00:00Z to forever) signed by CA %q accepted`, ssh.FingerprintSHA256(userKey), ssh.FingerprintSHA256(caKey))
+	if entry.String() != expected {
+		t.Errorf("String()=%v, want %v", entry.String(), expected)
+	}
+	if entry.KeyType != ssh.CertAlgoED25519v01 || entry.KeyBits != 256 {
+		t.Errorf("KeyType=%v KeyBits=%v, want an ed25519 certificate of 256 bits", entry.KeyType, entry.KeyBits)
+	}
+}
+
+func TestKeyBits(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	publicKey, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to convert key: %v", err)
+	}
+	if bits := keyBits(publicKey); bits != 1024 {
+		t.Errorf("keyBits=%v, want 1024", bits)
+	}
+	if bits := keyBits(mockPublicKey{}); bits != 0 {
+		t.Errorf("keyBits=%v, want 0", bits)
+	}
+}
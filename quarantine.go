@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// maxUploadSize bounds how large a single uploaded file may grow in memory.
+const maxUploadSize = 64 * 1024 * 1024
+
+// quarantineIndexFile is the sidecar index describing every stored sample,
+// keyed by SHA-256.
+const quarantineIndexFile = "index.json"
+
+// quarantineFlushInterval is how long changes to the index are batched before
+// it is rewritten.
+const quarantineFlushInterval = 5 * time.Second
+
+// quarantineMaxValues bounds the source IPs, session IDs and names recorded
+// for a sample. The oldest values are forgotten first.
+const quarantineMaxValues = 100
+
+// captureSource identifies the connection captured bytes came from.
+type captureSource struct {
+	ClientIP  string
+	SessionID string
+}
+
+type quarantineEntry struct {
+	SHA256     string    `json:"sha256"`
+	SHA1       string    `json:"sha1"`
+	MD5        string    `json:"md5"`
+	Size       int       `json:"size"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	SourceIPs  []string  `json:"source_ips"`
+	SessionIDs []string  `json:"session_ids"`
+	Names      []string  `json:"names"`
+}
+
+func newQuarantineEntry(data []byte) *quarantineEntry {
+	sha256Sum := sha256.Sum256(data)
+	sha1Sum := sha1.Sum(data)
+	md5Sum := md5.Sum(data)
+	return &quarantineEntry{
+		SHA256: hex.EncodeToString(sha256Sum[:]),
+		SHA1:   hex.EncodeToString(sha1Sum[:]),
+		MD5:    hex.EncodeToString(md5Sum[:]),
+		Size:   len(data),
+	}
+}
+
+// appendUnique appends value unless it is already present, keeping at most
+// quarantineMaxValues values.
+func appendUnique(values []string, value string) []string {
+	if value == "" {
+		return values
+	}
+	for _, existing := range values {
+		if existing == value {
+			return values
+		}
+	}
+	if len(values) >= quarantineMaxValues {
+		values = append(values[:0], values[len(values)-quarantineMaxValues+1:]...)
+	}
+	return append(values, value)
+}
+
+// quarantineStore is a content-addressed store for captured payloads. Samples
+// are stored under their SHA-256 next to an index recording where and when
+// they were seen. The index is rewritten in batches by flush.
+type quarantineStore struct {
+	mutex      sync.Mutex
+	flushMutex sync.Mutex
+	dir        string
+	entries    map[string]*quarantineEntry
+	dirty      bool
+}
+
+func newQuarantineStore(dir string) (*quarantineStore, error) {
+	store := &quarantineStore{dir: dir, entries: map[string]*quarantineEntry{}}
+	indexBytes, err := ioutil.ReadFile(path.Join(dir, quarantineIndexFile))
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(indexBytes, &store.entries); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// writeAtomically replaces name with data so readers never see a partially
+// written file.
+func writeAtomically(dir, name string, data []byte) error {
+	temp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := os.Rename(temp.Name(), path.Join(dir, name)); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return nil
+}
+
+// add stores data and records the capture in the index, returning a copy of
+// the updated entry. The index is flushed after quarantineFlushInterval.
+func (store *quarantineStore) add(data []byte, source captureSource, name string) (quarantineEntry, error) {
+	entry := newQuarantineEntry(data)
+	store.mutex.Lock()
+	_, exists := store.entries[entry.SHA256]
+	store.mutex.Unlock()
+	if !exists {
+		// Samples are content-addressed, so concurrent writes of the same
+		// sample store the same bytes.
+		if err := os.MkdirAll(store.dir, 0700); err != nil {
+			return quarantineEntry{}, err
+		}
+		if err := writeAtomically(store.dir, entry.SHA256, data); err != nil {
+			return quarantineEntry{}, err
+		}
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if existing, ok := store.entries[entry.SHA256]; ok {
+		entry = existing
+	} else {
+		entry.FirstSeen = time.Now()
+		store.entries[entry.SHA256] = entry
+	}
+	entry.LastSeen = time.Now()
+	entry.SourceIPs = appendUnique(entry.SourceIPs, source.ClientIP)
+	entry.SessionIDs = appendUnique(entry.SessionIDs, source.SessionID)
+	entry.Names = appendUnique(entry.Names, name)
+	if !store.dirty {
+		store.dirty = true
+		time.AfterFunc(quarantineFlushInterval, func() {
+			if err := store.flush(); err != nil {
+				warningLogger.Printf("Failed to write quarantine index: %v", err)
+			}
+		})
+	}
+	result := *entry
+	result.SourceIPs = append([]string(nil), entry.SourceIPs...)
+	result.SessionIDs = append([]string(nil), entry.SessionIDs...)
+	result.Names = append([]string(nil), entry.Names...)
+	return result, nil
+}
+
+// flush rewrites the index if it changed since it was last written.
+func (store *quarantineStore) flush() error {
+	if store == nil {
+		return nil
+	}
+	store.flushMutex.Lock()
+	defer store.flushMutex.Unlock()
+	store.mutex.Lock()
+	if !store.dirty {
+		store.mutex.Unlock()
+		return nil
+	}
+	indexBytes, err := json.MarshalIndent(store.entries, "", "  ")
+	store.dirty = false
+	store.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(store.dir, 0700); err != nil {
+		return err
+	}
+	return writeAtomically(store.dir, quarantineIndexFile, indexBytes)
+}
+
+// capture stores bytes written by tool to name in the quarantine store, logs
+// the capture and returns the SHA-256 of the data.
+func (context commandContext) capture(tool, name string, data []byte) (string, error) {
+	entry := *newQuarantineEntry(data)
+	if context.cfg != nil && context.cfg.quarantine != nil {
+		var err error
+		if entry, err = context.cfg.quarantine.add(data, context.source, name); err != nil {
+			return "", err
+		}
+	}
+	context.logEvent(fileCaptureLog{
+		channelLog: channelLog{
+			ChannelID: context.channelID,
+		},
+		Tool:   tool,
+		Path:   name,
+		Size:   entry.Size,
+		SHA256: entry.SHA256,
+		SHA1:   entry.SHA1,
+		MD5:    entry.MD5,
+	})
+	return entry.SHA256, nil
+}
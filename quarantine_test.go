@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestQuarantineStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newQuarantineStore(dir)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	if _, err := store.add([]byte("payload"), captureSource{"1.2.3.4", "aa"}, "/tmp/a"); err != nil {
+		t.Fatalf("Failed to add sample: %v", err)
+	}
+	entry, err := store.add([]byte("payload"), captureSource{"5.6.7.8", "bb"}, "/tmp/a")
+	if err != nil {
+		t.Fatalf("Failed to add sample: %v", err)
+	}
+	expectedEntry := quarantineEntry{
+		SHA256:     "239f59ed55e737c77147cf55ad0c1b030b6d7ee748a7426952f9b852d5a935e5",
+		SHA1:       "f07e5a815613c5abeddc4b682247a4c42d8a95df",
+		MD5:        "321c3cf486ed509164edec1e1981fec8",
+		Size:       7,
+		FirstSeen:  entry.FirstSeen,
+		LastSeen:   entry.LastSeen,
+		SourceIPs:  []string{"1.2.3.4", "5.6.7.8"},
+		SessionIDs: []string{"aa", "bb"},
+		Names:      []string{"/tmp/a"},
+	}
+	if !reflect.DeepEqual(entry, expectedEntry) {
+		t.Errorf("entry=%+v, want %+v", entry, expectedEntry)
+	}
+	if entry.LastSeen.Before(entry.FirstSeen) {
+		t.Errorf("LastSeen=%v before FirstSeen=%v", entry.LastSeen, entry.FirstSeen)
+	}
+	content, err := ioutil.ReadFile(path.Join(dir, entry.SHA256))
+	if err != nil {
+		t.Fatalf("Failed to read sample: %v", err)
+	}
+	if string(content) != "payload" {
+		t.Errorf("content=%q, want payload", content)
+	}
+
+	if err := store.flush(); err != nil {
+		t.Fatalf("Failed to flush index: %v", err)
+	}
+	reloaded, err := newQuarantineStore(dir)
+	if err != nil {
+		t.Fatalf("Failed to reload store: %v", err)
+	}
+	if len(reloaded.entries) != 1 || !reflect.DeepEqual(reloaded.entries[entry.SHA256].SourceIPs, expectedEntry.SourceIPs) {
+		t.Errorf("entries=%v, want the recorded sample", reloaded.entries)
+	}
+}
+
+func TestQuarantineStoreBounded(t *testing.T) {
+	store, err := newQuarantineStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	var entry quarantineEntry
+	for i := 0; i < quarantineMaxValues+10; i++ {
+		if entry, err = store.add([]byte("payload"), captureSource{"1.2.3.4", fmt.Sprint(i)}, "/tmp/a"); err != nil {
+			t.Fatalf("Failed to add sample: %v", err)
+		}
+	}
+	if len(entry.SessionIDs) != quarantineMaxValues {
+		t.Errorf("len(SessionIDs)=%v, want %v", len(entry.SessionIDs), quarantineMaxValues)
+	}
+	if last := entry.SessionIDs[len(entry.SessionIDs)-1]; last != fmt.Sprint(quarantineMaxValues+9) {
+		t.Errorf("last session ID=%v, want the most recent", last)
+	}
+	if !reflect.DeepEqual(entry.SourceIPs, []string{"1.2.3.4"}) || !reflect.DeepEqual(entry.Names, []string{"/tmp/a"}) {
+		t.Errorf("SourceIPs=%v Names=%v, want them deduplicated", entry.SourceIPs, entry.Names)
+	}
+}
+
+func TestShellCapture(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newQuarantineStore(dir)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	events := make(chan logEntry, 10)
+	status, err := executeProgram(commandContext{
+		args:       []string{"sh", "-c", "echo aGVsbG8K | base64 -d > /tmp/x; cat > /tmp/y <<EOF\nworld\nEOF\nrm -f /tmp/z > /dev/null"},
+		stdin:      newReaderReadLiner(strings.NewReader("")),
+		stdout:     &bytes.Buffer{},
+		stderr:     &bytes.Buffer{},
+		filesystem: defaultFilesystemImage.clone(),
+		env:        newShellEnvironment("/root", nil),
+		events:     events,
+		cfg:        &config{quarantine: store},
+		source:     captureSource{"1.2.3.4", "aa"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to execute program: %v", err)
+	}
+	if status != 127 {
+		t.Errorf("status=%v, want 127", status)
+	}
+	close(events)
+	var captures []fileCaptureLog
+	for entry := range events {
+		if capture, ok := entry.(fileCaptureLog); ok {
+			captures = append(captures, capture)
+		}
+	}
+	expectedCaptures := []fileCaptureLog{
+		{Tool: "shell", Path: "/tmp/x", Size: 6, SHA256: "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03", SHA1: "f572d396fae9206628714fb2ce00f72e94f2258f", MD5: "b1946ac92492d2347c6235b4d2611184"},
+		{Tool: "shell", Path: "/tmp/y", Size: 6, SHA256: "e258d248fda94c63753607f7c4494ee0fcbe92f1a76bfdac795c9d84101eb317", SHA1: "9591818c07e900db7e1e0bc4b884c945e6a61b24", MD5: "591785b794601e212b260e25925636fd"},
+	}
+	if !reflect.DeepEqual(captures, expectedCaptures) {
+		t.Errorf("captures=%+v, want %+v", captures, expectedCaptures)
+	}
+	if len(store.entries) != 2 {
+		t.Errorf("len(entries)=%v, want 2", len(store.entries))
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// asciicastHeader is the first line of an asciicast v2 recording.
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// sessionRecorder writes the bytes exchanged on a PTY session as an
+// asciicast v2 stream. Recording errors are logged once and then ignored so
+// they never affect the session. Once the recording would grow past maxSize
+// bytes it stops and limitReached is called.
+type sessionRecorder struct {
+	mutex        sync.Mutex
+	file         io.WriteCloser
+	started      time.Time
+	failed       bool
+	size         int
+	maxSize      int
+	limitReached func(size int)
+}
+
+func newSessionRecorder(file io.WriteCloser, header asciicastHeader, maxSize int, limitReached func(size int)) (*sessionRecorder, error) {
+	recorder := &sessionRecorder{file: file, started: time.Now(), maxSize: maxSize, limitReached: limitReached}
+	header.Version = 2
+	header.Timestamp = recorder.started.Unix()
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(file, "%s\n", headerBytes); err != nil {
+		return nil, err
+	}
+	recorder.size = len(headerBytes) + 1
+	return recorder, nil
+}
+
+func (recorder *sessionRecorder) event(eventType string, data string) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if recorder.failed {
+		return
+	}
+	elapsed := time.Since(recorder.started).Seconds()
+	eventBytes, err := json.Marshal([]interface{}{json.Number(fmt.Sprintf("%.6f", elapsed)), eventType, data})
+	if err == nil && recorder.maxSize > 0 && recorder.size+len(eventBytes)+1 > recorder.maxSize {
+		recorder.failed = true
+		if recorder.limitReached != nil {
+			recorder.limitReached(recorder.size)
+		}
+		return
+	}
+	if err == nil {
+		_, err = fmt.Fprintf(recorder.file, "%s\n", eventBytes)
+		recorder.size += len(eventBytes) + 1
+	}
+	if err != nil {
+		warningLogger.Printf("Failed to record session: %v", err)
+		recorder.failed = true
+	}
+}
+
+func (recorder *sessionRecorder) resize(width, height uint32) {
+	recorder.event("r", fmt.Sprintf("%vx%v", width, height))
+}
+
+func (recorder *sessionRecorder) Close() error {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.failed = true
+	return recorder.file.Close()
+}
+
+// recordedChannel tees everything read from and written to a channel into a
+// recorder.
+type recordedChannel struct {
+	io.ReadWriter
+	recorder *sessionRecorder
+}
+
+func (channel recordedChannel) Read(p []byte) (int, error) {
+	n, err := channel.ReadWriter.Read(p)
+	if n > 0 {
+		channel.recorder.event("i", string(p[:n]))
+	}
+	return n, err
+}
+
+func (channel recordedChannel) Write(p []byte) (int, error) {
+	channel.recorder.event("o", string(p))
+	return channel.ReadWriter.Write(p)
+}
+
+// startRecording creates a recording for the session's PTY and returns it
+// with its file name, or returns nil when recording is disabled or the file
+// cannot be created.
+func (channel *sessionContext) startRecording() (*sessionRecorder, string) {
+	if channel.cfg == nil || channel.cfg.recordingDir == "" {
+		return nil, ""
+	}
+	if err := os.MkdirAll(channel.cfg.recordingDir, 0700); err != nil {
+		warningLogger.Printf("Failed to create recording directory: %v", err)
+		return nil, ""
+	}
+	now := time.Now()
+	sessionID := channel.source.SessionID
+	if len(sessionID) > 16 {
+		sessionID = sessionID[:16]
+	}
+	name := path.Join(channel.cfg.recordingDir, fmt.Sprintf("%v-%v-%v.cast", now.UTC().Format("20060102T150405Z"), sessionID, channel.channelID))
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		warningLogger.Printf("Failed to create recording: %v", err)
+		return nil, ""
+	}
+	recorder, err := newSessionRecorder(file, asciicastHeader{
+		Width:  channel.width,
+		Height: channel.height,
+		Title:  fmt.Sprintf("%v channel %v", channel.source.ClientIP, channel.channelID),
+		Env:    map[string]string{"TERM": channel.variables["TERM"], "SHELL": "/bin/bash"},
+	}, channel.cfg.Recording.MaxSize, func(size int) {
+		channel.logChan <- sessionRecordingLimitLog{
+			channelLog: channelLog{
+				ChannelID: channel.channelID,
+			},
+			File: name,
+			Size: size,
+		}
+	})
+	if err != nil {
+		file.Close()
+		warningLogger.Printf("Failed to create recording: %v", err)
+		return nil, ""
+	}
+	return recorder, name
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type nopWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func TestSessionRecorder(t *testing.T) {
+	output := &bytes.Buffer{}
+	recorder, err := newSessionRecorder(nopWriteCloser{output}, asciicastHeader{Width: 80, Height: 24, Env: map[string]string{"TERM": "xterm"}}, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to create recorder: %v", err)
+	}
+	channel := recordedChannel{&struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader("id\r"), &bytes.Buffer{}}, recorder}
+	if _, err := ioutil.ReadAll(channel); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if _, err := channel.Write([]byte("uid=0(root)\r\n")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	recorder.resize(120, 40)
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("Failed to close recorder: %v", err)
+	}
+	recorder.event("o", "ignored after close")
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("lines=%q, want a header and three events", lines)
+	}
+	var header asciicastHeader
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatalf("Failed to parse header: %v", err)
+	}
+	if header.Version != 2 || header.Width != 80 || header.Height != 24 || header.Timestamp == 0 || header.Env["TERM"] != "xterm" {
+		t.Errorf("header=%+v, want a version 2 header for an 80x24 xterm", header)
+	}
+	var events [][]interface{}
+	for _, line := range lines[1:] {
+		var event []interface{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("Failed to parse event %q: %v", line, err)
+		}
+		if elapsed, ok := event[0].(float64); !ok || elapsed < 0 {
+			t.Errorf("event[0]=%v, want a non-negative time", event[0])
+		}
+		events = append(events, event[1:])
+	}
+	expectedEvents := [][]interface{}{{"i", "id\r"}, {"o", "uid=0(root)\r\n"}, {"r", "120x40"}}
+	if !reflect.DeepEqual(events, expectedEvents) {
+		t.Errorf("events=%v, want %v", events, expectedEvents)
+	}
+}
+
+func TestSessionRecorderLimit(t *testing.T) {
+	output := &bytes.Buffer{}
+	limitSize := -1
+	recorder, err := newSessionRecorder(nopWriteCloser{output}, asciicastHeader{Width: 80, Height: 24}, 100, func(size int) {
+		limitSize = size
+	})
+	if err != nil {
+		t.Fatalf("Failed to create recorder: %v", err)
+	}
+	recorder.event("o", "short")
+	recordedSize := output.Len()
+	recorder.event("o", strings.Repeat("x", 100))
+	recorder.event("o", "short")
+	if output.Len() != recordedSize {
+		t.Errorf("output=%q, want recording to stop at the limit", output.String())
+	}
+	if limitSize != recordedSize {
+		t.Errorf("limitSize=%v, want %v", limitSize, recordedSize)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+type asciicastEvent struct {
+	Time float64
+	Type string
+	Data string
+}
+
+func readAsciicast(reader io.Reader) (asciicastHeader, []asciicastEvent, error) {
+	var header asciicastHeader
+	var events []asciicastEvent
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, 16*1024*1024)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return header, nil, err
+		}
+		return header, nil, errors.New("empty recording")
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return header, nil, fmt.Errorf("invalid header: %w", err)
+	}
+	if header.Version != 2 {
+		return header, nil, fmt.Errorf("unsupported asciicast version %v", header.Version)
+	}
+	for line := 2; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var fields []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &fields); err != nil {
+			return header, nil, fmt.Errorf("line %v: %w", line, err)
+		}
+		if len(fields) != 3 {
+			return header, nil, fmt.Errorf("line %v: expected 3 fields, got %v", line, len(fields))
+		}
+		eventTime, timeOK := fields[0].(float64)
+		eventType, typeOK := fields[1].(string)
+		data, dataOK := fields[2].(string)
+		if !timeOK || !typeOK || !dataOK {
+			return header, nil, fmt.Errorf("line %v: malformed event", line)
+		}
+		events = append(events, asciicastEvent{eventTime, eventType, data})
+	}
+	return header, events, scanner.Err()
+}
+
+type replayCommand struct {
+	Time    float64
+	Command string
+}
+
+// commandIndex reconstructs the lines typed during a recording from its
+// input events, applying backspaces the way a terminal would.
+func commandIndex(events []asciicastEvent) []replayCommand {
+	var commands []replayCommand
+	var line []rune
+	var started float64
+	for _, event := range events {
+		if event.Type != "i" {
+			continue
+		}
+		for i := 0; i < len(event.Data); i++ {
+			char := event.Data[i]
+			switch {
+			case char == '\r' || char == '\n':
+				if command := strings.TrimSpace(string(line)); command != "" {
+					commands = append(commands, replayCommand{started, command})
+				}
+				line = nil
+			case char == 0x7f || char == '\b':
+				if len(line) > 0 {
+					line = line[:len(line)-1]
+				}
+			case char == 0x1b:
+				// Skip escape sequences such as cursor keys.
+				for i+1 < len(event.Data) && (event.Data[i+1] == '[' || event.Data[i+1] == 'O' || (event.Data[i+1] >= '0' && event.Data[i+1] <= '9') || event.Data[i+1] == ';') {
+					i++
+				}
+				if i+1 < len(event.Data) {
+					i++
+				}
+			case char < 0x20:
+			default:
+				if len(line) == 0 {
+					started = event.Time
+				}
+				line = append(line, []rune(string(event.Data[i]))...)
+			}
+		}
+	}
+	return commands
+}
+
+type replayOptions struct {
+	speed     float64
+	idleLimit float64
+	seek      float64
+}
+
+// replayer plays back the output of a recording. Its position is tracked in
+// recording time so seeking and speed changes compose naturally.
+type replayer struct {
+	events   []asciicastEvent
+	output   io.Writer
+	options  replayOptions
+	next     int
+	position float64
+	paused   bool
+}
+
+func (player *replayer) writeEvent(event asciicastEvent) error {
+	if event.Type != "o" {
+		return nil
+	}
+	_, err := io.WriteString(player.output, event.Data)
+	return err
+}
+
+// seek moves the playback position to target, redrawing from the start when
+// moving backwards.
+func (player *replayer) seek(target float64) error {
+	if target < 0 {
+		target = 0
+	}
+	if target < player.position {
+		if _, err := io.WriteString(player.output, "\x1bc"); err != nil {
+			return err
+		}
+		player.next = 0
+	}
+	for player.next < len(player.events) && player.events[player.next].Time <= target {
+		if err := player.writeEvent(player.events[player.next]); err != nil {
+			return err
+		}
+		player.next++
+	}
+	player.position = target
+	return nil
+}
+
+func (player *replayer) handleKey(key byte) (bool, error) {
+	switch key {
+	case ' ':
+		player.paused = !player.paused
+	case '+', '=':
+		player.options.speed *= 2
+	case '-', '_':
+		player.options.speed /= 2
+	case 'f', 'l':
+		return false, player.seek(player.position + 5)
+	case 'b', 'h':
+		return false, player.seek(player.position - 5)
+	case '.':
+		if player.next < len(player.events) {
+			return false, player.seek(player.events[player.next].Time)
+		}
+	case 'q', 3:
+		return true, nil
+	}
+	return false, nil
+}
+
+// play writes the recording's output in real time, scaled by the speed, and
+// reacts to keys until the recording ends or the user quits.
+func (player *replayer) play(keys <-chan byte) error {
+	if err := player.seek(player.options.seek); err != nil {
+		return err
+	}
+	for player.next < len(player.events) {
+		event := player.events[player.next]
+		delay := event.Time - player.position
+		if player.options.idleLimit > 0 && delay > player.options.idleLimit {
+			player.position = event.Time - player.options.idleLimit
+			delay = player.options.idleLimit
+		}
+		var timer <-chan time.Time
+		if !player.paused {
+			timer = time.After(time.Duration(delay / player.options.speed * float64(time.Second)))
+		}
+		started := time.Now()
+		select {
+		case key, ok := <-keys:
+			if !ok {
+				keys = nil
+				continue
+			}
+			if !player.paused {
+				player.position += time.Since(started).Seconds() * player.options.speed
+			}
+			quit, err := player.handleKey(key)
+			if quit || err != nil {
+				return err
+			}
+		case <-timer:
+			player.position = event.Time
+			if err := player.writeEvent(event); err != nil {
+				return err
+			}
+			player.next++
+		}
+	}
+	return nil
+}
+
+func formatReplayTime(seconds float64) string {
+	duration := time.Duration(seconds * float64(time.Second)).Round(time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", int(duration.Hours()), int(duration.Minutes())%60, int(duration.Seconds())%60)
+}
+
+func runReplay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := flags.Float64("speed", 1, "playback speed multiplier")
+	idleLimit := flags.Float64("idle_limit", 0, "cap pauses between events to this many seconds, 0 for no limit")
+	seek := flags.Float64("seek", 0, "start playback at this many seconds into the recording")
+	command := flags.Int("command", 0, "start playback at the given entry of the command index")
+	index := flags.Bool("index", false, "print the index of entered commands and exit")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %v replay [flags] recording.cast\n\nKeys: space pauses, +/- change speed, f/b seek 5s, . skips to the next event, q quits.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || *speed <= 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, events, err := readAsciicast(file)
+	if err != nil {
+		return err
+	}
+	commands := commandIndex(events)
+	if *index {
+		for i, entry := range commands {
+			fmt.Printf("%4d  %v  %v\n", i+1, formatReplayTime(entry.Time), entry.Command)
+		}
+		return nil
+	}
+	if *command > 0 {
+		if *command > len(commands) {
+			return fmt.Errorf("the recording has only %v commands", len(commands))
+		}
+		*seek = commands[*command-1].Time
+	}
+
+	var keys chan byte
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		state, err := term.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			return err
+		}
+		defer term.Restore(int(os.Stdin.Fd()), state)
+		keys = make(chan byte)
+		go func() {
+			defer close(keys)
+			buffer := make([]byte, 1)
+			for {
+				if _, err := os.Stdin.Read(buffer); err != nil {
+					return
+				}
+				keys <- buffer[0]
+			}
+		}()
+	}
+	player := &replayer{
+		events:  events,
+		output:  os.Stdout,
+		options: replayOptions{*speed, *idleLimit, *seek},
+	}
+	return player.play(keys)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testRecording = `{"version":2,"width":80,"height":24,"timestamp":1600000000}
+[0.100000,"o","$ "]
+[1.000000,"i","l"]
+[1.100000,"i","x\u007fs"]
+[1.200000,"o","ls"]
+[1.300000,"i","\r"]
+[1.400000,"o","\r\nbin etc\r\n$ "]
+[2.000000,"i","\u001b[Auname -a\r"]
+[2.500000,"o","Linux\r\n$ "]
+`
+
+func TestReadAsciicast(t *testing.T) {
+	header, events, err := readAsciicast(strings.NewReader(testRecording))
+	if err != nil {
+		t.Fatalf("Failed to read recording: %v", err)
+	}
+	if header.Width != 80 || header.Height != 24 {
+		t.Errorf("header=%+v, want 80x24", header)
+	}
+	if len(events) != 8 {
+		t.Fatalf("len(events)=%v, want 8", len(events))
+	}
+	if expected := (asciicastEvent{1.1, "i", "x\x7fs"}); events[2] != expected {
+		t.Errorf("events[2]=%+v, want %+v", events[2], expected)
+	}
+	if _, _, err := readAsciicast(strings.NewReader(`{"version":1}`)); err == nil {
+		t.Errorf("err=nil, want an unsupported version error")
+	}
+}
+
+func TestCommandIndex(t *testing.T) {
+	_, events, err := readAsciicast(strings.NewReader(testRecording))
+	if err != nil {
+		t.Fatalf("Failed to read recording: %v", err)
+	}
+	expected := []replayCommand{{1.0, "ls"}, {2.0, "uname -a"}}
+	if commands := commandIndex(events); !reflect.DeepEqual(commands, expected) {
+		t.Errorf("commands=%+v, want %+v", commands, expected)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	_, events, err := readAsciicast(strings.NewReader(testRecording))
+	if err != nil {
+		t.Fatalf("Failed to read recording: %v", err)
+	}
+	output := &bytes.Buffer{}
+	player := &replayer{events: events, output: output, options: replayOptions{speed: 1000}}
+	if err := player.play(nil); err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+	if expected := "$ ls\r\nbin etc\r\n$ Linux\r\n$ "; output.String() != expected {
+		t.Errorf("output=%q, want %q", output.String(), expected)
+	}
+
+	output.Reset()
+	player = &replayer{events: events, output: output, options: replayOptions{speed: 1000, seek: 1.4}}
+	if err := player.seek(1.4); err != nil {
+		t.Fatalf("Failed to seek: %v", err)
+	}
+	if err := player.seek(0.5); err != nil {
+		t.Fatalf("Failed to seek: %v", err)
+	}
+	if expected := "$ ls\r\nbin etc\r\n$ \x1bc$ "; output.String() != expected {
+		t.Errorf("output=%q, want %q", output.String(), expected)
+	}
+}
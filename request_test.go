@@ -113,15 +113,17 @@ func TestRequests(t *testing.T) {
 
 	clientAddress := path.Join(dataDir, "client.sock")
 
-	logs := testRequests(t, dataDir, cfg, clientAddress)
+	logs := normalizeLogs(testRequests(t, dataDir, cfg, clientAddress))
 
 	expectedLogs := fmt.Sprintf(`[%[1]v] authentication for user "" without credentials accepted
-[%[1]v] connection with client version "SSH-2.0-Go" established
+[%[1]v] connection with client version "SSH-2.0-Go" and HASSH %[2]v established
+[%[1]v] handshake negotiated %[3]v
 [%[1]v] TCP/IP forwarding on 127.0.0.1:0 requested
 [%[1]v] TCP/IP forwarding on 127.0.0.1:1234 requested
 [%[1]v] TCP/IP forwarding on 127.0.0.1:0 canceled
+[%[1]v] authentication finished after 1 attempts with methods ["none"] accepted
 [%[1]v] connection closed
-`, clientAddress)
+`, clientAddress, goClientHASSH, goClientHandshake)
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", logs, expectedLogs)
 	}
@@ -144,19 +146,21 @@ func TestRequestsJSON(t *testing.T) {
 
 	clientAddress := path.Join(dataDir, "client.sock")
 
-	logs := testRequests(t, dataDir, cfg, clientAddress)
+	logs := normalizeLogs(testRequests(t, dataDir, cfg, clientAddress))
 
 	escapedClientAddress, err := json.Marshal(clientAddress)
 	if err != nil {
 		t.Fatalf("Failed to escape clientAddress: %v", err)
 	}
 	expectedLogs := fmt.Sprintf(`{"source":%[1]v,"event_type":"no_auth","event":{"user":"","accepted":true}}
-{"source":%[1]v,"event_type":"connection","event":{"client_version":"SSH-2.0-Go"}}
+{"source":%[1]v,"event_type":"connection","event":%[2]v}
+{"source":%[1]v,"event_type":"handshake","event":%[3]v}
 {"source":%[1]v,"event_type":"tcpip_forward","event":{"address":"127.0.0.1:0"}}
 {"source":%[1]v,"event_type":"tcpip_forward","event":{"address":"127.0.0.1:1234"}}
 {"source":%[1]v,"event_type":"cancel_tcpip_forward","event":{"address":"127.0.0.1:0"}}
+{"source":%[1]v,"event_type":"auth_summary","event":{"attempts":[{"index":0,"method":"none","user":"","elapsed_ms":0,"accepted":true}],"methods":["none"],"accepted":true}}
 {"source":%[1]v,"event_type":"connection_close","event":{}}
-`, string(escapedClientAddress))
+`, string(escapedClientAddress), goClientConnectionJSON, goClientHandshakeJSON)
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", logs, expectedLogs)
 	}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// scpError is a protocol level error reported to the client instead of
+// aborting the session.
+type scpError struct {
+	message string
+}
+
+func (err scpError) Error() string {
+	return err.message
+}
+
+type scpOptions struct {
+	recursive, preserve bool
+}
+
+type cmdSCP struct{}
+
+func (cmdSCP) readAck(reader *bufio.Reader) error {
+	code, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if code == 0 {
+		return nil
+	}
+	message, err := readBufferedLine(reader)
+	if err != nil {
+		return err
+	}
+	return scpError{message}
+}
+
+func (cmdSCP) sendError(context commandContext, format string, args ...interface{}) error {
+	_, err := fmt.Fprintf(context.stdout, "\x01scp: "+format+"\n", args...)
+	return err
+}
+
+// scpValidName reports whether a name received in a 'C' or 'D' record stays
+// within the target directory.
+func scpValidName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+func (scp cmdSCP) receiveFile(context commandContext, reader *bufio.Reader, dir, target string, header string) error {
+	fields := strings.SplitN(header, " ", 3)
+	if len(fields) != 3 {
+		return scpError{"protocol error: bad mode"}
+	}
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return scpError{"protocol error: bad mode"}
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return scpError{"protocol error: size not delimited"}
+	}
+	if size > maxUploadSize {
+		return scpError{fmt.Sprintf("%v: File too large", fields[2])}
+	}
+	name := fields[2]
+	if !scpValidName(name) {
+		return scpError{fmt.Sprintf("error: unexpected filename: %v", name)}
+	}
+	if target == "" {
+		target = path.Join(dir, name)
+	}
+	if _, err := context.stdout.Write([]byte{0}); err != nil {
+		return err
+	}
+	buffer := &bytes.Buffer{}
+	if n, err := io.Copy(buffer, io.LimitReader(reader, size)); err != nil {
+		return err
+	} else if n < size {
+		return io.ErrUnexpectedEOF
+	}
+	data := buffer.Bytes()
+	if err := scp.readAck(reader); err != nil {
+		return err
+	}
+	digest, err := context.capture("scp", target, data)
+	if err != nil {
+		return err
+	}
+	context.logEvent(fileUploadLog{
+		channelLog: channelLog{
+			ChannelID: context.channelID,
+		},
+		Tool:   "scp",
+		Path:   target,
+		Size:   len(data),
+		SHA256: digest,
+	})
+	if err := context.filesystem.writeFile(target, data, unixMode(mode&07777)); err != nil {
+		return scpError{fmt.Sprintf("%v: %v", target, fsErrorMessage(err))}
+	}
+	_, uid, gid := context.user()
+	return context.filesystem.chown(target, fileOwner{uid, gid})
+}
+
+// sink implements "scp -t", receiving files pushed by the client.
+func (scp cmdSCP) sink(context commandContext, options scpOptions, target string) error {
+	reader := bufio.NewReader(context.binaryInput())
+	dir := resolvePath(context.env.dir, target)
+	file := ""
+	if info, err := context.filesystem.stat(dir); err != nil || !info.IsDir() {
+		if options.recursive {
+			return scp.sendError(context, "%v: Not a directory", target)
+		}
+		dir, file = path.Dir(dir), dir
+	}
+	dirs := []string{}
+	if _, err := context.stdout.Write([]byte{0}); err != nil {
+		return err
+	}
+	for {
+		line, err := readBufferedLine(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return scp.sendError(context, "protocol error: unexpected <newline>")
+		}
+		switch line[0] {
+		case 'T':
+			// Modification times are accepted but not applied.
+		case 'C':
+			err = scp.receiveFile(context, reader, dir, file, line[1:])
+			file = ""
+		case 'D':
+			fields := strings.SplitN(line[1:], " ", 3)
+			if !options.recursive || len(fields) != 3 {
+				return scp.sendError(context, "received directory without -r")
+			}
+			if !scpValidName(fields[2]) {
+				return scp.sendError(context, "error: unexpected filename: %v", fields[2])
+			}
+			dirs = append(dirs, dir)
+			dir = path.Join(dir, fields[2])
+			if err := context.filesystem.mkdirAll(dir, 0755); err != nil {
+				return scp.sendError(context, "%v: %v", dir, fsErrorMessage(err))
+			}
+		case 'E':
+			if len(dirs) == 0 {
+				return scp.sendError(context, "protocol error: unexpected <E>")
+			}
+			dir, dirs = dirs[len(dirs)-1], dirs[:len(dirs)-1]
+		case 1, 2:
+			// The client reported an error, which needs no reply.
+			continue
+		default:
+			return scp.sendError(context, "protocol error: expected control record")
+		}
+		if protocolError, ok := err.(scpError); ok {
+			if err := scp.sendError(context, "%v", protocolError.message); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := context.stdout.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+}
+
+func (scp cmdSCP) sendFile(context commandContext, reader *bufio.Reader, options scpOptions, name string) error {
+	info, err := context.filesystem.stat(name)
+	if err != nil {
+		return scpError{fmt.Sprintf("%v: %v", name, fsErrorMessage(err))}
+	}
+	if options.preserve {
+		if _, err := fmt.Fprintf(context.stdout, "T%v 0 %v 0\n", info.ModTime().Unix(), info.ModTime().Unix()); err != nil {
+			return err
+		}
+		if err := scp.readAck(reader); err != nil {
+			return err
+		}
+	}
+	if info.IsDir() {
+		if !options.recursive {
+			return scpError{fmt.Sprintf("%v: not a regular file", name)}
+		}
+		entries, err := context.filesystem.readDir(name)
+		if err != nil {
+			return scpError{fmt.Sprintf("%v: %v", name, fsErrorMessage(err))}
+		}
+		if _, err := fmt.Fprintf(context.stdout, "D%04o 0 %v\n", info.Mode().Perm(), path.Base(name)); err != nil {
+			return err
+		}
+		if err := scp.readAck(reader); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := scp.sendFile(context, reader, options, path.Join(name, entry.Name())); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprint(context.stdout, "E\n"); err != nil {
+			return err
+		}
+		return scp.readAck(reader)
+	}
+	data, err := context.filesystem.readFile(name)
+	if err != nil {
+		return scpError{fmt.Sprintf("%v: %v", name, fsErrorMessage(err))}
+	}
+	if _, err := fmt.Fprintf(context.stdout, "C%04o %v %v\n", info.Mode().Perm(), len(data), path.Base(name)); err != nil {
+		return err
+	}
+	if err := scp.readAck(reader); err != nil {
+		return err
+	}
+	if _, err := context.stdout.Write(append(data, 0)); err != nil {
+		return err
+	}
+	return scp.readAck(reader)
+}
+
+// source implements "scp -f", sending files from the filesystem to the
+// client.
+func (scp cmdSCP) source(context commandContext, options scpOptions, sources []string) (uint32, error) {
+	reader := bufio.NewReader(context.binaryInput())
+	if err := scp.readAck(reader); err != nil {
+		return 1, nil
+	}
+	var status uint32
+	for _, source := range sources {
+		name := resolvePath(context.env.dir, source)
+		context.logEvent(fileDownloadLog{
+			channelLog: channelLog{
+				ChannelID: context.channelID,
+			},
+			Tool: "scp",
+			Path: name,
+		})
+		err := scp.sendFile(context, reader, options, name)
+		if protocolError, ok := err.(scpError); ok {
+			status = 1
+			err = scp.sendError(context, "%v", protocolError.message)
+		}
+		if err == io.EOF {
+			return 1, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return status, nil
+}
+
+func (scp cmdSCP) execute(context commandContext) (uint32, error) {
+	options := scpOptions{}
+	mode := ""
+	var operands []string
+	for _, arg := range context.args[1:] {
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			operands = append(operands, arg)
+			continue
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 't', 'f':
+				mode = string(flag)
+			case 'r':
+				options.recursive = true
+			case 'p':
+				options.preserve = true
+			}
+		}
+	}
+	switch {
+	case mode == "t" && len(operands) == 1:
+		if err := scp.sink(context, options, operands[0]); err != nil && err != io.EOF {
+			return 1, err
+		}
+		return 0, nil
+	case mode == "f" && len(operands) > 0:
+		return scp.source(context, options, operands)
+	}
+	_, err := fmt.Fprintln(context.stderr, "usage: scp [-346ABCpqrTv] [-c cipher] [-F ssh_config] [-i identity_file]\n            [-J destination] [-l limit] [-o ssh_option] [-P port]\n            [-S program] source ... target")
+	return 1, err
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func runTestSCP(t *testing.T, filesystem *virtualFilesystem, quarantine *quarantineStore, command string, input string) (uint32, string, []logEntry) {
+	stdout := &bytes.Buffer{}
+	events := make(chan logEntry, 10)
+	status, err := executeProgram(commandContext{
+		args:       []string{"sh", "-c", command},
+		stdin:      newReaderReadLiner(strings.NewReader(input)),
+		stdout:     stdout,
+		stderr:     &bytes.Buffer{},
+		filesystem: filesystem,
+		env:        newShellEnvironment("/root", map[string]string{"HOME": "/root"}),
+		events:     events,
+		cfg:        &config{quarantine: quarantine},
+	})
+	if err != nil {
+		t.Fatalf("Failed to execute program: %v", err)
+	}
+	close(events)
+	var entries []logEntry
+	for entry := range events {
+		switch entry.(type) {
+		case sessionCommandLog, fileCaptureLog:
+		default:
+			entries = append(entries, entry)
+		}
+	}
+	return status, stdout.String(), entries
+}
+
+func TestSCPSink(t *testing.T) {
+	quarantineDir := t.TempDir()
+	quarantine, err := newQuarantineStore(quarantineDir)
+	if err != nil {
+		t.Fatalf("Failed to create quarantine store: %v", err)
+	}
+	filesystem := defaultFilesystemImage.clone()
+	input := "C0755 6 bot\nhello\n\x00" + "D0755 0 lib\nC0644 0 empty\n\x00E\n"
+	status, stdout, events := runTestSCP(t, filesystem, quarantine, "scp -r -t /tmp", input)
+	if status != 0 {
+		t.Errorf("status=%v, want 0", status)
+	}
+	if expectedStdout := strings.Repeat("\x00", 7); stdout != expectedStdout {
+		t.Errorf("stdout=%q, want %q", stdout, expectedStdout)
+	}
+	sum := sha256.Sum256([]byte("hello\n"))
+	digest := hex.EncodeToString(sum[:])
+	emptySum := sha256.Sum256(nil)
+	expectedEvents := []logEntry{
+		fileUploadLog{Tool: "scp", Path: "/tmp/bot", Size: 6, SHA256: digest},
+		fileUploadLog{Tool: "scp", Path: "/tmp/lib/empty", Size: 0, SHA256: hex.EncodeToString(emptySum[:])},
+	}
+	if !reflect.DeepEqual(events, expectedEvents) {
+		t.Errorf("events=%v, want %v", events, expectedEvents)
+	}
+	content, err := filesystem.readFile("/tmp/bot")
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if string(content) != "hello\n" {
+		t.Errorf("content=%q, want hello", content)
+	}
+	info, err := filesystem.stat("/tmp/bot")
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if info.Mode() != 0755 {
+		t.Errorf("info.Mode()=%v, want 0755", info.Mode())
+	}
+	quarantined, err := ioutil.ReadFile(path.Join(quarantineDir, digest))
+	if err != nil {
+		t.Fatalf("Failed to read quarantined file: %v", err)
+	}
+	if string(quarantined) != "hello\n" {
+		t.Errorf("quarantined=%q, want hello", quarantined)
+	}
+
+	status, stdout, _ = runTestSCP(t, filesystem, quarantine, "scp -t /tmp/renamed", "C0644 2 original\nhi\x00")
+	if status != 0 || stdout != "\x00\x00\x00" {
+		t.Errorf("status=%v stdout=%q, want 0 and three acknowledgements", status, stdout)
+	}
+	if content, err := filesystem.readFile("/tmp/renamed"); err != nil || string(content) != "hi" {
+		t.Errorf("content=%q err=%v, want hi", content, err)
+	}
+
+	for _, name := range []string{"..", "../etc", "a/b"} {
+		_, stdout, _ = runTestSCP(t, filesystem, quarantine, "scp -r -t /tmp/lib", "D0755 0 "+name+"\nC0644 2 x\nhi\x00E\n")
+		if expectedStdout := "\x00\x01scp: error: unexpected filename: " + name + "\n"; stdout != expectedStdout {
+			t.Errorf("stdout=%q, want %q", stdout, expectedStdout)
+		}
+	}
+	if _, err := filesystem.stat("/tmp/x"); err == nil {
+		t.Errorf("/tmp/x exists, want directory names with .. rejected")
+	}
+}
+
+func TestSCPSource(t *testing.T) {
+	filesystem := defaultFilesystemImage.clone()
+	status, stdout, events := runTestSCP(t, filesystem, nil, "scp -f /etc/hostname /nonexistent", "\x00\x00\x00")
+	if status != 1 {
+		t.Errorf("status=%v, want 1", status)
+	}
+	expectedStdout := "C0644 7 hostname\nubuntu\n\x00\x01scp: /nonexistent: No such file or directory\n"
+	if stdout != expectedStdout {
+		t.Errorf("stdout=%q, want %q", stdout, expectedStdout)
+	}
+	expectedEvents := []logEntry{
+		fileDownloadLog{Tool: "scp", Path: "/etc/hostname"},
+		fileDownloadLog{Tool: "scp", Path: "/nonexistent"},
+	}
+	if !reflect.DeepEqual(events, expectedEvents) {
+		t.Errorf("events=%v, want %v", events, expectedEvents)
+	}
+}
+
+func TestSCPSinkQuota(t *testing.T) {
+	quarantineDir := t.TempDir()
+	quarantine, err := newQuarantineStore(quarantineDir)
+	if err != nil {
+		t.Fatalf("Failed to create quarantine store: %v", err)
+	}
+	filesystem := defaultFilesystemImage.clone()
+	filesystem.quota = 4
+	status, stdout, events := runTestSCP(t, filesystem, quarantine, "scp -t /tmp", "C0644 6 bot\nhello\n\x00")
+	if status != 0 {
+		t.Errorf("status=%v, want 0", status)
+	}
+	if expectedStdout := "\x00\x00\x01scp: /tmp/bot: File too large\n"; stdout != expectedStdout {
+		t.Errorf("stdout=%q, want %q", stdout, expectedStdout)
+	}
+	if len(events) != 1 {
+		t.Errorf("len(events)=%v, want 1", len(events))
+	}
+	if _, err := filesystem.stat("/tmp/bot"); err == nil {
+		t.Errorf("/tmp/bot exists, want upload rejected by the quota")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+type serverListener struct {
+	net.Listener
+	name    string
+	address string
+	cfg     *config
+}
+
+// server accepts connections on the configured listeners and keeps track of
+// them so the configuration can be swapped and the connections drained on
+// shutdown.
+type server struct {
+	mutex       sync.Mutex
+	cfg         *config
+	listeners   []*serverListener
+	conns       map[net.Conn]bool
+	connections sync.WaitGroup
+	closing     bool
+}
+
+// listen binds the listeners of a configuration, using the sockets inherited
+// through socket activation where there are any.
+func listen(serverCfg *serverConfig, sockets *inheritedSockets) ([]*serverListener, error) {
+	addresses, err := serverCfg.listenAddresses()
+	if err != nil {
+		return nil, err
+	}
+	var listeners []*serverListener
+	for i, address := range addresses {
+		netListener := sockets.take(i, address.name)
+		if netListener == nil {
+			netListener, err = net.Listen("tcp", address.address)
+			if err != nil {
+				for _, listener := range listeners {
+					listener.Close()
+				}
+				return nil, err
+			}
+		}
+		listeners = append(listeners, &serverListener{
+			Listener: netListener,
+			name:     address.name,
+			address:  address.address,
+		})
+	}
+	sockets.closeUnused()
+	return listeners, nil
+}
+
+func newServer(cfg *config, listeners []*serverListener) (*server, error) {
+	srv := &server{cfg: cfg, listeners: listeners, conns: map[net.Conn]bool{}}
+	for _, listener := range listeners {
+		for _, listenerCfg := range cfg.listeners {
+			if listenerCfg.name == listener.name {
+				listener.cfg = listenerCfg.cfg
+			}
+		}
+		if listener.cfg == nil {
+			return nil, fmt.Errorf("no configuration for listener %q", listener.name)
+		}
+	}
+	return srv, nil
+}
+
+// serve accepts connections until the server is shut down.
+func (srv *server) serve() {
+	var listeners sync.WaitGroup
+	for _, listener := range srv.listeners {
+		if listener.name != "" {
+			infoLogger.Printf("Listening on %v as %q", listener.Addr(), listener.name)
+		} else {
+			infoLogger.Printf("Listening on %v", listener.Addr())
+		}
+		listeners.Add(1)
+		go func(listener *serverListener) {
+			defer listeners.Done()
+			srv.accept(listener)
+		}(listener)
+	}
+	listeners.Wait()
+}
+
+func (srv *server) accept(listener *serverListener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			warningLogger.Printf("Failed to accept connection: %v", err)
+			continue
+		}
+		srv.mutex.Lock()
+		if srv.closing {
+			srv.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		cfg := listener.cfg
+		srv.conns[conn] = true
+		srv.connections.Add(1)
+		srv.mutex.Unlock()
+		go func() {
+			defer func() {
+				srv.mutex.Lock()
+				delete(srv.conns, conn)
+				srv.mutex.Unlock()
+				srv.connections.Done()
+			}()
+			proxiedConn, err := cfg.acceptProxyProtocol(conn)
+			if err != nil {
+				warningLogger.Printf("Failed to read PROXY protocol header from %v: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			handleConnection(proxiedConn, cfg)
+		}()
+	}
+}
+
+// reload swaps in a new configuration for new connections. Existing
+// connections keep the configuration they were accepted with. Listeners are
+// matched by name; adding, removing or moving listeners requires a restart.
+func (srv *server) reload(cfg *config) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	previous := srv.cfg
+	cfg.shareState(previous)
+	matched := map[string]bool{}
+	for _, listenerCfg := range cfg.listeners {
+		found := false
+		for _, listener := range srv.listeners {
+			if listener.name != listenerCfg.name {
+				continue
+			}
+			found = true
+			if listener.address != listenerCfg.address {
+				warningLogger.Printf("Listener %q moved to %v, restart to apply", listenerCfg.name, listenerCfg.address)
+			}
+			listener.cfg = listenerCfg.cfg
+			matched[listener.name] = true
+		}
+		if !found {
+			warningLogger.Printf("Listener %q added, restart to apply", listenerCfg.name)
+		}
+	}
+	for _, listener := range srv.listeners {
+		if !matched[listener.name] {
+			warningLogger.Printf("Listener %q removed, restart to apply", listener.name)
+		}
+	}
+	srv.cfg = cfg
+	cfg.applyLogging()
+	if previous.logFileHandle != nil && previous.logFileHandle != cfg.logFileHandle {
+		previous.logFileHandle.Close()
+	}
+	infoLogger.Printf("Config reloaded")
+}
+
+// shutdown stops accepting connections and waits for open connections to
+// finish for up to the drain timeout before closing them. It returns once
+// every connection has logged its closing events.
+func (srv *server) shutdown() {
+	srv.mutex.Lock()
+	srv.closing = true
+	for _, listener := range srv.listeners {
+		listener.Close()
+	}
+	drainTimeout := srv.cfg.Server.DrainTimeout
+	srv.mutex.Unlock()
+
+	drained := make(chan interface{})
+	go func() {
+		srv.connections.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(drainTimeout):
+		srv.mutex.Lock()
+		if len(srv.conns) > 0 {
+			infoLogger.Printf("Closing %v connections still open after %v", len(srv.conns), drainTimeout)
+		}
+		for conn := range srv.conns {
+			conn.Close()
+		}
+		srv.mutex.Unlock()
+		<-drained
+	}
+
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.cfg.sinks.replace(nil)
+	if err := srv.cfg.quarantine.flush(); err != nil {
+		warningLogger.Printf("Failed to write quarantine index: %v", err)
+	}
+	if srv.cfg.logFileHandle != nil {
+		srv.cfg.logFileHandle.Close()
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func testServerConfig(t *testing.T, key string, version string) *config {
+	cfg := &config{}
+	cfg.Server.HostKeys = []string{key}
+	cfg.Server.DrainTimeout = 50 * time.Millisecond
+	cfg.SSHProto.Version = version
+	cfg.Auth.NoAuth = true
+	cfg.Logging.JSON = true
+	if err := cfg.setupSSHConfig(); err != nil {
+		t.Fatalf("Failed to setup SSH config: %v", err)
+	}
+	if err := cfg.setupLimits(); err != nil {
+		t.Fatalf("Failed to setup limits: %v", err)
+	}
+	cfg.Server.ListenAddress = "127.0.0.1:0"
+	if err := cfg.setupListeners("", ""); err != nil {
+		t.Fatalf("Failed to setup listeners: %v", err)
+	}
+	return cfg
+}
+
+func dialServer(t *testing.T, srv *server) ssh.Conn {
+	netConn, err := net.Dial("tcp", srv.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	conn, _, _, err := ssh.NewClientConn(netConn, "", &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatalf("Failed to establish SSH connection: %v", err)
+	}
+	return conn
+}
+
+func startServer(t *testing.T, cfg *config) *server {
+	listeners, err := listen(&cfg.Server, nil)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv, err := newServer(cfg, listeners)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	return srv
+}
+
+func TestServerReloadAndShutdown(t *testing.T) {
+	key, err := generateKey(t.TempDir(), ecdsa_key)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	cfg := testServerConfig(t, key, "SSH-2.0-first")
+	logBuffer := setupLogBuffer(t, cfg)
+	firstLog := &mockFile{buffer: logBuffer}
+	cfg.logFileHandle = firstLog
+
+	srv := startServer(t, cfg)
+	served := make(chan interface{})
+	go func() {
+		srv.serve()
+		close(served)
+	}()
+
+	first := dialServer(t, srv)
+	defer first.Close()
+	if version := string(first.ServerVersion()); version != "SSH-2.0-first" {
+		t.Errorf("ServerVersion=%v, want SSH-2.0-first", version)
+	}
+
+	reloaded := testServerConfig(t, key, "SSH-2.0-second")
+	reloaded.logFileHandle = &mockFile{buffer: logBuffer}
+	srv.reload(reloaded)
+	if reloaded.connectionLimiter != cfg.connectionLimiter {
+		t.Errorf("Reloaded config does not share the connection limiter")
+	}
+	if !firstLog.closed {
+		t.Errorf("Previous log file not closed by reload")
+	}
+	second := dialServer(t, srv)
+	defer second.Close()
+	if version := string(second.ServerVersion()); version != "SSH-2.0-second" {
+		t.Errorf("ServerVersion=%v, want SSH-2.0-second", version)
+	}
+	if _, _, err := first.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Errorf("Existing connection dropped by reload: %v", err)
+	}
+
+	shutdown := make(chan interface{})
+	go func() {
+		srv.shutdown()
+		close(shutdown)
+	}()
+	select {
+	case <-shutdown:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Shutdown did not close the open connections")
+	}
+	<-served
+	if err := first.Wait(); err == nil {
+		t.Errorf("Connection not closed by shutdown")
+	}
+
+	logs := logBuffer.String()
+	if count := strings.Count(logs, `"event_type":"connection_close"`); count != 2 {
+		t.Errorf("logs=%v, want 2 connection_close events", logs)
+	}
+	if _, err := net.Dial("tcp", srv.listeners[0].Addr().String()); err == nil {
+		t.Errorf("Listener still accepting connections after shutdown")
+	}
+}
+
+func TestServerShutdownIdle(t *testing.T) {
+	key, err := generateKey(t.TempDir(), ecdsa_key)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	cfg := testServerConfig(t, key, "SSH-2.0-test")
+	cfg.Server.DrainTimeout = time.Hour
+	srv := startServer(t, cfg)
+	go srv.serve()
+	start := time.Now()
+	srv.shutdown()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown without connections took %v", elapsed)
+	}
+}
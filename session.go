@@ -2,8 +2,11 @@ package main
 
 import (
 	"bufio"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"strings"
 
 	"golang.org/x/crypto/ssh"
@@ -180,42 +183,71 @@ var sessionRequestParsers = map[string]channelRequestPayloadParser{
 
 type sessionContext struct {
 	ssh.Channel
-	inputChan chan string
-	errorChan chan error
-	active    bool
-	pty       bool
+	channelID  int
+	logChan    chan logEntry
+	errorChan  chan error
+	active     bool
+	pty        bool
+	filesystem *virtualFilesystem
+	variables  map[string]string
+	cfg        *config
+	source     captureSource
+	width      uint32
+	height     uint32
+	recorder   *sessionRecorder
 }
 
 type scannerReadLiner struct {
-	scanner   *bufio.Scanner
-	inputChan chan<- string
+	reader    *bufio.Reader
+	channelID int
+	logChan   chan<- logEntry
 }
 
 func (r scannerReadLiner) ReadLine() (string, error) {
-	if !r.scanner.Scan() {
-		if err := r.scanner.Err(); err != nil {
-			return "", err
-		}
-		return "", io.EOF
+	line, err := readBufferedLine(r.reader)
+	if err != nil {
+		return "", err
+	}
+	r.logChan <- sessionInputLog{
+		channelLog: channelLog{
+			ChannelID: r.channelID,
+		},
+		Input: line,
 	}
-	line := r.scanner.Text()
-	r.inputChan <- line
 	return line, nil
 }
 
+func (r scannerReadLiner) Read(p []byte) (int, error) {
+	return r.reader.Read(p)
+}
+
 type terminalReadLiner struct {
 	terminal  *term.Terminal
-	inputChan chan<- string
+	channelID int
+	logChan   chan<- logEntry
 }
 
 func (r terminalReadLiner) ReadLine() (string, error) {
 	line, err := r.terminal.ReadLine()
 	if err == nil || line != "" {
-		r.inputChan <- line
+		r.logChan <- sessionInputLog{
+			channelLog: channelLog{
+				ChannelID: r.channelID,
+			},
+			Input: line,
+		}
 	}
 	return line, err
 }
 
+var defaultShellVariables = map[string]string{
+	"HOME":    "/root",
+	"LOGNAME": "root",
+	"PATH":    "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+	"SHELL":   "/bin/bash",
+	"USER":    "root",
+}
+
 func (channel *sessionContext) handleProgram(program []string) bool {
 	if channel.active {
 		warningLogger.Printf("A program is already active")
@@ -224,25 +256,62 @@ func (channel *sessionContext) handleProgram(program []string) bool {
 	channel.active = true
 	var stdin readLiner
 	var stdout, stderr io.Writer
+	var output io.Writer = channel
+	recordingFile := ""
 	if channel.pty {
-		terminal := term.NewTerminal(channel, "")
-		stdin = terminalReadLiner{terminal, channel.inputChan}
+		var terminalChannel io.ReadWriter = channel
+		channel.recorder, recordingFile = channel.startRecording()
+		if channel.recorder != nil {
+			terminalChannel = recordedChannel{channel, channel.recorder}
+			output = terminalChannel
+		}
+		terminal := term.NewTerminal(terminalChannel, "")
+		stdin = terminalReadLiner{terminal, channel.channelID, channel.logChan}
 		stdout = terminal
 		stderr = terminal
 	} else {
-		stdin = scannerReadLiner{bufio.NewScanner(channel), channel.inputChan}
+		stdin = scannerReadLiner{bufio.NewReader(channel), channel.channelID, channel.logChan}
 		stdout = channel
 		stderr = channel.Stderr()
 	}
+	variables := map[string]string{}
+	for name, value := range defaultShellVariables {
+		variables[name] = value
+	}
+	for name, value := range channel.variables {
+		variables[name] = value
+	}
+	env := newShellEnvironment(variables["HOME"], variables)
 	go func() {
-		defer close(channel.inputChan)
+		defer close(channel.logChan)
 		defer close(channel.errorChan)
-		result, err := executeProgram(commandContext{program, stdin, stdout, stderr, channel.pty})
+		if channel.recorder != nil {
+			defer channel.recorder.Close()
+			channel.logChan <- sessionRecordingLog{
+				channelLog: channelLog{
+					ChannelID: channel.channelID,
+				},
+				File: recordingFile,
+			}
+		}
+		result, err := executeProgram(commandContext{
+			args:       program,
+			stdin:      stdin,
+			stdout:     stdout,
+			stderr:     stderr,
+			pty:        channel.pty,
+			filesystem: channel.filesystem,
+			env:        env,
+			channelID:  channel.channelID,
+			events:     channel.logChan,
+			cfg:        channel.cfg,
+			source:     channel.source,
+		})
 		if err == io.EOF {
 			err = nil
 		}
 		if err == nil && channel.pty {
-			_, err = channel.Write([]byte("\r\n"))
+			_, err = output.Write([]byte("\r\n"))
 		}
 		if err == nil {
 			_, err = channel.SendRequest("exit-status", false, ssh.Marshal(struct {
@@ -263,6 +332,38 @@ func (channel *sessionContext) handleProgram(program []string) bool {
 	return true
 }
 
+func splitAddress(addr net.Addr) (string, string) {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String(), "0"
+	}
+	return host, port
+}
+
+func (context channelContext) captureSource() captureSource {
+	clientIP, _ := splitAddress(context.RemoteAddr())
+	return captureSource{clientIP, hex.EncodeToString(context.SessionID())}
+}
+
+func sessionVariables(context channelContext) map[string]string {
+	clientHost, clientPort := splitAddress(context.RemoteAddr())
+	serverHost, serverPort := splitAddress(context.LocalAddr())
+	variables := map[string]string{
+		"SSH_CLIENT":     fmt.Sprintf("%v %v %v", clientHost, clientPort, serverPort),
+		"SSH_CONNECTION": fmt.Sprintf("%v %v %v %v", clientHost, clientPort, serverHost, serverPort),
+	}
+	if context.account != nil {
+		for name, value := range context.account.variables() {
+			variables[name] = value
+		}
+	}
+	return variables
+}
+
+// sftpServerPath is the program the sftp subsystem runs, as configured in the
+// emulated /etc/ssh/sshd_config.
+const sftpServerPath = "/usr/lib/openssh/sftp-server"
+
 func (channel *sessionContext) handleRequest(request interface{}) (bool, error) {
 	switch payload := request.(type) {
 	case *ptyRequest:
@@ -270,16 +371,30 @@ func (channel *sessionContext) handleRequest(request interface{}) (bool, error)
 			return false, errors.New("a pty-req request was already sent")
 		}
 		channel.pty = true
+		channel.width, channel.height = payload.Width, payload.Height
+		channel.variables["TERM"] = payload.Term
+		channel.variables["SSH_TTY"] = fmt.Sprintf("/dev/pts/%v", channel.channelID)
+	case *windowChangeRequestPayload:
+		channel.width, channel.height = payload.Width, payload.Height
+		if channel.recorder != nil {
+			channel.recorder.resize(payload.Width, payload.Height)
+		}
+	case *envRequestPayload:
+		channel.variables[payload.Name] = payload.Value
 	case *shellRequest:
 		if !channel.handleProgram(shellProgram) {
 			return false, nil
 		}
 	case *execRequestPayload:
-		if !channel.handleProgram(strings.Fields(payload.Command)) {
+		if !channel.handleProgram([]string{"sh", "-c", payload.Command}) {
 			return false, nil
 		}
 	case *subsystemRequestPayload:
-		if !channel.handleProgram(strings.Fields(payload.Subsystem)) {
+		program := strings.Fields(payload.Subsystem)
+		if payload.Subsystem == "sftp" {
+			program = []string{sftpServerPath}
+		}
+		if !channel.handleProgram(program) {
 			return false, nil
 		}
 	}
@@ -308,23 +423,27 @@ func handleSessionChannel(newChannel ssh.NewChannel, context channelContext) err
 		},
 	})
 
-	inputChan := make(chan string)
+	logChan := make(chan logEntry)
 	errorChan := make(chan error)
-	session := sessionContext{channel, inputChan, errorChan, false, false}
+	session := sessionContext{
+		Channel:    channel,
+		channelID:  context.channelID,
+		logChan:    logChan,
+		errorChan:  errorChan,
+		filesystem: context.filesystem,
+		variables:  sessionVariables(context),
+		cfg:        context.cfg,
+		source:     context.captureSource(),
+	}
 
-	for inputChan != nil || errorChan != nil || requests != nil {
+	for logChan != nil || errorChan != nil || requests != nil {
 		select {
-		case input, ok := <-inputChan:
+		case entry, ok := <-logChan:
 			if !ok {
-				inputChan = nil
+				logChan = nil
 				continue
 			}
-			context.logEvent(sessionInputLog{
-				channelLog: channelLog{
-					ChannelID: context.channelID,
-				},
-				Input: input,
-			})
+			context.logEvent(entry)
 		case err, ok := <-errorChan:
 			if !ok {
 				errorChan = nil
@@ -337,7 +456,7 @@ func handleSessionChannel(newChannel ssh.NewChannel, context channelContext) err
 			if !ok {
 				requests = nil
 				if !session.active {
-					close(inputChan)
+					close(logChan)
 					close(errorChan)
 				}
 				continue
@@ -326,31 +326,40 @@ func TestSession(t *testing.T) {
 
 	clientAddress := path.Join(dataDir, "client.sock")
 
-	logs := testSession(t, dataDir, cfg, clientAddress)
+	logs := normalizeLogs(testSession(t, dataDir, cfg, clientAddress))
 
 	expectedLogs := fmt.Sprintf(`[%[1]v] authentication for user "" without credentials accepted
-[%[1]v] connection with client version "SSH-2.0-Go" established
+[%[1]v] connection with client version "SSH-2.0-Go" and HASSH %[2]v established
+[%[1]v] handshake negotiated %[3]v
 [%[1]v] [channel 0] session requested
 [%[1]v] [channel 0] X11 forwarding on screen 0 requested
 [%[1]v] [channel 0] environment variable "LANG" with value "en_IE.UTF-8" requested
 [%[1]v] [channel 0] command "sh" requested
+[%[1]v] [channel 0] shell command "sh" parsed as [sh]
 [%[1]v] [channel 0] input: "false"
+[%[1]v] [channel 0] shell command "false" parsed as [false]
 [%[1]v] [channel 0] input: "true"
+[%[1]v] [channel 0] shell command "true" parsed as [true]
 [%[1]v] [channel 0] closed
 [%[1]v] [channel 1] session requested
 [%[1]v] [channel 1] X11 forwarding on screen 0 requested
 [%[1]v] [channel 1] environment variable "LANG" with value "en_IE.UTF-8" requested
 [%[1]v] [channel 1] shell requested
 [%[1]v] [channel 1] input: "false"
+[%[1]v] [channel 1] shell command "false" parsed as [false]
 [%[1]v] [channel 1] input: "true"
+[%[1]v] [channel 1] shell command "true" parsed as [true]
 [%[1]v] [channel 1] closed
 [%[1]v] [channel 2] session requested
 [%[1]v] [channel 2] X11 forwarding on screen 0 requested
 [%[1]v] [channel 2] PTY using terminal "xterm-256color" (size 80x24) requested
 [%[1]v] [channel 2] environment variable "LANG" with value "en_IE.UTF-8" requested
 [%[1]v] [channel 2] command "sh" requested
+[%[1]v] [channel 2] shell command "sh" parsed as [sh]
 [%[1]v] [channel 2] input: "false"
+[%[1]v] [channel 2] shell command "false" parsed as [false]
 [%[1]v] [channel 2] input: "true"
+[%[1]v] [channel 2] shell command "true" parsed as [true]
 [%[1]v] [channel 2] closed
 [%[1]v] [channel 3] session requested
 [%[1]v] [channel 3] X11 forwarding on screen 0 requested
@@ -358,10 +367,13 @@ func TestSession(t *testing.T) {
 [%[1]v] [channel 3] environment variable "LANG" with value "en_IE.UTF-8" requested
 [%[1]v] [channel 3] shell requested
 [%[1]v] [channel 3] input: "false"
+[%[1]v] [channel 3] shell command "false" parsed as [false]
 [%[1]v] [channel 3] input: "true"
+[%[1]v] [channel 3] shell command "true" parsed as [true]
 [%[1]v] [channel 3] closed
+[%[1]v] authentication finished after 1 attempts with methods ["none"] accepted
 [%[1]v] connection closed
-`, clientAddress)
+`, clientAddress, goClientHASSH, goClientHandshake)
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", logs, expectedLogs)
 	}
@@ -384,35 +396,44 @@ func TestSessionJSON(t *testing.T) {
 
 	clientAddress := path.Join(dataDir, "client.sock")
 
-	logs := testSession(t, dataDir, cfg, clientAddress)
+	logs := normalizeLogs(testSession(t, dataDir, cfg, clientAddress))
 
 	escapedClientAddress, err := json.Marshal(clientAddress)
 	if err != nil {
 		t.Fatalf("Failed to escape clientAddress: %v", err)
 	}
 	expectedLogs := fmt.Sprintf(`{"source":%[1]v,"event_type":"no_auth","event":{"user":"","accepted":true}}
-{"source":%[1]v,"event_type":"connection","event":{"client_version":"SSH-2.0-Go"}}
+{"source":%[1]v,"event_type":"connection","event":%[2]v}
+{"source":%[1]v,"event_type":"handshake","event":%[3]v}
 {"source":%[1]v,"event_type":"session","event":{"channel_id":0}}
 {"source":%[1]v,"event_type":"x11","event":{"channel_id":0,"screen":0}}
 {"source":%[1]v,"event_type":"env","event":{"channel_id":0,"name":"LANG","value":"en_IE.UTF-8"}}
 {"source":%[1]v,"event_type":"exec","event":{"channel_id":0,"command":"sh"}}
+{"source":%[1]v,"event_type":"session_command","event":{"channel_id":0,"command":"sh","tree":[{"pipelines":[{"commands":[{"args":["sh"]}]}]}]}}
 {"source":%[1]v,"event_type":"session_input","event":{"channel_id":0,"input":"false"}}
+{"source":%[1]v,"event_type":"session_command","event":{"channel_id":0,"command":"false","tree":[{"pipelines":[{"commands":[{"args":["false"]}]}]}]}}
 {"source":%[1]v,"event_type":"session_input","event":{"channel_id":0,"input":"true"}}
+{"source":%[1]v,"event_type":"session_command","event":{"channel_id":0,"command":"true","tree":[{"pipelines":[{"commands":[{"args":["true"]}]}]}]}}
 {"source":%[1]v,"event_type":"session_close","event":{"channel_id":0}}
 {"source":%[1]v,"event_type":"session","event":{"channel_id":1}}
 {"source":%[1]v,"event_type":"x11","event":{"channel_id":1,"screen":0}}
 {"source":%[1]v,"event_type":"env","event":{"channel_id":1,"name":"LANG","value":"en_IE.UTF-8"}}
 {"source":%[1]v,"event_type":"shell","event":{"channel_id":1}}
 {"source":%[1]v,"event_type":"session_input","event":{"channel_id":1,"input":"false"}}
+{"source":%[1]v,"event_type":"session_command","event":{"channel_id":1,"command":"false","tree":[{"pipelines":[{"commands":[{"args":["false"]}]}]}]}}
 {"source":%[1]v,"event_type":"session_input","event":{"channel_id":1,"input":"true"}}
+{"source":%[1]v,"event_type":"session_command","event":{"channel_id":1,"command":"true","tree":[{"pipelines":[{"commands":[{"args":["true"]}]}]}]}}
 {"source":%[1]v,"event_type":"session_close","event":{"channel_id":1}}
 {"source":%[1]v,"event_type":"session","event":{"channel_id":2}}
 {"source":%[1]v,"event_type":"x11","event":{"channel_id":2,"screen":0}}
 {"source":%[1]v,"event_type":"pty","event":{"channel_id":2,"terminal":"xterm-256color","width":80,"height":24}}
 {"source":%[1]v,"event_type":"env","event":{"channel_id":2,"name":"LANG","value":"en_IE.UTF-8"}}
 {"source":%[1]v,"event_type":"exec","event":{"channel_id":2,"command":"sh"}}
+{"source":%[1]v,"event_type":"session_command","event":{"channel_id":2,"command":"sh","tree":[{"pipelines":[{"commands":[{"args":["sh"]}]}]}]}}
 {"source":%[1]v,"event_type":"session_input","event":{"channel_id":2,"input":"false"}}
+{"source":%[1]v,"event_type":"session_command","event":{"channel_id":2,"command":"false","tree":[{"pipelines":[{"commands":[{"args":["false"]}]}]}]}}
 {"source":%[1]v,"event_type":"session_input","event":{"channel_id":2,"input":"true"}}
+{"source":%[1]v,"event_type":"session_command","event":{"channel_id":2,"command":"true","tree":[{"pipelines":[{"commands":[{"args":["true"]}]}]}]}}
 {"source":%[1]v,"event_type":"session_close","event":{"channel_id":2}}
 {"source":%[1]v,"event_type":"session","event":{"channel_id":3}}
 {"source":%[1]v,"event_type":"x11","event":{"channel_id":3,"screen":0}}
@@ -420,10 +441,13 @@ func TestSessionJSON(t *testing.T) {
 {"source":%[1]v,"event_type":"env","event":{"channel_id":3,"name":"LANG","value":"en_IE.UTF-8"}}
 {"source":%[1]v,"event_type":"shell","event":{"channel_id":3}}
 {"source":%[1]v,"event_type":"session_input","event":{"channel_id":3,"input":"false"}}
+{"source":%[1]v,"event_type":"session_command","event":{"channel_id":3,"command":"false","tree":[{"pipelines":[{"commands":[{"args":["false"]}]}]}]}}
 {"source":%[1]v,"event_type":"session_input","event":{"channel_id":3,"input":"true"}}
+{"source":%[1]v,"event_type":"session_command","event":{"channel_id":3,"command":"true","tree":[{"pipelines":[{"commands":[{"args":["true"]}]}]}]}}
 {"source":%[1]v,"event_type":"session_close","event":{"channel_id":3}}
+{"source":%[1]v,"event_type":"auth_summary","event":{"attempts":[{"index":0,"method":"none","user":"","elapsed_ms":0,"accepted":true}],"methods":["none"],"accepted":true}}
 {"source":%[1]v,"event_type":"connection_close","event":{}}
-`, string(escapedClientAddress))
+`, string(escapedClientAddress), goClientConnectionJSON, goClientHandshakeJSON)
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", logs, expectedLogs)
 	}
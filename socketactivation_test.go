@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestInheritListeners(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Socket activation is not supported on Windows")
+	}
+	if sockets, err := inheritListeners(listenFDsStart); sockets != nil || err != nil {
+		t.Fatalf("sockets=%v, err=%v, want nothing inherited", sockets, err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	// The descriptor is handed over to inheritListeners, which closes it.
+	file, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("Failed to get listener file: %v", err)
+	}
+	os.Setenv("LISTEN_PID", fmt.Sprint(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", "router")
+	sockets, err := inheritListeners(int(file.Fd()))
+	if err != nil {
+		t.Fatalf("Failed to inherit sockets: %v", err)
+	}
+	for _, variable := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if value, ok := os.LookupEnv(variable); ok {
+			t.Errorf("%v=%q, want it unset", variable, value)
+		}
+	}
+	if len(sockets.listeners) != 1 || sockets.listeners[0].Addr().String() != listener.Addr().String() {
+		t.Fatalf("listeners=%v, want the socket on %v", sockets.listeners, listener.Addr())
+	}
+	if inherited := sockets.take(1, "router"); inherited != sockets.listeners[0] {
+		t.Errorf("take(1, router)=%v, want the socket named router", inherited)
+	}
+	if inherited := sockets.take(0, "ubuntu"); inherited != nil {
+		t.Errorf("take(0, ubuntu)=%v, want the socket taken only once", inherited)
+	}
+	sockets.closeUnused()
+	sockets.listeners[0].Close()
+}
+
+func TestInheritedSocketsByPosition(t *testing.T) {
+	var listeners []net.Listener
+	for i := 0; i < 3; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		defer listener.Close()
+		listeners = append(listeners, listener)
+	}
+	sockets := &inheritedSockets{listeners: listeners, used: make([]bool, len(listeners))}
+	if inherited := sockets.take(1, "router"); inherited != listeners[1] {
+		t.Errorf("take(1)=%v, want the second socket", inherited)
+	}
+	if inherited := sockets.take(0, ""); inherited != listeners[0] {
+		t.Errorf("take(0)=%v, want the first socket", inherited)
+	}
+	if inherited := sockets.take(3, ""); inherited != nil {
+		t.Errorf("take(3)=%v, want no socket", inherited)
+	}
+	sockets.closeUnused()
+	if _, err := net.Dial("tcp", listeners[2].Addr().String()); err == nil {
+		t.Errorf("Unused socket still open")
+	}
+	var none *inheritedSockets
+	if inherited := none.take(0, ""); inherited != nil {
+		t.Errorf("take on no sockets=%v, want nil", inherited)
+	}
+	none.closeUnused()
+}
@@ -0,0 +1,40 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"log/syslog"
+)
+
+type syslogSink struct {
+	writer *syslog.Writer
+	format string
+}
+
+// newSyslogSink connects to the local syslog daemon, or to a remote one if a
+// network and address are set.
+func newSyslogSink(sinkCfg logSinkConfig) (logSink, error) {
+	tag := sinkCfg.Tag
+	if tag == "" {
+		tag = "sshpot"
+	}
+	writer, err := syslog.Dial(sinkCfg.Network, sinkCfg.Address, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer: writer, format: sinkCfg.Format}, nil
+}
+
+func (sink *syslogSink) write(event loggedEvent) error {
+	// Syslog timestamps the messages itself.
+	line, err := formatLine(event, sink.format, false)
+	if err != nil {
+		return err
+	}
+	return sink.writer.Info(string(line))
+}
+
+func (sink *syslogSink) close() error {
+	return sink.writer.Close()
+}
@@ -0,0 +1,7 @@
+package main
+
+import "errors"
+
+func newSyslogSink(sinkCfg logSinkConfig) (logSink, error) {
+	return nil, errors.New("syslog is not supported on Windows")
+}
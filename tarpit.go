@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authDelay returns how long to wait before answering an authentication
+// attempt, given how many attempts the connection made before it.
+func (cfg *config) authDelay(previousAttempts int) time.Duration {
+	delayCfg := cfg.Auth.Delay
+	switch delayCfg.Mode {
+	case "fixed":
+		return delayCfg.Delay
+	case "jitter":
+		if delayCfg.Jitter <= 0 {
+			return delayCfg.Delay
+		}
+		return delayCfg.Delay + time.Duration(rand.Int63n(int64(delayCfg.Jitter)))
+	case "growing":
+		delay := delayCfg.Delay * time.Duration(previousAttempts+1)
+		if delayCfg.Max > 0 && delay > delayCfg.Max {
+			delay = delayCfg.Max
+		}
+		return delay
+	}
+	return 0
+}
+
+// delayAuth sleeps like PAM does before answering an authentication
+// attempt.
+func (cfg *config) delayAuth(conn ssh.ConnMetadata) {
+	if delay := cfg.authDelay(cfg.authTimelines.count(conn.SessionID())); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+func (cfg *config) setupAuthDelay() error {
+	switch cfg.Auth.Delay.Mode {
+	case "", "fixed", "jitter", "growing":
+		return nil
+	}
+	return fmt.Errorf("auth delay: unknown mode %q", cfg.Auth.Delay.Mode)
+}
+
+func (cfg *config) setupTarpit() error {
+	if cfg.SSHProto.Tarpit.Enabled && cfg.SSHProto.Tarpit.Interval <= 0 {
+		return errors.New("tarpit: interval must be positive")
+	}
+	return nil
+}
+
+// tarpitLines returns the banner as lines that may be sent before the SSH
+// version string. Lines starting with "SSH-" would be taken for the version
+// so they are indented.
+func tarpitLines(banner string) string {
+	if banner == "" {
+		banner = "\r\n"
+	}
+	lines := strings.SplitAfter(banner, "\r\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "SSH-") {
+			lines[i] = " " + line
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// tarpit trickles the banner to a new connection one byte per interval, as
+// lines preceding the SSH version string, until the tarpit duration elapses.
+// A zero duration keeps the client in the tarpit until it disconnects.
+func (cfg *config) tarpit(conn net.Conn) error {
+	tarpitCfg := cfg.SSHProto.Tarpit
+	text := tarpitLines(formatBanner(cfg.SSHProto.Banner))
+	deadline := time.Now().Add(tarpitCfg.Duration)
+	for {
+		for i := 0; i < len(text); i++ {
+			if tarpitCfg.Duration > 0 && time.Now().After(deadline) && (i == 0 || text[i-1] == '\n') {
+				return nil
+			}
+			if _, err := conn.Write([]byte{text[i]}); err != nil {
+				return err
+			}
+			time.Sleep(tarpitCfg.Interval)
+		}
+	}
+}
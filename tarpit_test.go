@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthDelay(t *testing.T) {
+	cfg := &config{}
+	if delay := cfg.authDelay(3); delay != 0 {
+		t.Errorf("delay=%v, want 0", delay)
+	}
+	cfg.Auth.Delay = authDelayConfig{Mode: "fixed", Delay: time.Second}
+	if delay := cfg.authDelay(3); delay != time.Second {
+		t.Errorf("delay=%v, want 1s", delay)
+	}
+	cfg.Auth.Delay = authDelayConfig{Mode: "jitter", Delay: time.Second, Jitter: time.Second}
+	for i := 0; i < 100; i++ {
+		if delay := cfg.authDelay(0); delay < time.Second || delay >= 2*time.Second {
+			t.Fatalf("delay=%v, want between 1s and 2s", delay)
+		}
+	}
+	cfg.Auth.Delay = authDelayConfig{Mode: "growing", Delay: time.Second, Max: 3 * time.Second}
+	for previous, expected := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		if delay := cfg.authDelay(previous); delay != expected {
+			t.Errorf("authDelay(%v)=%v, want %v", previous, delay, expected)
+		}
+	}
+	cfg.Auth.Delay.Mode = "random"
+	if err := cfg.setupAuthDelay(); err == nil {
+		t.Errorf("err=nil, want an error for an unknown mode")
+	}
+}
+
+func TestAuthCallbackDelay(t *testing.T) {
+	cfg := &config{}
+	cfg.Auth.PasswordAuth.Enabled = true
+	cfg.Auth.PublicKeyAuth.Enabled = true
+	cfg.Auth.Delay = authDelayConfig{Mode: "growing", Delay: 20 * time.Millisecond}
+	setupLogBuffer(t, cfg)
+	sessionID := mockConnContext{}.SessionID()
+	cfg.authTimelines.start(sessionID, time.Now())
+	defer cfg.authTimelines.finish(sessionID)
+	cfg.authTimelines.record(sessionID, "password", "root", nil)
+	started := time.Now()
+	cfg.getPasswordCallback()(mockConnContext{}, []byte("hunter2"))
+	if elapsed := time.Since(started); elapsed < 40*time.Millisecond {
+		t.Errorf("password elapsed=%v, want at least 40ms", elapsed)
+	}
+	key, _ := generateTestKey(t)
+	started = time.Now()
+	cfg.getPublicKeyCallback()(mockConnContext{}, key)
+	if elapsed := time.Since(started); elapsed < 40*time.Millisecond {
+		t.Errorf("public key elapsed=%v, want at least 40ms", elapsed)
+	}
+}
+
+func TestTarpit(t *testing.T) {
+	if lines := tarpitLines("hello\r\nSSH-2.0-fake\r\n"); lines != "hello\r\n SSH-2.0-fake\r\n" {
+		t.Errorf("lines=%q, want the version-like line indented", lines)
+	}
+	cfg := &config{}
+	cfg.SSHProto.Banner = "Authorized access only"
+	cfg.SSHProto.Tarpit = tarpitConfig{Enabled: true, Interval: time.Millisecond, Duration: 30 * time.Millisecond}
+	server, client := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- cfg.tarpit(server)
+		server.Close()
+	}()
+	reader := bufio.NewReader(client)
+	lines := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if line != "Authorized access only\r\n" {
+			t.Fatalf("line=%q, want the banner", line)
+		}
+		lines++
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Failed to tarpit: %v", err)
+	}
+	if lines < 1 {
+		t.Errorf("lines=%v, want at least 1", lines)
+	}
+}
+
+func TestTarpitDisconnect(t *testing.T) {
+	cfg := &config{}
+	cfg.SSHProto.Tarpit = tarpitConfig{Enabled: true, Interval: time.Millisecond}
+	server, client := net.Pipe()
+	done := make(chan error)
+	go func() { done <- cfg.tarpit(server) }()
+	buffer := make([]byte, 4)
+	if _, err := client.Read(buffer); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	client.Close()
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Errorf("err=%v, want a closed pipe error", err)
+	}
+}
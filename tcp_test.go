@@ -107,15 +107,17 @@ func TestTCP(t *testing.T) {
 
 	clientAddress := path.Join(dataDir, "client.sock")
 
-	logs := testTCP(t, dataDir, cfg, clientAddress)
+	logs := normalizeLogs(testTCP(t, dataDir, cfg, clientAddress))
 
 	expectedLogs := fmt.Sprintf(`[%[1]v] authentication for user "" without credentials accepted
-[%[1]v] connection with client version "SSH-2.0-Go" established
+[%[1]v] connection with client version "SSH-2.0-Go" and HASSH %[2]v established
+[%[1]v] handshake negotiated %[3]v
 [%[1]v] [channel 0] direct TCP/IP forwarding from localhost:8080 to example.org:80 requested
 [%[1]v] [channel 0] input: "GET / HTTP/1.1\r\n\r\n"
 [%[1]v] [channel 0] closed
+[%[1]v] authentication finished after 1 attempts with methods ["none"] accepted
 [%[1]v] connection closed
-`, clientAddress)
+`, clientAddress, goClientHASSH, goClientHandshake)
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", logs, expectedLogs)
 	}
@@ -138,19 +140,21 @@ func TestTCPJSON(t *testing.T) {
 
 	clientAddress := path.Join(dataDir, "client.sock")
 
-	logs := testTCP(t, dataDir, cfg, clientAddress)
+	logs := normalizeLogs(testTCP(t, dataDir, cfg, clientAddress))
 	escapedClientAddress, err := json.Marshal(clientAddress)
 	if err != nil {
 		t.Fatalf("Failed to escape clientAddress: %v", err)
 	}
 
 	expectedLogs := fmt.Sprintf(`{"source":%[1]v,"event_type":"no_auth","event":{"user":"","accepted":true}}
-{"source":%[1]v,"event_type":"connection","event":{"client_version":"SSH-2.0-Go"}}
+{"source":%[1]v,"event_type":"connection","event":%[2]v}
+{"source":%[1]v,"event_type":"handshake","event":%[3]v}
 {"source":%[1]v,"event_type":"direct_tcpip","event":{"channel_id":0,"from":"localhost:8080","to":"example.org:80"}}
 {"source":%[1]v,"event_type":"direct_tcpip_input","event":{"channel_id":0,"input":"GET / HTTP/1.1\r\n\r\n"}}
 {"source":%[1]v,"event_type":"direct_tcpip_close","event":{"channel_id":0}}
+{"source":%[1]v,"event_type":"auth_summary","event":{"attempts":[{"index":0,"method":"none","user":"","elapsed_ms":0,"accepted":true}],"methods":["none"],"accepted":true}}
 {"source":%[1]v,"event_type":"connection_close","event":{}}
-`, string(escapedClientAddress))
+`, string(escapedClientAddress), goClientConnectionJSON, goClientHandshakeJSON)
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", logs, expectedLogs)
 	}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 	"path"
+	"regexp"
 	"testing"
 
 	"golang.org/x/crypto/ssh"
@@ -47,7 +48,26 @@ func setupLogBuffer(t *testing.T, cfg *config) *bytes.Buffer {
 	if err := cfg.setupLogging(); err != nil {
 		t.Fatalf("Failed to setup logging: %v", err)
 	}
+	cfg.applyLogging()
 	buffer := &bytes.Buffer{}
 	log.SetOutput(buffer)
 	return buffer
 }
+
+var elapsedPattern = regexp.MustCompile(`"elapsed_ms":[0-9]+`)
+
+// normalizeLogs zeroes timings that vary between runs so logs can be
+// compared exactly.
+func normalizeLogs(logs string) string {
+	return elapsedPattern.ReplaceAllString(logs, `"elapsed_ms":0`)
+}
+
+// goClientHASSH is the HASSH of the KEXINIT sent by the Go SSH client used in
+// tests, goClientConnectionJSON the connection event it produces and
+// goClientHandshake the algorithms it negotiates with an ECDSA host key.
+const (
+	goClientHandshake      = "kex curve25519-sha256@libssh.org and host key ecdsa-sha2-nistp256, client to server aes128-gcm@openssh.com/<implicit>/none, server to client aes128-gcm@openssh.com/<implicit>/none"
+	goClientHandshakeJSON  = `{"kex":"curve25519-sha256@libssh.org","host_key":"ecdsa-sha2-nistp256","cipher_client_to_server":"aes128-gcm@openssh.com","cipher_server_to_client":"aes128-gcm@openssh.com","mac_client_to_server":"","mac_server_to_client":"","compression_client_to_server":"none","compression_server_to_client":"none"}`
+	goClientHASSH          = "98ddc5604ef6a1006a2b49a58759fbe6"
+	goClientConnectionJSON = `{"client_version":"SSH-2.0-Go","hassh":"98ddc5604ef6a1006a2b49a58759fbe6","hassh_algorithms":"curve25519-sha256@libssh.org,ecdh-sha2-nistp256,ecdh-sha2-nistp384,ecdh-sha2-nistp521,diffie-hellman-group14-sha1;aes128-gcm@openssh.com,chacha20-poly1305@openssh.com,aes128-ctr,aes192-ctr,aes256-ctr;hmac-sha2-256-etm@openssh.com,hmac-sha2-256,hmac-sha1,hmac-sha1-96;none","hassh_server":"98ddc5604ef6a1006a2b49a58759fbe6","client_kex_init":{"kex_algorithms":["curve25519-sha256@libssh.org","ecdh-sha2-nistp256","ecdh-sha2-nistp384","ecdh-sha2-nistp521","diffie-hellman-group14-sha1"],"server_host_key_algorithms":["ssh-rsa-cert-v01@openssh.com","ssh-dss-cert-v01@openssh.com","ecdsa-sha2-nistp256-cert-v01@openssh.com","ecdsa-sha2-nistp384-cert-v01@openssh.com","ecdsa-sha2-nistp521-cert-v01@openssh.com","ssh-ed25519-cert-v01@openssh.com","ecdsa-sha2-nistp256","ecdsa-sha2-nistp384","ecdsa-sha2-nistp521","ssh-rsa","ssh-dss","ssh-ed25519"],"encryption_algorithms_client_to_server":["aes128-gcm@openssh.com","chacha20-poly1305@openssh.com","aes128-ctr","aes192-ctr","aes256-ctr"],"encryption_algorithms_server_to_client":["aes128-gcm@openssh.com","chacha20-poly1305@openssh.com","aes128-ctr","aes192-ctr","aes256-ctr"],"mac_algorithms_client_to_server":["hmac-sha2-256-etm@openssh.com","hmac-sha2-256","hmac-sha1","hmac-sha1-96"],"mac_algorithms_server_to_client":["hmac-sha2-256-etm@openssh.com","hmac-sha2-256","hmac-sha1","hmac-sha1-96"],"compression_algorithms_client_to_server":["none"],"compression_algorithms_server_to_client":["none"]}}`
+)
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// userPermissionsExtension is the ssh.Permissions extension carrying the name
+// of the account a client authenticated as.
+const userPermissionsExtension = "sshpot-user"
+
+// userAccount is a configured account with its authorized keys parsed.
+type userAccount struct {
+	userConfig
+	authorizedKeys []authorizedKey
+}
+
+func newUserAccount(userCfg userConfig) (*userAccount, error) {
+	if userCfg.Name == "" || strings.ContainsAny(userCfg.Name, ":\n/") {
+		return nil, fmt.Errorf("invalid name %q", userCfg.Name)
+	}
+	if userCfg.Home == "" {
+		if userCfg.UID == 0 {
+			userCfg.Home = "/root"
+		} else {
+			userCfg.Home = path.Join("/home", userCfg.Name)
+		}
+	}
+	if userCfg.Shell == "" {
+		userCfg.Shell = "/bin/bash"
+	}
+	if userCfg.PasswordHash != "" && !passwordLocked(userCfg.PasswordHash) {
+		if _, err := bcrypt.Cost([]byte(userCfg.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("password_hash: %w", err)
+		}
+	}
+	authorizedKeys, err := parseAuthorizedKeys([]byte(strings.Join(userCfg.AuthorizedKeys, "\n")))
+	if err != nil {
+		return nil, fmt.Errorf("authorized_keys: %w", err)
+	}
+	return &userAccount{userConfig: userCfg, authorizedKeys: authorizedKeys}, nil
+}
+
+// passwordLocked reports whether a password hash disables password logins,
+// as "*" and "!" prefixes do in /etc/shadow.
+func passwordLocked(hash string) bool {
+	return strings.HasPrefix(hash, "*") || strings.HasPrefix(hash, "!")
+}
+
+// authenticate decides an attempt against the account's credentials. It
+// returns false for decided when the account has no credentials for the
+// attempt's method, leaving the decision to the other auth settings.
+func (account *userAccount) authenticate(request authRequest) (decided bool, accepted bool) {
+	switch request.Method {
+	case "password", "keyboard_interactive":
+		if account.PasswordHash == "" {
+			return false, false
+		}
+		if passwordLocked(account.PasswordHash) {
+			return true, false
+		}
+		for _, password := range request.Passwords {
+			if bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(password)) == nil {
+				return true, true
+			}
+		}
+		return true, false
+	case "public_key":
+		if len(account.authorizedKeys) == 0 {
+			return false, false
+		}
+		return true, authorizes(account.authorizedKeys, request)
+	}
+	return false, false
+}
+
+func (cfg *config) setupUsers() error {
+	cfg.users = map[string]*userAccount{}
+	for i, userCfg := range cfg.Users {
+		account, err := newUserAccount(userCfg)
+		if err != nil {
+			return fmt.Errorf("user %v: %w", i, err)
+		}
+		if _, ok := cfg.users[account.Name]; ok {
+			return fmt.Errorf("user %v: duplicate name %q", i, account.Name)
+		}
+		cfg.users[account.Name] = account
+	}
+	return nil
+}
+
+// permissions returns the permissions granted to a client that authenticated
+// as user, recording the account so the connection can find it.
+func (cfg *config) permissions(user string) *ssh.Permissions {
+	if _, ok := cfg.users[user]; !ok {
+		return nil
+	}
+	return &ssh.Permissions{Extensions: map[string]string{userPermissionsExtension: user}}
+}
+
+// account returns the account a connection authenticated as, or nil if the
+// client is not logged in as a configured user.
+func (cfg *config) account(permissions *ssh.Permissions) *userAccount {
+	if permissions == nil {
+		return nil
+	}
+	return cfg.users[permissions.Extensions[userPermissionsExtension]]
+}
+
+// variables returns the login environment of the account.
+func (account *userAccount) variables() map[string]string {
+	return map[string]string{
+		"HOME":    account.Home,
+		"LOGNAME": account.Name,
+		"PS1":     `\u@\h:\w\$ `,
+		"SHELL":   account.Shell,
+		"USER":    account.Name,
+	}
+}
+
+// setEntry replaces the line of a passwd or group style file whose first
+// field is name, or appends one if there is none.
+func setEntry(content string, name string, entry string) string {
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	if content == "" {
+		lines = nil
+	}
+	for i, line := range lines {
+		if strings.SplitN(line, ":", 2)[0] == name {
+			lines[i] = entry
+			return strings.Join(lines, "\n") + "\n"
+		}
+	}
+	return strings.Join(append(lines, entry), "\n") + "\n"
+}
+
+// hasEntryID reports whether a passwd or group style file has an entry with
+// the given numeric ID.
+func hasEntryID(content string, id uint32) bool {
+	for _, line := range strings.Split(content, "\n") {
+		if fields := strings.Split(line, ":"); len(fields) > 2 && fields[2] == fmt.Sprint(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// addUserFiles adds the configured accounts to /etc/passwd and /etc/group and
+// creates their home directories.
+func (cfg *config) addUserFiles(filesystem *virtualFilesystem) error {
+	if len(cfg.users) == 0 {
+		return nil
+	}
+	passwd, _ := filesystem.readFile("/etc/passwd")
+	group, _ := filesystem.readFile("/etc/group")
+	passwdContent, groupContent := string(passwd), string(group)
+	for _, userCfg := range cfg.Users {
+		account := cfg.users[userCfg.Name]
+		passwdContent = setEntry(passwdContent, account.Name, fmt.Sprintf("%v:x:%v:%v::%v:%v", account.Name, account.UID, account.GID, account.Home, account.Shell))
+		if !hasEntryID(groupContent, account.GID) {
+			groupContent = setEntry(groupContent, account.Name, fmt.Sprintf("%v:x:%v:", account.Name, account.GID))
+		}
+		if _, err := filesystem.stat(account.Home); err != nil {
+			if err := filesystem.mkdirAll(account.Home, 0755); err != nil {
+				return err
+			}
+			if err := filesystem.chmod(account.Home, 0750); err != nil {
+				return err
+			}
+			if err := filesystem.chown(account.Home, fileOwner{account.UID, account.GID}); err != nil {
+				return err
+			}
+		}
+	}
+	if err := filesystem.mkdirAll("/etc", 0755); err != nil {
+		return err
+	}
+	if err := filesystem.writeFile("/etc/passwd", []byte(passwdContent), 0644); err != nil {
+		return err
+	}
+	return filesystem.writeFile("/etc/group", []byte(groupContent), 0644)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestUserStore(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	sshKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("Failed to convert key: %v", err)
+	}
+	cfg := &config{}
+	cfg.Users = []userConfig{
+		{Name: "alice", UID: 1000, GID: 1000, PasswordHash: string(hash)},
+		{Name: "git", UID: 1001, GID: 1001, AuthorizedKeys: []string{string(ssh.MarshalAuthorizedKey(sshKey))}},
+		{Name: "nobody", UID: 65534, GID: 65534, PasswordHash: "*"},
+	}
+	if err := cfg.setupUsers(); err != nil {
+		t.Fatalf("Failed to set up users: %v", err)
+	}
+	if home := cfg.users["alice"].Home; home != "/home/alice" {
+		t.Errorf("home=%v, want /home/alice", home)
+	}
+	for _, test := range []struct {
+		request  authRequest
+		fallback bool
+		expected bool
+	}{
+		{authRequest{Method: "password", User: "alice", Passwords: []string{"hunter2"}}, false, true},
+		{authRequest{Method: "password", User: "alice", Passwords: []string{"123456"}}, true, false},
+		{authRequest{Method: "keyboard_interactive", User: "alice", Passwords: []string{"alice", "hunter2"}}, false, true},
+		{authRequest{Method: "public_key", User: "alice", KeyFingerprint: ssh.FingerprintSHA256(sshKey)}, true, true},
+		{authRequest{Method: "public_key", User: "git", KeyFingerprint: ssh.FingerprintSHA256(sshKey)}, false, true},
+		{authRequest{Method: "public_key", User: "git", KeyFingerprint: "SHA256:other"}, true, false},
+		{authRequest{Method: "password", User: "nobody", Passwords: []string{"*"}}, true, false},
+		{authRequest{Method: "password", User: "mallory", Passwords: []string{"hunter2"}}, false, false},
+	} {
+		if accepted := cfg.authenticate(test.request, test.fallback); accepted != test.expected {
+			t.Errorf("authenticate(%+v)=%v, want %v", test.request, accepted, test.expected)
+		}
+	}
+
+	if permissions := cfg.permissions("mallory"); permissions != nil {
+		t.Errorf("permissions=%v, want nil", permissions)
+	}
+	if account := cfg.account(cfg.permissions("alice")); account != cfg.users["alice"] {
+		t.Errorf("account=%v, want alice", account)
+	}
+
+	for _, invalid := range []userConfig{{}, {Name: "a:b"}, {Name: "bob", PasswordHash: "plaintext"}, {Name: "bob", AuthorizedKeys: []string{"garbage"}}} {
+		cfg := &config{Users: []userConfig{invalid}}
+		if err := cfg.setupUsers(); err == nil {
+			t.Errorf("setupUsers(%+v)=nil, want an error", invalid)
+		}
+	}
+}
+
+func TestUserShell(t *testing.T) {
+	cfg := &config{Persona: getDefaultPersona()}
+	cfg.Users = []userConfig{{Name: "alice", UID: 1000, GID: 1000}, {Name: "root", Shell: "/bin/sh"}}
+	if err := cfg.setupUsers(); err != nil {
+		t.Fatalf("Failed to set up users: %v", err)
+	}
+	filesystem := cfg.newFilesystem()
+	passwd, err := filesystem.readFile("/etc/passwd")
+	if err != nil {
+		t.Fatalf("Failed to read /etc/passwd: %v", err)
+	}
+	if !strings.HasPrefix(string(passwd), "root:x:0:0::/root:/bin/sh\n") || !strings.HasSuffix(string(passwd), "\nalice:x:1000:1000::/home/alice:/bin/bash\n") {
+		t.Errorf("passwd=%q, want root replaced and alice appended", passwd)
+	}
+	if info, err := filesystem.stat("/home/alice"); err != nil || !info.IsDir() {
+		t.Errorf("/home/alice is not a directory: %v", err)
+	}
+
+	account := cfg.users["alice"]
+	stdout := &bytes.Buffer{}
+	status, err := executeProgram(commandContext{
+		args:       []string{"sh"},
+		stdin:      newReaderReadLiner(strings.NewReader("id; whoami; echo $HOME\ncd /tmp\n")),
+		stdout:     stdout,
+		stderr:     stdout,
+		pty:        true,
+		filesystem: filesystem,
+		env:        newShellEnvironment(account.Home, account.variables()),
+		cfg:        cfg,
+	})
+	if err != nil {
+		t.Fatalf("Failed to execute program: %v", err)
+	}
+	if status != 0 {
+		t.Errorf("status=%v, want 0", status)
+	}
+	expected := "alice@ubuntu:~$ uid=1000(alice) gid=1000(alice) groups=1000(alice)\nalice\n/home/alice\nalice@ubuntu:~$ alice@ubuntu:/tmp$ "
+	if stdout.String() != expected {
+		t.Errorf("stdout=%q, want %q", stdout.String(), expected)
+	}
+}